@@ -8,6 +8,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"sync"
 	"time"
@@ -19,13 +20,19 @@ func main() {
 	host := flag.String("host", "localhost:8080", "Server host:port")
 	workers := flag.Int("workers", 900, "Number of worker threads")
 	totalMessages := flag.Int("messages", 500000, "Total number of messages to send")
+	compress := flag.Bool("compress", false, "Offer permessage-deflate compression to the server")
 	flag.Parse()
 
-	fmt.Printf("Starting Client Part 1 with host=%s, workers=%d, messages=%d\n", *host, *workers, *totalMessages)
+	fmt.Printf("Starting Client Part 1 with host=%s, workers=%d, messages=%d, compress=%t\n", *host, *workers, *totalMessages, *compress)
+
+	// Wait until the server reports it can take connections
+	if err := waitForReady(*host, 30*time.Second); err != nil {
+		log.Fatalf("Server not ready: %v", err)
+	}
 
 	// Warmup Phase
 	fmt.Println("\n--- Starting Warmup Phase ---")
-	warmupDuration := runWarmup(*host, *workers, 1000)
+	warmupDuration := runWarmup(*host, *workers, 1000, pool.NewDialer(*compress, nil))
 	fmt.Println("--- Warmup Complete ---")
 
 	// Little's Law Analysis
@@ -51,7 +58,7 @@ func main() {
 	go gen.Run()
 
 	// pool
-	p := pool.NewPool(*workers, gen.Output, collector, *host)
+	p := pool.NewPool(*workers, gen.Output, collector, *host, pool.NewDialer(*compress, collector))
 	
 	start := time.Now()
 	p.Run()
@@ -66,7 +73,7 @@ func main() {
 	fmt.Printf("Wall Time: %.2f seconds\n", duration.Seconds())
 }
 
-func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
+func runWarmup(host string, numWorkers int, msgsPerWorker int, dialer *websocket.Dialer) time.Duration {
 	var wg sync.WaitGroup
 	start := time.Now()
 
@@ -77,7 +84,7 @@ func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
 			
 			// Simple dial and send loop
 			u := url.URL{Scheme: "ws", Host: host, Path: "/chat/1"}
-			conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+			conn, _, err := dialer.Dial(u.String(), nil)
 			if err != nil {
 				log.Printf("Warmup worker %d failed to connect: %v", id, err)
 				return
@@ -100,7 +107,7 @@ func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
 				}
 				
 				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-				_, _, err := conn.ReadMessage()
+				_, err := pool.ReadResponse(conn)
 				if err != nil {
 					log.Printf("Warmup worker %d failed read: %v", id, err)
 					return
@@ -113,3 +120,27 @@ func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
 	fmt.Printf("Warmup finished in %.2f seconds\n", duration.Seconds())
 	return duration
 }
+
+// waitForReady polls the server's readiness probe until it answers 200 or the timeout expires
+func waitForReady(host string, timeout time.Duration) error {
+	u := url.URL{Scheme: "http", Host: host, Path: "/health/ready"}
+	client := http.Client{Timeout: 2 * time.Second}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		resp, err := client.Get(u.String())
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("readiness returned %s", resp.Status)
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+		fmt.Printf("Waiting for server to become ready: %v\n", err)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +18,10 @@ type Collector struct {
 	records    chan Record
 	Done       chan struct{}
 	Stats      Statistics
+
+	// Raw bytes on the wire, counted from the dialer's connections
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
 }
 
 type Statistics struct {
@@ -74,6 +79,19 @@ func (c *Collector) RecordRetry() {
 	c.records <- Record{StatusCode: "RETRY"}
 }
 
+func (c *Collector) AddBytesSent(n int) {
+	c.bytesSent.Add(int64(n))
+}
+
+func (c *Collector) AddBytesReceived(n int) {
+	c.bytesReceived.Add(int64(n))
+}
+
+// WireBytes returns the raw bytes sent and received so far
+func (c *Collector) WireBytes() (sent, received int64) {
+	return c.bytesSent.Load(), c.bytesReceived.Load()
+}
+
 func (c *Collector) Close() {
 	close(c.records)
 }
@@ -90,5 +108,16 @@ func (c *Collector) PrintSummary() {
 	fmt.Printf("Throughput: %.2f msg/sec\n", throughput)
 	fmt.Printf("Total Connections: %d\n", c.Stats.TotalConnections)
 	fmt.Printf("Total Retries: %d\n", c.Stats.RetryCount)
+	c.printWireBytes()
 	fmt.Println("=========================================")
 }
+
+func (c *Collector) printWireBytes() {
+	sent, received := c.WireBytes()
+	fmt.Printf("Bytes Sent (wire): %d\n", sent)
+	fmt.Printf("Bytes Received (wire): %d\n", received)
+	if c.Stats.TotalMessages > 0 {
+		fmt.Printf("Wire Bytes per Message: %.1f sent, %.1f received\n",
+			float64(sent)/float64(c.Stats.TotalMessages), float64(received)/float64(c.Stats.TotalMessages))
+	}
+}
@@ -8,6 +8,10 @@ const (
 	MessageTypeLeave = "LEAVE"
 )
 
+// StatusBroadcast marks a frame relaying another member's message rather
+// than answering one of ours
+const StatusBroadcast = "BROADCAST"
+
 type Message struct {
 	UserId      string    `json:"userId"`
 	Username    string    `json:"username"`
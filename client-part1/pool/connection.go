@@ -18,16 +18,18 @@ type Worker struct {
 	Input     <-chan model.Message
 	Collector *metrics.Collector
 	Host      string
+	Dialer    *websocket.Dialer
 	Conns     map[string]*websocket.Conn
 	mu        sync.Mutex
 }
 
-func NewWorker(id int, input <-chan model.Message, collector *metrics.Collector, host string) *Worker {
+func NewWorker(id int, input <-chan model.Message, collector *metrics.Collector, host string, dialer *websocket.Dialer) *Worker {
 	return &Worker{
 		ID:        id,
 		Input:     input,
 		Collector: collector,
 		Host:      host,
+		Dialer:    dialer,
 		Conns:     make(map[string]*websocket.Conn),
 	}
 }
@@ -50,7 +52,7 @@ func (w *Worker) getConnection(roomId string) (*websocket.Conn, error) {
 	}
 
 	u := url.URL{Scheme: "ws", Host: w.Host, Path: fmt.Sprintf("/chat/%s", roomId)}
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, _, err := w.Dialer.Dial(u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -121,10 +123,9 @@ func (w *Worker) sendMessage(msg model.Message) error {
 	// Set deadline for read
 	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
 	
-	// Read response (Echo)
-	// We use RawMessage to avoid full parsing if we don't need it, but we need to check ID/Status ideally.
-	// For performance test, just successfully reading a JSON is good enough proof of roundtrip.
-	_, _, err = conn.ReadMessage()
+	// Read response (Echo), skipping broadcasts from other members of the room.
+	// For performance test, just successfully reading our response is good enough proof of roundtrip.
+	_, err = ReadResponse(conn)
 	if err != nil {
 		return err
 	}
@@ -137,14 +138,16 @@ type Pool struct {
 	GeneratorInput <-chan model.Message
 	Collector  *metrics.Collector
 	Host       string
+	Dialer     *websocket.Dialer
 }
 
-func NewPool(numWorkers int, input <-chan model.Message, collector *metrics.Collector, host string) *Pool {
+func NewPool(numWorkers int, input <-chan model.Message, collector *metrics.Collector, host string, dialer *websocket.Dialer) *Pool {
 	return &Pool{
 		NumWorkers: numWorkers,
 		GeneratorInput: input,
 		Collector:  collector,
 		Host:       host,
+		Dialer:     dialer,
 	}
 }
 
@@ -152,7 +155,7 @@ func (p *Pool) Run() {
 	var wg sync.WaitGroup
 	for i := 0; i < p.NumWorkers; i++ {
 		wg.Add(1)
-		worker := NewWorker(i, p.GeneratorInput, p.Collector, p.Host)
+		worker := NewWorker(i, p.GeneratorInput, p.Collector, p.Host, p.Dialer)
 		go worker.Run(&wg)
 	}
 	wg.Wait()
@@ -0,0 +1,47 @@
+package pool
+
+import (
+	"chatroom/client-part1/metrics"
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewDialer returns a websocket dialer that optionally offers
+// permessage-deflate and, if collector is set, counts bytes on the wire
+func NewDialer(compress bool, collector *metrics.Collector) *websocket.Dialer {
+	netDialer := &net.Dialer{Timeout: 10 * time.Second}
+	return &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  45 * time.Second,
+		EnableCompression: compress,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := netDialer.DialContext(ctx, network, addr)
+			if err != nil || collector == nil {
+				return conn, err
+			}
+			return &countingConn{Conn: conn, collector: collector}, nil
+		},
+	}
+}
+
+// countingConn reports the raw bytes read and written, i.e. after compression
+type countingConn struct {
+	net.Conn
+	collector *metrics.Collector
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.collector.AddBytesReceived(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.collector.AddBytesSent(n)
+	return n, err
+}
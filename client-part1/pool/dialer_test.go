@@ -0,0 +1,84 @@
+package pool
+
+import (
+	"chatroom/client-part1/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newEchoServer echoes every frame back and accepts permessage-deflate
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, p); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// echoBytes sends frames of text through an echo server and returns the
+// bytes the collector counted
+func echoBytes(t *testing.T, url string, compress bool, text string) (sent, received int64) {
+	t.Helper()
+	collector := metrics.NewCollector()
+	conn, _, err := NewDialer(compress, collector).Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if _, p, err := conn.ReadMessage(); err != nil || string(p) != text {
+			t.Fatalf("echo: %v", err)
+		}
+	}
+	return collector.WireBytes()
+}
+
+func TestDialerCountsWireBytes(t *testing.T) {
+	url := newEchoServer(t)
+	text := strings.Repeat(`{"userId":"42","message":"hello"}`, 100)
+	payload := int64(10 * len(text))
+
+	sent, received := echoBytes(t, url, false, text)
+	if sent < payload || received < payload {
+		t.Fatalf("uncompressed: sent %d, received %d, want at least %d each", sent, received, payload)
+	}
+
+	compressedSent, compressedReceived := echoBytes(t, url, true, text)
+	if compressedSent == 0 || compressedReceived == 0 {
+		t.Fatal("compressed traffic not counted")
+	}
+	if compressedSent > sent/4 || compressedReceived > received/4 {
+		t.Errorf("compressed: sent %d, received %d; uncompressed: sent %d, received %d",
+			compressedSent, compressedReceived, sent, received)
+	}
+}
+
+func TestDialerWithoutCollector(t *testing.T) {
+	conn, _, err := NewDialer(true, nil).Dial(newEchoServer(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,27 @@
+package pool
+
+import (
+	"chatroom/client-part1/model"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// ReadResponse reads frames until it gets the server's answer to our last
+// message, skipping the broadcasts of other room members in between
+func ReadResponse(conn *websocket.Conn) (model.ServerResponse, error) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return model.ServerResponse{}, err
+		}
+
+		var response model.ServerResponse
+		if err := json.Unmarshal(data, &response); err != nil {
+			return model.ServerResponse{}, err
+		}
+		if response.Status != model.StatusBroadcast {
+			return response, nil
+		}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"chatroom/client-part2/metrics"
 	"chatroom/client-part2/model"
 	"chatroom/client-part2/pool"
+	"chatroom/codec"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"sync"
@@ -20,13 +22,30 @@ func main() {
 	host := flag.String("host", "localhost:8080", "Server host:port")
 	workers := flag.Int("workers", 32, "Number of worker threads")
 	totalMessages := flag.Int("messages", 500000, "Total number of messages to send")
+	compress := flag.Bool("compress", false, "Offer permessage-deflate compression to the server")
+	codecName := flag.String("codec", "json", "Frame encoding: json, msgpack or proto")
+	batchSize := flag.Int("batch", 1, "Messages per frame; above 1 sends JSON arrays (json codec only)")
+	resume := flag.Bool("resume", false, "Open connections with HELLO and resume their sessions after a reconnect")
 	flag.Parse()
 
-	fmt.Printf("Starting Client with host=%s, workers=%d, messages=%d\n", *host, *workers, *totalMessages)
+	cdc, ok := codec.ForProtocol("chat." + *codecName + ".v1")
+	if !ok {
+		log.Fatalf("Unknown codec %q (want json, msgpack or proto)", *codecName)
+	}
+	if *batchSize < 1 || (*batchSize > 1 && cdc != codec.JSON) {
+		log.Fatalf("-batch must be at least 1, and batches require -codec json")
+	}
+
+	fmt.Printf("Starting Client with host=%s, workers=%d, messages=%d, compress=%t, codec=%s, batch=%d\n", *host, *workers, *totalMessages, *compress, cdc.Name(), *batchSize)
+
+	// Wait until the server reports it can take connections
+	if err := waitForReady(*host, 30*time.Second); err != nil {
+		log.Fatalf("Server not ready: %v", err)
+	}
 
 	// Warmup Phase
 	fmt.Println("\n--- Starting Warmup Phase ---")
-	warmupDuration := runWarmup(*host, *workers, 1000)
+	warmupDuration := runWarmup(*host, *workers, 1000, pool.NewDialer(*compress, cdc, nil), cdc)
 	fmt.Println("--- Warmup Complete ---")
 
 	// Little's Law Analysis
@@ -63,7 +82,9 @@ func main() {
 	go gen.Run()
 
 	// pool
-	p := pool.NewPool(*workers, gen.Output, collector, *host)
+	p := pool.NewPool(*workers, gen.Output, collector, *host, pool.NewDialer(*compress, cdc, collector), cdc)
+	p.BatchSize = *batchSize
+	p.Resume = *resume
 	
 	start := time.Now()
 	p.Run()
@@ -85,7 +106,7 @@ func main() {
 	}
 }
 
-func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
+func runWarmup(host string, numWorkers int, msgsPerWorker int, dialer *websocket.Dialer, cdc codec.Codec) time.Duration {
 	var wg sync.WaitGroup
 	start := time.Now()
 
@@ -97,12 +118,16 @@ func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
 			// Simple dial and send loop
 			// We just pick a random room (e.g., "1") for warmup
 			u := url.URL{Scheme: "ws", Host: host, Path: "/chat/1"}
-			conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+			conn, _, err := dialer.Dial(u.String(), nil)
 			if err != nil {
 				log.Printf("Warmup worker %d failed to connect: %v", id, err)
 				return
 			}
 			defer conn.Close()
+			if err := pool.CheckSubprotocol(conn, cdc); err != nil {
+				log.Printf("Warmup worker %d: %v", id, err)
+				return
+			}
 
 			for j := 0; j < msgsPerWorker; j++ {
 				msg := model.Message{
@@ -113,14 +138,20 @@ func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
 					MessageType: "TEXT",
 				}
 				
+				data, err := cdc.Marshal(msg)
+				if err != nil {
+					log.Printf("Warmup worker %d failed to encode: %v", id, err)
+					return
+				}
+
 				conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-				if err := conn.WriteJSON(msg); err != nil {
+				if err := conn.WriteMessage(cdc.FrameType(), data); err != nil {
 					log.Printf("Warmup worker %d failed write: %v", id, err)
 					return // Stop this worker on error
 				}
 				
 				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-				_, _, err := conn.ReadMessage()
+				_, err = pool.ReadResponse(conn, cdc)
 				if err != nil {
 					log.Printf("Warmup worker %d failed read: %v", id, err)
 					return
@@ -133,3 +164,27 @@ func runWarmup(host string, numWorkers int, msgsPerWorker int) time.Duration {
 	fmt.Printf("Warmup finished in %.2f seconds\n", duration.Seconds())
 	return duration
 }
+
+// waitForReady polls the server's readiness probe until it answers 200 or the timeout expires
+func waitForReady(host string, timeout time.Duration) error {
+	u := url.URL{Scheme: "http", Host: host, Path: "/health/ready"}
+	client := http.Client{Timeout: 2 * time.Second}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		resp, err := client.Get(u.String())
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("readiness returned %s", resp.Status)
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+		fmt.Printf("Waiting for server to become ready: %v\n", err)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +26,10 @@ type Collector struct {
 	csvFile    *os.File
 	csvWriter  *csv.Writer
 	Stats      Statistics
+
+	// Raw bytes on the wire, counted from the dialer's connections
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
 }
 
 type Statistics struct {
@@ -32,6 +37,7 @@ type Statistics struct {
 	SuccessCount     int
 	FailCount        int
 	TotalConnections int
+	ResumedSessions  int
 	RetryCount       int
 	TotalLatency     int64
 	MinLatency       int64
@@ -43,6 +49,7 @@ type Statistics struct {
 	Latencies         []int64
 	RoomCounts        map[string]int
 	TypeCounts        map[string]int
+	ErrorCounts       map[string]int // by status code: the server's error code, or ERROR when sending failed
 	ThroughputBuckets map[int64]int // Unix timestamp (10s bucket) -> count
 }
 
@@ -67,6 +74,7 @@ func NewCollector(filePath string) (*Collector, error) {
 			Latencies:         make([]int64, 0),
 			RoomCounts:        make(map[string]int),
 			TypeCounts:        make(map[string]int),
+			ErrorCounts:       make(map[string]int),
 			ThroughputBuckets: make(map[int64]int),
 		},
 	}, nil
@@ -85,6 +93,10 @@ func (c *Collector) Start() {
 				c.Stats.TotalConnections++
 				continue
 			}
+			if r.StatusCode == "CONN_RESUMED" {
+				c.Stats.ResumedSessions++
+				continue
+			}
 			if r.StatusCode == "RETRY" {
 				c.Stats.RetryCount++
 				continue
@@ -112,6 +124,7 @@ func (c *Collector) Start() {
 
 			} else {
 				c.Stats.FailCount++
+				c.Stats.ErrorCounts[r.StatusCode]++
 			}
 
 			c.csvWriter.Write([]string{
@@ -133,10 +146,28 @@ func (c *Collector) RecordConnection() {
 	c.records <- Record{StatusCode: "CONN_NEW"}
 }
 
+// RecordResume counts a reconnect that resumed its session
+func (c *Collector) RecordResume() {
+	c.records <- Record{StatusCode: "CONN_RESUMED"}
+}
+
 func (c *Collector) RecordRetry() {
 	c.records <- Record{StatusCode: "RETRY"}
 }
 
+func (c *Collector) AddBytesSent(n int) {
+	c.bytesSent.Add(int64(n))
+}
+
+func (c *Collector) AddBytesReceived(n int) {
+	c.bytesReceived.Add(int64(n))
+}
+
+// WireBytes returns the raw bytes sent and received so far
+func (c *Collector) WireBytes() (sent, received int64) {
+	return c.bytesSent.Load(), c.bytesReceived.Load()
+}
+
 func (c *Collector) Close() {
 	close(c.records)
 }
@@ -169,7 +200,11 @@ func (c *Collector) PrintSummary() {
 	fmt.Printf("Failed: %d\n", c.Stats.FailCount)
 	fmt.Printf("Throughput: %.2f msg/sec\n", throughput)
 	fmt.Printf("Total Connections: %d\n", c.Stats.TotalConnections)
+	if c.Stats.ResumedSessions > 0 {
+		fmt.Printf("Resumed Sessions: %d\n", c.Stats.ResumedSessions)
+	}
 	fmt.Printf("Total Retries: %d\n", c.Stats.RetryCount)
+	c.printWireBytes()
 	fmt.Printf("Avg Latency: %.2f ms\n", avgLatency)
 	fmt.Printf("Min Latency: %d ms\n", c.Stats.MinLatency)
 	fmt.Printf("Max Latency: %d ms\n", c.Stats.MaxLatency)
@@ -181,6 +216,18 @@ func (c *Collector) PrintSummary() {
 	for k, v := range c.Stats.TypeCounts {
 		fmt.Printf("%s: %d\n", k, v)
 	}
+
+	if len(c.Stats.ErrorCounts) > 0 {
+		fmt.Println("\n--- Error Breakdown ---")
+		codes := make([]string, 0, len(c.Stats.ErrorCounts))
+		for code := range c.Stats.ErrorCounts {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Printf("%s: %d\n", code, c.Stats.ErrorCounts[code])
+		}
+	}
 	
 	fmt.Println("================================")
 }
@@ -259,3 +306,13 @@ func (c *Collector) GenerateChart(filename string) error {
 	})
 }
 
+
+func (c *Collector) printWireBytes() {
+	sent, received := c.WireBytes()
+	fmt.Printf("Bytes Sent (wire): %d\n", sent)
+	fmt.Printf("Bytes Received (wire): %d\n", received)
+	if c.Stats.TotalMessages > 0 {
+		fmt.Printf("Wire Bytes per Message: %.1f sent, %.1f received\n",
+			float64(sent)/float64(c.Stats.TotalMessages), float64(received)/float64(c.Stats.TotalMessages))
+	}
+}
@@ -8,19 +8,58 @@ const (
 	MessageTypeLeave = "LEAVE"
 )
 
+// StatusBroadcast marks a frame relaying another member's message rather
+// than answering one of ours
+const StatusBroadcast = "BROADCAST"
+
 type Message struct {
-	UserId      string    `json:"userId"`
-	Username    string    `json:"username"`
-	Message     string    `json:"message"`
-	Timestamp   time.Time `json:"timestamp"`
-	MessageType string    `json:"messageType"`
+	UserId      string    `json:"userId" proto:"1"`
+	Username    string    `json:"username" proto:"2"`
+	Message     string    `json:"message" proto:"3"`
+	Timestamp   time.Time `json:"timestamp" proto:"4"`
+	MessageType string    `json:"messageType" proto:"5"`
 	RoomId      string    `json:"-"` // Not sent in JSON payload, but used for connection routing
 }
 
 type ServerResponse struct {
-	Message
-	ServerTimestamp time.Time `json:"serverTimestamp"`
-	Status          string    `json:"status"`
-	Error           string    `json:"error,omitempty"`
+	Message         `proto:"1"`
+	ServerTimestamp time.Time `json:"serverTimestamp" proto:"2"`
+	Status          string    `json:"status" proto:"3"`
+	Error           string    `json:"error,omitempty" proto:"4"`
+	Seq             uint64    `json:"seq,omitempty" proto:"5"`  // set on broadcasts
+	Code            string    `json:"code,omitempty" proto:"8"` // error code, with status ERROR
+}
+
+// StatusCode is what a response is recorded as: OK, or the server's error
+// code for a rejected message
+func (r ServerResponse) StatusCode() string {
+	if r.Status == "ERROR" && r.Code != "" {
+		return r.Code
+	}
+	return r.Status
+}
+
+// Handshake frames; see the server's model package for the full protocol
+const (
+	ControlTypeHello   = "HELLO"
+	ControlTypeWelcome = "WELCOME"
+	ProtocolVersion    = 2
+	FeatureHistory     = "history"
+)
+
+type Hello struct {
+	Type     string   `json:"type" proto:"1"`
+	Version  int      `json:"version" proto:"2"`
+	Features []string `json:"features,omitempty" proto:"3"`
+	Client   string   `json:"client,omitempty" proto:"4"`
+}
+
+// Welcome is the part of the server's answer to Hello the load client uses
+type Welcome struct {
+	Type        string   `json:"type" proto:"1"`
+	Version     int      `json:"version" proto:"2"`
+	Features    []string `json:"features" proto:"3"`
+	ResumeToken string   `json:"resumeToken,omitempty" proto:"7"`
+	Resumed     bool     `json:"resumed,omitempty" proto:"8"`
 }
 
@@ -0,0 +1,140 @@
+package pool
+
+import (
+	"bytes"
+	"chatroom/client-part2/metrics"
+	"chatroom/client-part2/model"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runBatched buffers messages per room and sends a room's buffer as one
+// JSON array frame once it holds BatchSize messages
+func (w *Worker) runBatched() {
+	pending := make(map[string][]model.Message)
+
+	for msg := range w.Input {
+		batch := append(pending[msg.RoomId], msg)
+		if len(batch) < w.BatchSize {
+			pending[msg.RoomId] = batch
+			continue
+		}
+		delete(pending, msg.RoomId)
+		w.processBatchWithRetry(msg.RoomId, batch)
+	}
+
+	// Flush the partial batches left when the generator is done
+	for roomId, batch := range pending {
+		w.processBatchWithRetry(roomId, batch)
+	}
+}
+
+func (w *Worker) processBatchWithRetry(roomId string, batch []model.Message) {
+	maxRetries := 5
+	baseDelay := 100 * time.Millisecond
+
+	for i := 0; i <= maxRetries; i++ {
+		start := time.Now()
+		responses, err := w.sendBatch(roomId, batch)
+		if err == nil {
+			// Every message in the batch shares the frame's round trip time
+			latency := time.Since(start).Milliseconds()
+			for j, msg := range batch {
+				w.Collector.Record(metrics.Record{
+					Timestamp:   start,
+					MessageType: msg.MessageType,
+					Latency:     latency,
+					StatusCode:  responses[j].StatusCode(),
+					RoomId:      roomId,
+				})
+			}
+			return
+		}
+
+		log.Printf("Worker %d: Failed to send batch of %d (attempt %d/%d): %v", w.ID, len(batch), i+1, maxRetries+1, err)
+		w.Collector.RecordRetry()
+
+		if conn, ok := w.Conns[roomId]; ok {
+			conn.Close()
+			delete(w.Conns, roomId)
+		}
+
+		if i == maxRetries {
+			for _, msg := range batch {
+				w.Collector.Record(metrics.Record{
+					Timestamp:   start,
+					MessageType: msg.MessageType,
+					Latency:     0,
+					StatusCode:  "ERROR",
+					RoomId:      roomId,
+				})
+			}
+		} else {
+			delay := baseDelay * time.Duration(math.Pow(2, float64(i)))
+			time.Sleep(delay)
+		}
+	}
+}
+
+// sendBatch writes the messages as a JSON array and reads the array of
+// per-message responses, which the server returns in the same order
+func (w *Worker) sendBatch(roomId string, batch []model.Message) ([]model.ServerResponse, error) {
+	conn, err := w.getConnection(roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := readBatchReply(conn, w.lastSeq(roomId))
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []model.ServerResponse
+	if err := json.Unmarshal(reply, &responses); err != nil {
+		return nil, fmt.Errorf("unexpected batch reply: %w", err)
+	}
+	if len(responses) != len(batch) {
+		return nil, fmt.Errorf("batch reply has %d responses for %d messages", len(responses), len(batch))
+	}
+	return responses, nil
+}
+
+// readBatchReply skips broadcast frames, which are single objects, until it
+// reads the array answering our batch (or a single error for the whole batch).
+// The sequence numbers of skipped broadcasts are recorded in lastSeq, if set.
+func readBatchReply(conn *websocket.Conn, lastSeq *uint64) ([]byte, error) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		trimmed := bytes.TrimLeft(data, " \t\r\n")
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			return data, nil
+		}
+
+		var response model.ServerResponse
+		if err := json.Unmarshal(data, &response); err != nil {
+			return nil, err
+		}
+		if response.Status != model.StatusBroadcast {
+			return nil, fmt.Errorf("batch rejected: %s", response.Error)
+		}
+		recordSeq(lastSeq, response.Seq)
+	}
+}
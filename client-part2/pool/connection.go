@@ -3,6 +3,7 @@ package pool
 import (
 	"chatroom/client-part2/metrics"
 	"chatroom/client-part2/model"
+	"chatroom/codec"
 	"fmt"
 	"log"
 	"math"
@@ -18,25 +19,38 @@ type Worker struct {
 	Input     <-chan model.Message
 	Collector *metrics.Collector
 	Host      string
+	Dialer    *websocket.Dialer
+	Codec     codec.Codec
+	BatchSize int  // messages per frame; 1 sends each message on its own
+	Resume    bool // open with HELLO and resume dropped connections' sessions
 	Conns     map[string]*websocket.Conn
+	sessions  map[string]*roomSession
 	mu        sync.Mutex
 }
 
-func NewWorker(id int, input <-chan model.Message, collector *metrics.Collector, host string) *Worker {
+func NewWorker(id int, input <-chan model.Message, collector *metrics.Collector, host string, dialer *websocket.Dialer, cdc codec.Codec) *Worker {
 	return &Worker{
 		ID:        id,
 		Input:     input,
 		Collector: collector,
 		Host:      host,
+		Dialer:    dialer,
+		Codec:     cdc,
+		BatchSize: 1,
 		Conns:     make(map[string]*websocket.Conn),
+		sessions:  make(map[string]*roomSession),
 	}
 }
 
 func (w *Worker) Run(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	for msg := range w.Input {
-		w.processMessageWithRetry(msg)
+	if w.BatchSize > 1 {
+		w.runBatched()
+	} else {
+		for msg := range w.Input {
+			w.processMessageWithRetry(msg)
+		}
 	}
 	// Cleanup connections
 	for _, conn := range w.Conns {
@@ -50,31 +64,64 @@ func (w *Worker) getConnection(roomId string) (*websocket.Conn, error) {
 	}
 
 	u := url.URL{Scheme: "ws", Host: w.Host, Path: fmt.Sprintf("/chat/%s", roomId)}
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if w.Resume {
+		u.RawQuery = w.sessions[roomId].query()
+	}
+	conn, _, err := w.Dialer.Dial(u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	if err := CheckSubprotocol(conn, w.Codec); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if w.Resume {
+		sess := w.sessions[roomId]
+		if sess == nil {
+			sess = &roomSession{}
+			w.sessions[roomId] = sess
+		}
+		welcome, err := Handshake(conn, w.Codec, &sess.lastSeq)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		sess.token = welcome.ResumeToken
+		if welcome.Resumed {
+			w.Collector.RecordResume()
+		}
+	}
 
 	w.Collector.RecordConnection()
 	w.Conns[roomId] = conn
 	return conn, nil
 }
 
+// lastSeq is where the session of roomId's connection would resume, or nil
+// when the worker does not resume sessions
+func (w *Worker) lastSeq(roomId string) *uint64 {
+	if sess := w.sessions[roomId]; sess != nil {
+		return &sess.lastSeq
+	}
+	return nil
+}
+
 func (w *Worker) processMessageWithRetry(msg model.Message) {
 	maxRetries := 5
 	baseDelay := 100 * time.Millisecond
 
 	for i := 0; i <= maxRetries; i++ {
 		start := time.Now()
-		err := w.sendMessage(msg)
+		response, err := w.sendMessage(msg)
 		if err == nil {
-			// Success
+			// Round trip done; the server accepted or rejected the message
 			latency := time.Since(start).Milliseconds()
 			w.Collector.Record(metrics.Record{
 				Timestamp:   start,
 				MessageType: msg.MessageType,
 				Latency:     latency,
-				StatusCode:  "OK",
+				StatusCode:  response.StatusCode(),
 				RoomId:      msg.RoomId,
 			})
 			return
@@ -106,30 +153,28 @@ func (w *Worker) processMessageWithRetry(msg model.Message) {
 	}
 }
 
-func (w *Worker) sendMessage(msg model.Message) error {
+func (w *Worker) sendMessage(msg model.Message) (model.ServerResponse, error) {
 	conn, err := w.getConnection(msg.RoomId)
 	if err != nil {
-		return err
+		return model.ServerResponse{}, err
 	}
 
 	// Set deadline for write
+	data, err := w.Codec.Marshal(msg)
+	if err != nil {
+		return model.ServerResponse{}, err
+	}
 	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	if err := conn.WriteJSON(msg); err != nil {
-		return err
+	if err := conn.WriteMessage(w.Codec.FrameType(), data); err != nil {
+		return model.ServerResponse{}, err
 	}
 
 	// Set deadline for read
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	
-	// Read response (Echo)
-	// We use RawMessage to avoid full parsing if we don't need it, but we need to check ID/Status ideally.
-	// For performance test, just successfully reading a JSON is good enough proof of roundtrip.
-	_, _, err = conn.ReadMessage()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Read response (Echo), skipping broadcasts from other members of the room.
+	// For performance test, just successfully reading our response is good enough proof of roundtrip.
+	return readResponse(conn, w.Codec, w.lastSeq(msg.RoomId))
 }
 
 type Pool struct {
@@ -137,14 +182,21 @@ type Pool struct {
 	GeneratorInput <-chan model.Message
 	Collector  *metrics.Collector
 	Host       string
+	Dialer     *websocket.Dialer
+	Codec      codec.Codec
+	BatchSize  int
+	Resume     bool
 }
 
-func NewPool(numWorkers int, input <-chan model.Message, collector *metrics.Collector, host string) *Pool {
+func NewPool(numWorkers int, input <-chan model.Message, collector *metrics.Collector, host string, dialer *websocket.Dialer, cdc codec.Codec) *Pool {
 	return &Pool{
 		NumWorkers: numWorkers,
 		GeneratorInput: input,
 		Collector:  collector,
 		Host:       host,
+		Dialer:     dialer,
+		Codec:      cdc,
+		BatchSize:  1,
 	}
 }
 
@@ -152,7 +204,9 @@ func (p *Pool) Run() {
 	var wg sync.WaitGroup
 	for i := 0; i < p.NumWorkers; i++ {
 		wg.Add(1)
-		worker := NewWorker(i, p.GeneratorInput, p.Collector, p.Host)
+		worker := NewWorker(i, p.GeneratorInput, p.Collector, p.Host, p.Dialer, p.Codec)
+		worker.BatchSize = p.BatchSize
+		worker.Resume = p.Resume
 		go worker.Run(&wg)
 	}
 	wg.Wait()
@@ -0,0 +1,61 @@
+package pool
+
+import (
+	"chatroom/client-part2/metrics"
+	"chatroom/codec"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewDialer returns a websocket dialer that requests cdc's subprotocol,
+// optionally offers permessage-deflate and, if collector is set, counts
+// bytes on the wire
+func NewDialer(compress bool, cdc codec.Codec, collector *metrics.Collector) *websocket.Dialer {
+	netDialer := &net.Dialer{Timeout: 10 * time.Second}
+	return &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  45 * time.Second,
+		EnableCompression: compress,
+		Subprotocols:      []string{cdc.Name()},
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := netDialer.DialContext(ctx, network, addr)
+			if err != nil || collector == nil {
+				return conn, err
+			}
+			return &countingConn{Conn: conn, collector: collector}, nil
+		},
+	}
+}
+
+// CheckSubprotocol fails if the server didn't agree to the requested codec.
+// Servers that predate subprotocols answer with none, which means JSON.
+func CheckSubprotocol(conn *websocket.Conn, cdc codec.Codec) error {
+	negotiated := conn.Subprotocol()
+	if negotiated == cdc.Name() || (negotiated == "" && cdc == codec.JSON) {
+		return nil
+	}
+	return fmt.Errorf("server did not accept subprotocol %s (got %q)", cdc.Name(), negotiated)
+}
+
+// countingConn reports the raw bytes read and written, i.e. after compression
+type countingConn struct {
+	net.Conn
+	collector *metrics.Collector
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.collector.AddBytesReceived(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.collector.AddBytesSent(n)
+	return n, err
+}
@@ -0,0 +1,34 @@
+package pool
+
+import (
+	"chatroom/client-part2/model"
+	"chatroom/codec"
+
+	"github.com/gorilla/websocket"
+)
+
+// ReadResponse reads frames until it gets the server's answer to our last
+// message, skipping the broadcasts of other room members in between
+func ReadResponse(conn *websocket.Conn, cdc codec.Codec) (model.ServerResponse, error) {
+	return readResponse(conn, cdc, nil)
+}
+
+// readResponse is ReadResponse that also records the highest broadcast
+// sequence number skipped in lastSeq, if set
+func readResponse(conn *websocket.Conn, cdc codec.Codec, lastSeq *uint64) (model.ServerResponse, error) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return model.ServerResponse{}, err
+		}
+
+		var response model.ServerResponse
+		if err := cdc.Unmarshal(data, &response); err != nil {
+			return model.ServerResponse{}, err
+		}
+		if response.Status != model.StatusBroadcast {
+			return response, nil
+		}
+		recordSeq(lastSeq, response.Seq)
+	}
+}
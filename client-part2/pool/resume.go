@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"chatroom/client-part2/model"
+	"chatroom/codec"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// roomSession is what a worker needs to resume a room's connection after
+// it drops
+type roomSession struct {
+	token   string
+	lastSeq uint64 // highest broadcast sequence seen
+}
+
+// query asks the server to resume the session after the last message seen
+func (s *roomSession) query() string {
+	if s == nil || s.token == "" {
+		return ""
+	}
+	return url.Values{
+		"resume":  {s.token},
+		"lastSeq": {strconv.FormatUint(s.lastSeq, 10)},
+	}.Encode()
+}
+
+// Handshake sends HELLO asking for history, so that the session can be
+// resumed, and returns the server's WELCOME. Messages replayed to a resumed
+// session arrive first; their sequence numbers are recorded in lastSeq.
+func Handshake(conn *websocket.Conn, cdc codec.Codec, lastSeq *uint64) (model.Welcome, error) {
+	hello := model.Hello{
+		Type:     model.ControlTypeHello,
+		Version:  model.ProtocolVersion,
+		Features: []string{model.FeatureHistory},
+		Client:   "client-part2",
+	}
+	data, err := cdc.Marshal(hello)
+	if err != nil {
+		return model.Welcome{}, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(cdc.FrameType(), data); err != nil {
+		return model.Welcome{}, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return model.Welcome{}, err
+		}
+
+		var welcome model.Welcome
+		if cdc.Unmarshal(data, &welcome) == nil && welcome.Type == model.ControlTypeWelcome {
+			return welcome, nil
+		}
+		var response model.ServerResponse
+		if err := cdc.Unmarshal(data, &response); err != nil {
+			return model.Welcome{}, err
+		}
+		if response.Status != model.StatusBroadcast {
+			return model.Welcome{}, fmt.Errorf("unexpected frame before WELCOME: %s %s", response.Status, response.Error)
+		}
+		recordSeq(lastSeq, response.Seq)
+	}
+}
+
+func recordSeq(lastSeq *uint64, seq uint64) {
+	if lastSeq != nil && seq > *lastSeq {
+		*lastSeq = seq
+	}
+}
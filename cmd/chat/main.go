@@ -0,0 +1,136 @@
+// Command chat is an interactive terminal client for a chat room
+//
+//	chat [-server ws://localhost:8080] [-name alice] [-user 42] [-token TOKEN] [-token-hosts HOSTS] ROOM
+//
+// Lines typed are sent as TEXT messages; "/help" lists the server's
+// commands and "/quit" (or Ctrl-D, Ctrl-C) leaves the room.
+package main
+
+import (
+	"bufio"
+	"chatroom/server/model"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var nonAlnum = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// defaultName derives a valid username (3-20 alphanumerics) from $USER
+func defaultName() string {
+	name := nonAlnum.ReplaceAllString(os.Getenv("USER"), "")
+	if len(name) > 20 {
+		name = name[:20]
+	}
+	if len(name) < 3 {
+		name = "guest" + strconv.Itoa(rand.Intn(1000))
+	}
+	return name
+}
+
+// serverURL turns host:port or an http(s) URL into a websocket base URL
+func serverURL(s string) string {
+	s = strings.TrimSuffix(s, "/")
+	switch {
+	case strings.HasPrefix(s, "http://"):
+		return "ws://" + strings.TrimPrefix(s, "http://")
+	case strings.HasPrefix(s, "https://"):
+		return "wss://" + strings.TrimPrefix(s, "https://")
+	case strings.HasPrefix(s, "ws://"), strings.HasPrefix(s, "wss://"):
+		return s
+	}
+	return "ws://" + s
+}
+
+// splitHosts parses a comma-separated list of host:port
+func splitHosts(s string) []string {
+	var hosts []string
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func main() {
+	server := flag.String("server", "ws://localhost:8080", "Server URL or host:port")
+	name := flag.String("name", defaultName(), "Username shown to the room (3-20 alphanumeric characters)")
+	userId := flag.Int("user", rand.Intn(100000)+1, "User ID between 1 and 100000 (default random)")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "Moderator token sent when connecting (default $CHAT_TOKEN)")
+	tokenHosts := flag.String("token-hosts", "", "Comma-separated host:port of other nodes that redirects may send the token to")
+	noColor := flag.Bool("no-color", false, "Plain output without a prompt or colours")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: chat [flags] ROOM\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *userId < 1 || *userId > 100000 {
+		fmt.Fprintln(os.Stderr, "chat: -user must be between 1 and 100000")
+		os.Exit(2)
+	}
+	if nonAlnum.MatchString(*name) || len(*name) < 3 || len(*name) > 20 {
+		fmt.Fprintln(os.Stderr, "chat: -name must be 3-20 alphanumeric characters")
+		os.Exit(2)
+	}
+	roomId := flag.Arg(0)
+
+	out := newScreen(os.Stdout, "["+roomId+"] > ", !*noColor && isTerminal(os.Stdout))
+	s := newSession(serverURL(*server), roomId, strconv.Itoa(*userId), *name, *token, splitHosts(*tokenHosts), out)
+	go s.run()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	lines := make(chan string)
+	go readLines(lines)
+
+	for {
+		select {
+		case <-interrupt:
+			s.leave()
+			out.println("")
+			return
+		case line, ok := <-lines:
+			if !ok || line == "/quit" {
+				s.leave()
+				return
+			}
+			out.showPrompt()
+			if line == "" {
+				continue
+			}
+			if len(line) > 500 {
+				out.status("message too long (%d characters, at most 500)", len(line))
+				continue
+			}
+			if err := s.send(model.MessageTypeText, line); err != nil {
+				out.status("not sent: %v", err)
+			}
+		}
+	}
+}
+
+// readLines sends stdin line by line and closes lines at EOF
+func readLines(lines chan<- string) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		lines <- strings.TrimSpace(scanner.Text())
+	}
+	close(lines)
+}
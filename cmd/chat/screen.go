@@ -0,0 +1,109 @@
+package main
+
+import (
+	"chatroom/server/model"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ANSI sequences; the prompt is redrawn below every line printed
+const (
+	clearLine = "\r\033[K"
+	dim       = "\033[2m"
+	bold      = "\033[1m"
+	red       = "\033[31m"
+	cyan      = "\033[36m"
+	magenta   = "\033[35m"
+	reset     = "\033[0m"
+)
+
+// screen prints chat lines above the input prompt
+type screen struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prompt string
+	color  bool
+}
+
+func newScreen(w io.Writer, prompt string, color bool) *screen {
+	return &screen{w: w, prompt: prompt, color: color}
+}
+
+func (s *screen) paint(codes string) string {
+	if !s.color {
+		return ""
+	}
+	return codes
+}
+
+// println prints line and redraws the prompt
+func (s *screen) println(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.color {
+		fmt.Fprint(s.w, clearLine)
+	}
+	fmt.Fprintln(s.w, line)
+	if s.color {
+		fmt.Fprint(s.w, s.prompt)
+	}
+}
+
+// showPrompt prints the prompt after the user pressed enter
+func (s *screen) showPrompt() {
+	if !s.color {
+		return
+	}
+	s.mu.Lock()
+	fmt.Fprint(s.w, s.prompt)
+	s.mu.Unlock()
+}
+
+// status prints a line from the client itself
+func (s *screen) status(format string, args ...interface{}) {
+	s.println(s.paint(dim) + "-- " + fmt.Sprintf(format, args...) + s.paint(reset))
+}
+
+// message renders a response or broadcast. Own messages come back as OK
+// responses, everyone else's as broadcasts.
+func (s *screen) message(msg model.ServerResponse, selfId string) {
+	if msg.Status == model.StatusError {
+		s.println(s.paint(red) + "! " + msg.Error + s.paint(reset))
+		return
+	}
+	if msg.Reply != "" {
+		for _, line := range strings.Split(msg.Reply, "\n") {
+			s.println(s.paint(cyan) + line + s.paint(reset))
+		}
+		return
+	}
+	if msg.Status == model.StatusOK && strings.HasPrefix(msg.Message.Message, "/") {
+		// A command with nothing to reply; its effect is broadcast
+		return
+	}
+
+	ts := s.paint(dim) + msg.ServerTimestamp.Local().Format(time.TimeOnly) + s.paint(reset)
+	name := msg.Username
+	if msg.Bot {
+		name += " [bot]"
+	}
+	if msg.UserId == selfId {
+		name = s.paint(bold) + name + s.paint(reset)
+	}
+
+	switch msg.MessageType {
+	case model.MessageTypeJoin:
+		s.println(fmt.Sprintf("%s %s-> %s joined%s", ts, s.paint(dim), name, s.paint(reset)))
+	case model.MessageTypeLeave:
+		s.println(fmt.Sprintf("%s %s<- %s left%s", ts, s.paint(dim), name, s.paint(reset)))
+	case model.MessageTypeAction:
+		s.println(fmt.Sprintf("%s %s* %s %s%s", ts, s.paint(magenta), name, msg.Message.Message, s.paint(reset)))
+	case model.MessageTypeSystem:
+		s.println(fmt.Sprintf("%s %s-- %s%s", ts, s.paint(cyan), msg.Message.Message, s.paint(reset)))
+	default:
+		s.println(fmt.Sprintf("%s <%s> %s", ts, name, msg.Message.Message))
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"chatroom/server/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	clientName     = "chat"
+	maxRedirects   = 5
+	minBackoff     = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+	writeWait      = 5 * time.Second
+	leaveGraceTime = time.Second
+)
+
+var (
+	errNotConnected = errors.New("not connected")
+	errUnauthorized = errors.New("token refused")
+)
+
+// session keeps one user connected to a room, reconnecting when the
+// connection drops or the server sends the client elsewhere
+type session struct {
+	userId   string
+	username string
+	roomId   string
+	header   http.Header     // sent with upgrades to trusted hosts, e.g. the moderator token
+	scheme   string          // scheme of the server the client was started with
+	trusted  map[string]bool // host:port that may receive header
+	out      *screen
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	target  string // URL to connect to next; changed by redirects
+	token   string // resumes the session on the next connection
+	lastSeq uint64 // highest sequence number seen
+	done    bool
+}
+
+// newSession connects to serverURL. The token is sent over its scheme to
+// its host and to tokenHosts, the other nodes the room may be redirected to.
+func newSession(serverURL, roomId, userId, username, token string, tokenHosts []string, out *screen) *session {
+	s := &session{
+		userId:   userId,
+		username: username,
+		roomId:   roomId,
+		header:   http.Header{},
+		trusted:  map[string]bool{},
+		out:      out,
+		target:   serverURL + "/chat/" + url.PathEscape(roomId),
+	}
+	if token != "" {
+		s.header.Set("Authorization", "Bearer "+token)
+	}
+	if u, err := url.Parse(serverURL); err == nil {
+		s.scheme = u.Scheme
+		s.trusted[u.Host] = true
+	}
+	for _, host := range tokenHosts {
+		s.trusted[host] = true
+	}
+	return s
+}
+
+// headerFor returns the header to upgrade to target with: the token only
+// goes to trusted hosts over the server's scheme, never on a downgrade
+func (s *session) headerFor(target string) http.Header {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != s.scheme || !s.trusted[u.Host] {
+		return nil
+	}
+	return s.header
+}
+
+// run connects and reads until close is called
+func (s *session) run() {
+	backoff := minBackoff
+	for !s.closed() {
+		conn, err := s.dial()
+		if errors.Is(err, errUnauthorized) {
+			// Retrying with the same token would only be refused again
+			s.out.status("connect failed: %v", err)
+			s.close()
+			return
+		}
+		if err != nil {
+			wait := backoff
+			var retry *retryAfterError
+			if errors.As(err, &retry) {
+				wait = retry.after
+			}
+			s.out.status("connect failed: %v; retrying in %s", err, wait.Round(100*time.Millisecond))
+			time.Sleep(wait)
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+
+		s.mu.Lock()
+		if s.done {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conn = conn
+		s.mu.Unlock()
+
+		s.out.status("connected to %s as %s", s.target, s.username)
+		if err := s.hello(); err != nil {
+			s.out.status("handshake failed: %v", err)
+		}
+
+		wait := s.read(conn)
+
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+
+		if s.closed() {
+			return
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+func (s *session) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// retryAfterError is a refused upgrade that told us when to come back
+type retryAfterError struct {
+	status string
+	after  time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.status
+}
+
+// dial upgrades to the current target, following 307 redirects to the
+// node that owns the room. With a session token it asks to resume after
+// the last message seen.
+func (s *session) dial() (*websocket.Conn, error) {
+	s.mu.Lock()
+	target := s.target
+	query := ""
+	if s.token != "" {
+		query = "?" + url.Values{
+			"resume":  {s.token},
+			"lastSeq": {strconv.FormatUint(s.lastSeq, 10)},
+		}.Encode()
+	}
+	s.mu.Unlock()
+
+	for i := 0; i <= maxRedirects; i++ {
+		conn, resp, err := websocket.DefaultDialer.Dial(target+query, s.headerFor(target))
+		if err == nil {
+			return conn, nil
+		}
+		if resp == nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			location, lerr := resp.Location()
+			if lerr != nil {
+				return nil, fmt.Errorf("redirect without a location: %w", lerr)
+			}
+			location.RawQuery = ""
+			target = location.String()
+			s.out.status("room is served by %s, following", target)
+			s.mu.Lock()
+			s.target = target
+			s.mu.Unlock()
+			continue
+		case http.StatusUnauthorized:
+			return nil, fmt.Errorf("%s: %w", resp.Status, errUnauthorized)
+		case http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusForbidden:
+			if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				return nil, &retryAfterError{status: resp.Status, after: time.Duration(secs) * time.Second}
+			}
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return nil, fmt.Errorf("more than %d redirects", maxRedirects)
+}
+
+// read renders frames until the connection ends and returns how long to
+// wait before reconnecting
+func (s *session) read(conn *websocket.Conn) time.Duration {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if s.closed() {
+				return 0
+			}
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				code, text := splitCloseReason(closeErr.Text)
+				switch code {
+				case model.ErrorKicked, model.ErrorBanned:
+					// Reconnecting would only repeat it
+					s.out.status("removed from the room: %s", text)
+					s.close()
+					return 0
+				case model.ErrorProtocolVersion:
+					s.out.status("refused by server: %s", text)
+					s.close()
+					return 0
+				case model.ErrorSessionReplaced:
+					// Another client resumed our session; don't fight over it
+					s.out.status("%s", text)
+					s.close()
+					return 0
+				}
+			}
+			s.out.status("connection lost: %v", err)
+			return minBackoff
+		}
+
+		if control, ok := decodeControl(data); ok {
+			switch control.Type {
+			case model.ControlTypeWelcome:
+				var welcome model.Welcome
+				json.Unmarshal(data, &welcome)
+				s.welcome(welcome)
+			case model.ControlTypeRedirect:
+				s.out.status("room moved to node %s, reconnecting", control.NodeId)
+				s.mu.Lock()
+				s.target = control.URL
+				s.mu.Unlock()
+				conn.Close()
+				return 0
+			case model.ControlTypeReconnect:
+				wait := time.Duration(control.RetryAfterMs) * time.Millisecond
+				s.out.status("server asked to reconnect (%s) in %s", control.Reason, wait)
+				conn.Close()
+				return wait
+			}
+			continue
+		}
+
+		var msg model.ServerResponse
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.out.status("unreadable frame: %v", err)
+			continue
+		}
+		s.out.message(msg, s.userId)
+		if msg.Seq != 0 {
+			s.ack(msg.Seq)
+		}
+	}
+}
+
+// welcome finishes the handshake: a resumed session is already in the
+// room, otherwise the client joins it
+func (s *session) welcome(welcome model.Welcome) {
+	s.mu.Lock()
+	expired := s.token != "" && !welcome.Resumed
+	s.token = welcome.ResumeToken
+	s.mu.Unlock()
+
+	s.out.status("protocol %d on node %s, features: %s", welcome.Version, orDash(welcome.NodeId), orDash(strings.Join(welcome.Features, ", ")))
+	if welcome.Resumed {
+		s.out.status("session resumed")
+		return
+	}
+	if expired {
+		s.out.status("session could not be resumed; rejoining")
+	}
+	if err := s.send(model.MessageTypeJoin, "joined the room"); err != nil {
+		s.out.status("join failed: %v", err)
+	}
+}
+
+// ack records seq as seen and tells the server, so that a resumed session
+// replays only what came after it
+func (s *session) ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq <= s.lastSeq {
+		return
+	}
+	s.lastSeq = seq
+	if s.conn != nil {
+		s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		s.conn.WriteJSON(model.Ack{Type: model.ControlTypeAck, Seq: seq})
+	}
+}
+
+// splitCloseReason separates the error code from the text of a close
+// reason of the form "CODE: text"
+func splitCloseReason(reason string) (code, text string) {
+	code, text, ok := strings.Cut(reason, ": ")
+	if !ok {
+		return "", reason
+	}
+	return code, text
+}
+
+// decodeControl recognises control frames, which have a type and no status
+func decodeControl(data []byte) (model.ControlMessage, bool) {
+	var probe struct {
+		Type   string `json:"type"`
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(data, &probe) != nil || probe.Type == "" || probe.Status != "" {
+		return model.ControlMessage{}, false
+	}
+	var control model.ControlMessage
+	json.Unmarshal(data, &control)
+	return control, true
+}
+
+// hello opens the connection with the protocol handshake; the WELCOME
+// arrives in read, after any messages replayed to a resumed session
+func (s *session) hello() error {
+	hello := model.Hello{
+		Type:     model.ControlTypeHello,
+		Version:  model.ProtocolVersion,
+		Features: []string{model.FeatureCommands, model.FeatureHistory, model.FeatureAcks},
+		Client:   clientName,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteJSON(hello)
+}
+
+// orDash shows empty values as "-"
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// send writes one message on the current connection
+func (s *session) send(messageType, text string) error {
+	msg := model.Message{
+		UserId:      s.userId,
+		Username:    s.username,
+		Message:     text,
+		Timestamp:   time.Now().UTC(),
+		MessageType: messageType,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteJSON(msg)
+}
+
+// leave says goodbye and closes the connection for good
+func (s *session) leave() {
+	if err := s.send(model.MessageTypeLeave, "left the room"); err == nil {
+		// Give the server a moment to accept it before the close frame
+		time.Sleep(leaveGraceTime / 4)
+	}
+	s.close()
+}
+
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	if s.conn != nil {
+		s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), time.Now().Add(writeWait))
+		s.conn.Close()
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"chatroom/server/cluster"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	httpClient = &http.Client{Timeout: 30 * time.Second, CheckRedirect: keepToken}
+	// streamClient has no overall timeout, for event streams kept alive by
+	// the server's heartbeats
+	streamClient = &http.Client{CheckRedirect: keepToken}
+)
+
+// keepToken sends the admin token on to the node a room's requests are
+// redirected to; net/http drops it when the host changes, but every node
+// of a cluster shares the token. It is only sent over the scheme of the
+// first request to its host or a member of the cluster; other redirects
+// are followed without it.
+func keepToken(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	auth := via[0].Header.Get("Authorization")
+	if auth == "" || req.URL.Scheme != via[0].URL.Scheme ||
+		(req.URL.Host != via[0].URL.Host && !clusterHosts()[req.URL.Host]) {
+		req.Header.Del("Authorization")
+		return nil
+	}
+	req.Header.Set("Authorization", auth)
+	return nil
+}
+
+var (
+	clusterHostsOnce sync.Once
+	clusterHostsSet  map[string]bool
+)
+
+// clusterHosts returns the host:port of every member of the server's
+// cluster, asked once; a server that cannot tell gives an empty set
+func clusterHosts() map[string]bool {
+	clusterHostsOnce.Do(func() {
+		clusterHostsSet = map[string]bool{}
+		var status struct {
+			Members []cluster.Member `json:"members"`
+		}
+		client := &http.Client{
+			Timeout:       10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := requestWith(client, "GET", "/admin/cluster", nil)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if json.NewDecoder(resp.Body).Decode(&status) != nil {
+			return
+		}
+		for _, m := range status.Members {
+			if u, err := url.Parse(m.HTTPURL("")); err == nil {
+				clusterHostsSet[u.Host] = true
+			}
+		}
+	})
+	return clusterHostsSet
+}
+
+// apiError is a non-2xx answer from the server
+type apiError struct {
+	status int
+	body   string
+}
+
+func (e *apiError) Error() string {
+	msg := strings.TrimSpace(e.body)
+	if msg == "" {
+		msg = http.StatusText(e.status)
+	}
+	if e.status == http.StatusUnauthorized {
+		msg += " (set -token or $ADMIN_TOKEN)"
+	}
+	return fmt.Sprintf("%d: %s", e.status, msg)
+}
+
+// request sends a request to the server and returns the response, which
+// the caller must close. Non-2xx statuses are returned as errors.
+func request(method, path string, body interface{}) (*http.Response, error) {
+	return requestWith(httpClient, method, path, body)
+}
+
+func requestWith(client *http.Client, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(opts.server, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &apiError{status: resp.StatusCode, body: string(data)}
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes the JSON answer into out. With -json
+// the answer is printed as it came and out is still filled in.
+func call(method, path string, body, out interface{}) error {
+	resp, err := request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		var indented bytes.Buffer
+		if json.Indent(&indented, data, "", "  ") == nil {
+			indented.WriteByte('\n')
+			indented.WriteTo(os.Stdout)
+		}
+	}
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func roomPath(roomId string, rest ...string) string {
+	return "/admin/rooms/" + url.PathEscape(roomId) + strings.Join(rest, "")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// resetClusterHosts forgets the cluster members learned by a test
+func resetClusterHosts(t *testing.T) {
+	t.Cleanup(func() {
+		clusterHostsOnce = sync.Once{}
+		clusterHostsSet = nil
+	})
+}
+
+func TestKeepToken(t *testing.T) {
+	resetClusterHosts(t)
+	clusterHostsOnce.Do(func() { clusterHostsSet = map[string]bool{"b.example:8080": true} })
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want bool
+	}{
+		{"same host", "https://a.example:8080/admin/rooms", "https://a.example:8080/admin/rooms/1/members", true},
+		{"cluster member", "http://a.example:8080/admin/rooms/1/kick", "http://b.example:8080/admin/rooms/1/kick", true},
+		{"unknown host", "http://a.example:8080/admin/rooms/1/kick", "http://evil.example/admin/rooms/1/kick", false},
+		{"downgrade", "https://a.example:8080/admin/rooms/1/kick", "http://a.example:8080/admin/rooms/1/kick", false},
+		{"member over another scheme", "https://a.example:8080/admin/rooms/1/kick", "http://b.example:8080/admin/rooms/1/kick", false},
+	}
+	for _, tt := range tests {
+		first := httptest.NewRequest("GET", tt.from, nil)
+		first.Header.Set("Authorization", "Bearer s3cret")
+		next := httptest.NewRequest("GET", tt.to, nil)
+		next.Header.Set("Authorization", "Bearer s3cret") // as net/http copies it to the same host
+		if err := keepToken(next, []*http.Request{first}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := next.Header.Get("Authorization") != ""; got != tt.want {
+			t.Errorf("%s: token sent %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTokenFollowsRedirectsToClusterMembers(t *testing.T) {
+	resetClusterHosts(t)
+	saved := opts
+	t.Cleanup(func() { opts = saved })
+
+	tokens := make(chan string, 1)
+	node := func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode([]string{})
+	}
+	member := httptest.NewServer(http.HandlerFunc(node))
+	defer member.Close()
+	stranger := httptest.NewServer(http.HandlerFunc(node))
+	defer stranger.Close()
+
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/cluster":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"members": []map[string]string{{"id": "b", "addr": strings.TrimPrefix(member.URL, "http://")}},
+			})
+		case "/admin/rooms/member":
+			http.Redirect(w, r, member.URL+r.URL.Path, http.StatusTemporaryRedirect)
+		default:
+			http.Redirect(w, r, stranger.URL+r.URL.Path, http.StatusTemporaryRedirect)
+		}
+	}))
+	defer first.Close()
+	opts = options{server: first.URL, token: "s3cret"}
+
+	if err := call("GET", "/admin/rooms/member", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-tokens; got != "Bearer s3cret" {
+		t.Fatalf("cluster member got Authorization %q", got)
+	}
+	if err := call("GET", "/admin/rooms/stranger", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-tokens; got != "" {
+		t.Fatalf("unknown host got Authorization %q", got)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// roomInfo is the part of the server's room metadata chatctl shows
+type roomInfo struct {
+	RoomId    string `json:"roomId"`
+	NodeId    string `json:"nodeId"`
+	Topic     string `json:"topic"`
+	Members   int    `json:"members"`
+	Retention struct {
+		Policy      string `json:"policy"`
+		Messages    int    `json:"messages"`
+		MaxAge      string `json:"maxAge"`
+		MaxMessages int    `json:"maxMessages"`
+	} `json:"retention"`
+	History struct {
+		Messages int    `json:"messages"`
+		LastSeq  uint64 `json:"lastSeq"`
+	} `json:"history"`
+}
+
+func (r roomInfo) retention() string {
+	keep := "forever"
+	switch r.Retention.Policy {
+	case "messages":
+		return strconv.Itoa(r.Retention.Messages) + " messages"
+	case "age":
+		keep = r.Retention.MaxAge
+	}
+	if r.Retention.MaxMessages > 0 {
+		keep += ", max " + strconv.Itoa(r.Retention.MaxMessages)
+	}
+	return keep
+}
+
+type member struct {
+	ConnId    string `json:"connId"`
+	UserId    string `json:"userId"`
+	Username  string `json:"username"`
+	Transport string `json:"transport"`
+}
+
+type ban struct {
+	UserId string     `json:"userId"`
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+type moderationResult struct {
+	RoomId string `json:"roomId"`
+	UserId string `json:"userId"`
+	Kicked int    `json:"kicked"`
+	Ban    *ban   `json:"ban"`
+}
+
+type drainStatus struct {
+	State         string `json:"state"`
+	Waves         int    `json:"waves"`
+	WavesDone     int    `json:"wavesDone"`
+	TotalClients  int    `json:"totalClients"`
+	ClientsClosed int    `json:"clientsClosed"`
+}
+
+func runRooms(fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 0)
+
+	var rooms []roomInfo
+	if err := call("GET", "/admin/rooms", nil, &rooms); err != nil || opts.json {
+		return err
+	}
+	t := newTable("ROOM", "MEMBERS", "MESSAGES", "LAST SEQ", "RETENTION", "TOPIC")
+	for _, r := range rooms {
+		t.row(r.RoomId, strconv.Itoa(r.Members), strconv.Itoa(r.History.Messages),
+			strconv.FormatUint(r.History.LastSeq, 10), r.retention(), orDash(r.Topic))
+	}
+	t.flush()
+	return nil
+}
+
+func runRoster(fs *flag.FlagSet, args []string) error {
+	roomId := parseArgs(fs, args, 1)[0]
+
+	var members []member
+	if err := call("GET", roomPath(roomId, "/members"), nil, &members); err != nil || opts.json {
+		return err
+	}
+	t := newTable("USERID", "USERNAME", "TRANSPORT", "CONNECTION")
+	for _, m := range members {
+		t.row(orDash(m.UserId), orDash(m.Username), m.Transport, orDash(m.ConnId))
+	}
+	t.flush()
+	return nil
+}
+
+func runKick(fs *flag.FlagSet, args []string) error {
+	reason := fs.String("reason", "", "Reason sent to the user in the close frame")
+	pos := parseArgs(fs, args, 2)
+
+	var result moderationResult
+	body := map[string]string{"userId": pos[1], "reason": *reason}
+	if err := call("POST", roomPath(pos[0], "/kick"), body, &result); err != nil || opts.json {
+		return err
+	}
+	fmt.Printf("Kicked %s from %s (%d connections)\n", result.UserId, result.RoomId, result.Kicked)
+	return nil
+}
+
+func runBan(fs *flag.FlagSet, args []string) error {
+	duration := fs.Duration("for", 0, "Ban duration, e.g. 30m or 24h (default permanent)")
+	reason := fs.String("reason", "", "Reason recorded with the ban")
+	pos := parseArgs(fs, args, 2)
+
+	body := map[string]string{"userId": pos[1], "reason": *reason}
+	if *duration > 0 {
+		body["duration"] = duration.String()
+	}
+	var result moderationResult
+	if err := call("POST", roomPath(pos[0], "/bans"), body, &result); err != nil || opts.json {
+		return err
+	}
+	until := "permanently"
+	if result.Ban != nil && result.Ban.Until != nil {
+		until = "until " + result.Ban.Until.Local().Format(time.DateTime)
+	}
+	fmt.Printf("Banned %s from %s %s (%d connections closed)\n", result.UserId, result.RoomId, until, result.Kicked)
+	return nil
+}
+
+func runUnban(fs *flag.FlagSet, args []string) error {
+	pos := parseArgs(fs, args, 2)
+
+	if err := call("DELETE", roomPath(pos[0], "/bans/", url.PathEscape(pos[1])), nil, nil); err != nil || opts.json {
+		return err
+	}
+	fmt.Printf("Unbanned %s from %s\n", pos[1], pos[0])
+	return nil
+}
+
+func runBans(fs *flag.FlagSet, args []string) error {
+	roomId := parseArgs(fs, args, 1)[0]
+
+	var bans []ban
+	if err := call("GET", roomPath(roomId, "/bans"), nil, &bans); err != nil || opts.json {
+		return err
+	}
+	t := newTable("USERID", "UNTIL", "REASON")
+	for _, b := range bans {
+		until := "forever"
+		if b.Until != nil {
+			until = b.Until.Local().Format(time.DateTime)
+		}
+		t.row(b.UserId, until, orDash(b.Reason))
+	}
+	t.flush()
+	return nil
+}
+
+func runDrain(fs *flag.FlagSet, args []string) error {
+	waves := fs.Int("waves", 0, "Number of client groups (server default 10)")
+	interval := fs.Duration("interval", 0, "Pause between waves (server default 1s)")
+	wait := fs.Bool("wait", false, "Wait for the drain to finish, printing progress")
+	parseArgs(fs, args, 0)
+
+	query := url.Values{}
+	if *waves > 0 {
+		query.Set("waves", strconv.Itoa(*waves))
+	}
+	if *interval > 0 {
+		query.Set("interval", interval.String())
+	}
+	path := "/admin/drain"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var status drainStatus
+	if err := call("POST", path, nil, &status); err != nil {
+		return err
+	}
+	if !opts.json {
+		printDrain(status)
+	}
+	for *wait && status.State != "DRAINED" {
+		time.Sleep(time.Second)
+		if err := call("GET", "/admin/drain", nil, &status); err != nil {
+			return err
+		}
+		if !opts.json {
+			printDrain(status)
+		}
+	}
+	return nil
+}
+
+func runDrainStatus(fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 0)
+
+	var status drainStatus
+	if err := call("GET", "/admin/drain", nil, &status); err != nil || opts.json {
+		return err
+	}
+	printDrain(status)
+	return nil
+}
+
+func printDrain(s drainStatus) {
+	fmt.Printf("%-8s waves %d/%d, clients closed %d/%d\n", s.State, s.WavesDone, s.Waves, s.ClientsClosed, s.TotalClients)
+}
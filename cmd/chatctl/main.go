@@ -0,0 +1,146 @@
+// Command chatctl administers a chat server through its admin HTTP API
+//
+//	chatctl [-server URL] [-token TOKEN] [-json] <command> [args]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// options are the flags every command accepts
+type options struct {
+	server string
+	token  string
+	json   bool
+}
+
+var opts options
+
+func defaultServer() string {
+	if s := os.Getenv("CHATCTL_SERVER"); s != "" {
+		return s
+	}
+	return "http://localhost:8080"
+}
+
+// addGlobalFlags registers the global flags on fs with the given defaults.
+// A command's flag set gets them too, defaulting to what was parsed before
+// the command name, so they may also follow it.
+func addGlobalFlags(fs *flag.FlagSet, defaults options) {
+	fs.StringVar(&opts.server, "server", defaults.server, "Server base URL (default $CHATCTL_SERVER if set)")
+	fs.StringVar(&opts.token, "token", defaults.token, "Admin bearer token (default $ADMIN_TOKEN)")
+	fs.BoolVar(&opts.json, "json", defaults.json, "Print JSON instead of tables")
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"rooms", "", "list rooms with member counts", runRooms},
+	{"roster", "ROOM", "list the connections in a room", runRoster},
+	{"kick", "[-reason TEXT] ROOM USERID", "disconnect a user from a room", runKick},
+	{"ban", "[-for DURATION] [-reason TEXT] ROOM USERID", "ban a user from a room and disconnect them", runBan},
+	{"unban", "ROOM USERID", "lift a ban", runUnban},
+	{"bans", "ROOM", "list a room's bans", runBans},
+	{"drain", "[-waves N] [-interval D] [-wait]", "drain the node before a restart", runDrain},
+	{"drain-status", "", "show the progress of a drain", runDrainStatus},
+	{"tail", "[-from SEQ] ROOM", "print a room's messages as they arrive", runTail},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: chatctl [flags] <command> [args]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	addGlobalFlags(flag.CommandLine, options{server: defaultServer(), token: os.Getenv("ADMIN_TOKEN")})
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	name := flag.Arg(0)
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		fs := flag.NewFlagSet("chatctl "+c.name, flag.ExitOnError)
+		addGlobalFlags(fs, opts)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: chatctl %s %s\n\n%s\n\nFlags:\n", c.name, c.args, c.summary)
+			fs.PrintDefaults()
+		}
+		if err := c.run(fs, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "chatctl %s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "chatctl: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// parseArgs parses fs's flags wherever they appear among args and checks
+// that exactly want positional arguments remain
+func parseArgs(fs *flag.FlagSet, args []string, want int) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != want {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return positional
+}
+
+// table writes aligned columns to stdout
+type table struct {
+	tw *tabwriter.Writer
+}
+
+func newTable(headers ...string) *table {
+	t := &table{tw: tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)}
+	t.row(headers...)
+	return t
+}
+
+func (t *table) row(cells ...string) {
+	fmt.Fprintln(t.tw, strings.Join(cells, "\t"))
+}
+
+func (t *table) flush() {
+	t.tw.Flush()
+}
+
+// orDash shows empty cells as "-"
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"chatroom/server/model"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runTail follows the room's event stream, reconnecting from the last
+// message seen when the stream drops
+func runTail(fs *flag.FlagSet, args []string) error {
+	from := fs.Uint64("from", 0, "Also print the retained messages after this sequence number")
+	roomId := parseArgs(fs, args, 1)[0]
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	lastSeq, resume := *from, *from > 0
+	for {
+		err := streamEvents(roomId, &lastSeq, resume, interrupt)
+		if err == errInterrupted {
+			return nil
+		}
+		if apiErr, ok := err.(*apiError); ok && apiErr.status != http.StatusServiceUnavailable {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "chatctl tail: %v; reconnecting\n", err)
+		resume = lastSeq > 0
+
+		select {
+		case <-interrupt:
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func streamEvents(roomId string, lastSeq *uint64, resume bool, interrupt <-chan os.Signal) error {
+	path := "/rooms/" + url.PathEscape(roomId) + "/events"
+	if resume {
+		path += "?lastEventId=" + strconv.FormatUint(*lastSeq, 10)
+	}
+
+	resp, err := requestWith(streamClient, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- readEvents(resp, lastSeq)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			err = fmt.Errorf("stream closed by server")
+		}
+		return err
+	case <-interrupt:
+		return errInterrupted
+	}
+}
+
+// readEvents prints the message events of an SSE stream until it ends
+func readEvents(resp *http.Response, lastSeq *uint64) error {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				printEvent(data.String(), lastSeq)
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
+
+func printEvent(data string, lastSeq *uint64) {
+	var msg model.ServerResponse
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		fmt.Fprintf(os.Stderr, "chatctl tail: bad event: %v\n", err)
+		return
+	}
+	if msg.Seq > *lastSeq {
+		*lastSeq = msg.Seq
+	}
+
+	if opts.json {
+		fmt.Println(data)
+		return
+	}
+	fmt.Println(formatMessage(msg))
+}
+
+// formatMessage renders a broadcast as one transcript line
+func formatMessage(msg model.ServerResponse) string {
+	ts := msg.ServerTimestamp.Local().Format(time.TimeOnly)
+	name := msg.Username
+	if msg.Bot {
+		name += " [bot]"
+	}
+	switch msg.MessageType {
+	case model.MessageTypeAction:
+		return fmt.Sprintf("%s #%d * %s %s", ts, msg.Seq, name, msg.Message.Message)
+	case model.MessageTypeSystem:
+		return fmt.Sprintf("%s #%d -- %s", ts, msg.Seq, msg.Message.Message)
+	case model.MessageTypeJoin:
+		return fmt.Sprintf("%s #%d -> %s joined", ts, msg.Seq, name)
+	case model.MessageTypeLeave:
+		return fmt.Sprintf("%s #%d <- %s left", ts, msg.Seq, name)
+	}
+	return fmt.Sprintf("%s #%d <%s> %s", ts, msg.Seq, name, msg.Message.Message)
+}
@@ -0,0 +1,55 @@
+// Package codec encodes chat frames for the negotiated websocket subprotocol
+package codec
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols a client can request with Sec-WebSocket-Protocol
+const (
+	JSONProtocol    = "chat.json.v1"
+	MsgPackProtocol = "chat.msgpack.v1"
+	ProtoProtocol   = "chat.proto.v1"
+)
+
+// Protocols lists the supported subprotocols in server preference order
+var Protocols = []string{JSONProtocol, MsgPackProtocol, ProtoProtocol}
+
+// Codec converts frames to and from their wire representation
+type Codec interface {
+	// Name is the subprotocol the codec is negotiated under
+	Name() string
+	// FrameType is the websocket message type frames are sent as
+	FrameType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	MsgPack Codec = msgpackCodec{}
+	Proto   Codec = protoCodec{}
+)
+
+// ForProtocol returns the codec for a negotiated subprotocol. Connections
+// that didn't negotiate one use JSON, as before subprotocols existed.
+func ForProtocol(name string) (Codec, bool) {
+	switch name {
+	case "", JSONProtocol:
+		return JSON, true
+	case MsgPackProtocol:
+		return MsgPack, true
+	case ProtoProtocol:
+		return Proto, true
+	}
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return JSONProtocol }
+func (jsonCodec) FrameType() int                             { return websocket.TextMessage }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
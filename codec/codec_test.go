@@ -0,0 +1,212 @@
+package codec
+
+import (
+	"bytes"
+	"chatroom/server/model"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var codecs = []Codec{JSON, MsgPack, Proto}
+
+// frames has one populated value of every frame type sent in either direction
+func frames() []interface{} {
+	ts := time.Date(2026, 3, 14, 15, 9, 26, 535897000, time.UTC)
+	msg := model.Message{
+		UserId:      "42",
+		Username:    "alice",
+		Message:     "héllo, wörld",
+		Timestamp:   ts,
+		MessageType: model.MessageTypeText,
+	}
+	return []interface{}{
+		&msg,
+		&model.ServerResponse{
+			Message:         msg,
+			ServerTimestamp: ts.Add(time.Millisecond),
+			Status:          model.StatusError,
+			Error:           "too long",
+			Seq:             1 << 40,
+			Bot:             true,
+			Reply:           "topic set",
+			Code:            model.ErrorMessageLength,
+		},
+		&model.ControlMessage{
+			Type:         model.ControlTypeRedirect,
+			Reason:       "room owned by another node",
+			RetryAfterMs: 1500,
+			URL:          "ws://localhost:8081/chat/7",
+			NodeId:       "b",
+		},
+		&model.Hello{
+			Type:     model.ControlTypeHello,
+			Version:  model.ProtocolVersion,
+			Features: []string{model.FeatureAcks, model.FeatureHistory},
+			Client:   "test/1.0",
+		},
+		&model.Welcome{
+			Type:        model.ControlTypeWelcome,
+			Version:     model.ProtocolVersion,
+			Features:    []string{model.FeatureAcks},
+			Limits:      model.Limits{MaxMessageLength: 500, MaxBatchSize: 50, MaxFrameBytes: 64 << 10},
+			NodeId:      "a",
+			ConnId:      "c1",
+			ResumeToken: "token",
+			Resumed:     true,
+		},
+		&model.Ack{Type: model.ControlTypeAck, Seq: 99},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, cdc := range codecs {
+		for _, frame := range frames() {
+			data, err := cdc.Marshal(frame)
+			if err != nil {
+				t.Fatalf("%s: marshal %T: %v", cdc.Name(), frame, err)
+			}
+			got := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+			if err := cdc.Unmarshal(data, got); err != nil {
+				t.Fatalf("%s: unmarshal %T: %v", cdc.Name(), frame, err)
+			}
+			if !reflect.DeepEqual(got, frame) {
+				t.Errorf("%s: %T round-tripped to\n%+v\nwant\n%+v", cdc.Name(), frame, got, frame)
+			}
+		}
+	}
+}
+
+func TestRoundTripZeroValues(t *testing.T) {
+	for _, cdc := range codecs {
+		for _, frame := range frames() {
+			zero := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+			data, err := cdc.Marshal(zero)
+			if err != nil {
+				t.Fatalf("%s: marshal zero %T: %v", cdc.Name(), frame, err)
+			}
+			got := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+			if err := cdc.Unmarshal(data, got); err != nil {
+				t.Fatalf("%s: unmarshal zero %T: %v", cdc.Name(), frame, err)
+			}
+		}
+	}
+}
+
+func TestMsgPackBatchRoundTrip(t *testing.T) {
+	msg := *frames()[0].(*model.Message)
+	batch := []model.Message{msg, msg}
+	batch[1].Message = "second"
+
+	data, err := MsgPack.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []model.Message
+	if err := MsgPack.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, batch) {
+		t.Errorf("batch round-tripped to %+v", got)
+	}
+}
+
+func TestTruncatedInput(t *testing.T) {
+	for _, cdc := range codecs {
+		for _, frame := range frames() {
+			data, err := cdc.Marshal(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(data); i++ {
+				got := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+				err := cdc.Unmarshal(data[:i], got)
+				// A protobuf message cut between fields is a valid message
+				// with fewer fields, so only the other codecs must fail
+				if err == nil && cdc != Proto {
+					t.Errorf("%s: %T truncated to %d of %d bytes decoded", cdc.Name(), frame, i, len(data))
+				}
+			}
+			// Cutting into the last field always fails
+			got := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+			if cdc.Unmarshal(data[:len(data)-1], got) == nil {
+				t.Errorf("%s: %T missing its last byte decoded", cdc.Name(), frame)
+			}
+		}
+	}
+}
+
+func TestGarbageInput(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, cdc := range codecs {
+		for i := 0; i < 2000; i++ {
+			data := make([]byte, rng.Intn(64))
+			rng.Read(data)
+			var msg model.Message
+			cdc.Unmarshal(data, &msg) // must not panic
+			var resp model.ServerResponse
+			cdc.Unmarshal(data, &resp)
+		}
+	}
+
+	// Mutations of valid frames reach deeper into the decoders
+	for _, cdc := range codecs {
+		for _, frame := range frames() {
+			valid, _ := cdc.Marshal(frame)
+			for i := 0; i < 500; i++ {
+				data := append([]byte(nil), valid...)
+				data[rng.Intn(len(data))] = byte(rng.Intn(256))
+				got := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+				cdc.Unmarshal(data, got)
+			}
+		}
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	tests := []struct {
+		name string
+		cdc  Codec
+		data []byte
+	}{
+		{"msgpack huge array", MsgPack, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack huge map", MsgPack, []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{"msgpack huge string", MsgPack, []byte{0x81, 0xdb, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack non-string key", MsgPack, []byte{0x81, 0x01, 0x01}},
+		{"msgpack unknown extension", MsgPack, []byte{0xd6, 0x05, 0, 0, 0, 0}},
+		{"msgpack trailing data", MsgPack, []byte{0x80, 0x80}},
+		{"msgpack wrong type", MsgPack, []byte{0x81, 0xa6, 'u', 's', 'e', 'r', 'I', 'd', 0xc3}},
+		{"proto overlong varint", Proto, bytes.Repeat([]byte{0xff}, 11)},
+		{"proto huge length", Proto, []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"proto unsupported wire type", Proto, []byte{0x0b}},
+		{"proto string as varint", Proto, []byte{0x08, 0x01}},
+		{"json not an object", JSON, []byte(`[1,2`)},
+	}
+	for _, tt := range tests {
+		var msg model.Message
+		if err := tt.cdc.Unmarshal(tt.data, &msg); err == nil {
+			t.Errorf("%s: decoded to %+v", tt.name, msg)
+		}
+	}
+}
+
+func TestMsgPackNestingLimit(t *testing.T) {
+	nested := func(depth int) []byte {
+		data := bytes.Repeat([]byte{0x91}, depth) // fixarray of one element
+		return append(data, 0xc0)
+	}
+
+	var v interface{}
+	if err := MsgPack.Unmarshal(nested(mpMaxDepth), &v); err != nil {
+		t.Fatalf("%d levels: %v", mpMaxDepth, err)
+	}
+	if err := MsgPack.Unmarshal(nested(mpMaxDepth+1), &v); err != errTooDeep {
+		t.Fatalf("%d levels: err = %v, want errTooDeep", mpMaxDepth+1, err)
+	}
+	// Rejected at the limit, not after recursing through the whole frame
+	var msg model.Message
+	if err := MsgPack.Unmarshal(nested(1<<20), &msg); err != errTooDeep {
+		t.Fatalf("1M levels: err = %v, want errTooDeep", err)
+	}
+}
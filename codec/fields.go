@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// field describes how a struct field is named on the wire. Names come from
+// the json tag so every codec agrees with the JSON representation; binary
+// codecs that need numbers use the proto tag.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	protoNum  int
+}
+
+var (
+	namedFieldsCache sync.Map // reflect.Type -> []field
+	protoFieldsCache sync.Map // reflect.Type -> []field
+)
+
+// namedFields returns the fields of t the way encoding/json sees them:
+// exported, not tagged "-", with untagged embedded structs flattened
+func namedFields(t reflect.Type) []field {
+	if cached, ok := namedFieldsCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, opts := parseJSONTag(sf.Tag.Get("json"))
+		if name == "-" && opts == "" {
+			continue
+		}
+
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, inner := range namedFields(sf.Type) {
+				inner.index = append([]int{i}, inner.index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: strings.Contains(opts, "omitempty"),
+		})
+	}
+
+	namedFieldsCache.Store(t, fields)
+	return fields
+}
+
+// protoFields returns the direct fields of t that carry a proto tag.
+// Embedded structs are not flattened; they are encoded as nested messages.
+func protoFields(t reflect.Type) []field {
+	if cached, ok := protoFieldsCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		num, err := strconv.Atoi(sf.Tag.Get("proto"))
+		if err != nil || num <= 0 {
+			continue
+		}
+		fields = append(fields, field{name: sf.Name, index: []int{i}, protoNum: num})
+	}
+
+	protoFieldsCache.Store(t, fields)
+	return fields
+}
+
+func parseJSONTag(tag string) (name, opts string) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
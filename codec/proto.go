@@ -0,0 +1,324 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// protoCodec implements the protobuf wire format for structs whose fields
+// carry proto:"<field number>" tags (see chat.proto). Zero values are
+// omitted as in proto3, embedded structs are nested messages and time.Time
+// is a google.protobuf.Timestamp.
+type protoCodec struct{}
+
+func (protoCodec) Name() string   { return ProtoProtocol }
+func (protoCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("proto: cannot marshal %T, only structs are messages", v)
+	}
+	return appendMessage(nil, rv)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("proto: cannot unmarshal into %T", v)
+	}
+	return decodeMessage(data, rv.Elem())
+}
+
+// Wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendTag(buf []byte, num, wire int) []byte {
+	return binary.AppendUvarint(buf, uint64(num)<<3|uint64(wire))
+}
+
+func appendMessage(buf []byte, v reflect.Value) ([]byte, error) {
+	if v.Type() == timeType {
+		return appendTimestamp(buf, v.Interface().(time.Time)), nil
+	}
+
+	var err error
+	for _, f := range protoFields(v.Type()) {
+		fv := v.FieldByIndex(f.index)
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+			for i := 0; i < fv.Len(); i++ {
+				if buf, err = appendField(buf, f.protoNum, fv.Index(i), true); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if buf, err = appendField(buf, f.protoNum, fv, false); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// appendField writes one value; repeated elements are written even when zero
+func appendField(buf []byte, num int, v reflect.Value, repeated bool) ([]byte, error) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return buf, nil
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		if t.IsZero() && !repeated {
+			return buf, nil
+		}
+		buf = appendTag(buf, num, wireBytes)
+		nested := appendTimestamp(nil, t)
+		buf = binary.AppendUvarint(buf, uint64(len(nested)))
+		return append(buf, nested...), nil
+	}
+	if !repeated && v.Kind() != reflect.Struct && isEmptyValue(v) {
+		return buf, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		buf = appendTag(buf, num, wireVarint)
+		if v.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf = appendTag(buf, num, wireVarint)
+		return binary.AppendUvarint(buf, uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf = appendTag(buf, num, wireVarint)
+		return binary.AppendUvarint(buf, v.Uint()), nil
+	case reflect.Float32:
+		buf = appendTag(buf, num, wireFixed32)
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		buf = appendTag(buf, num, wireFixed64)
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		buf = appendTag(buf, num, wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		return append(buf, v.String()...), nil
+	case reflect.Slice:
+		// only []byte reaches here
+		buf = appendTag(buf, num, wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		return append(buf, v.Bytes()...), nil
+	case reflect.Struct:
+		nested, err := appendMessage(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendTag(buf, num, wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(len(nested)))
+		return append(buf, nested...), nil
+	}
+	return nil, fmt.Errorf("proto: unsupported field type %s", v.Type())
+}
+
+// appendTimestamp encodes google.protobuf.Timestamp {int64 seconds = 1; int32 nanos = 2;}
+func appendTimestamp(buf []byte, t time.Time) []byte {
+	if sec := t.Unix(); sec != 0 {
+		buf = appendTag(buf, 1, wireVarint)
+		buf = binary.AppendUvarint(buf, uint64(sec))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		buf = appendTag(buf, 2, wireVarint)
+		buf = binary.AppendUvarint(buf, uint64(nanos))
+	}
+	return buf
+}
+
+var errTruncated = errors.New("proto: truncated message")
+
+func decodeMessage(data []byte, v reflect.Value) error {
+	if v.Type() == timeType {
+		return decodeTimestamp(data, v)
+	}
+
+	fields := protoFields(v.Type())
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		num, wire := int(tag>>3), int(tag&7)
+
+		var (
+			scalar  uint64
+			payload []byte
+		)
+		switch wire {
+		case wireVarint:
+			scalar, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			scalar, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			scalar, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			payload, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", wire)
+		}
+
+		f, ok := protoFieldByNum(fields, num)
+		if !ok {
+			continue
+		}
+		fv := v.FieldByIndex(f.index)
+		if err := setField(fv, wire, scalar, payload); err != nil {
+			return fmt.Errorf("proto: field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+func protoFieldByNum(fields []field, num int) (field, bool) {
+	for _, f := range fields {
+		if f.protoNum == num {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+func setField(fv reflect.Value, wire int, scalar uint64, payload []byte) error {
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+		elemType := fv.Type().Elem()
+		if wire == wireBytes && isPackable(elemType) {
+			return appendPacked(fv, payload)
+		}
+		elem := reflect.New(elemType).Elem()
+		if err := setField(elem, wire, scalar, payload); err != nil {
+			return err
+		}
+		fv.Set(reflect.Append(fv, elem))
+		return nil
+	}
+
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		fv = fv.Elem()
+	}
+	if fv.Type() == timeType || fv.Kind() == reflect.Struct {
+		if wire != wireBytes {
+			return errors.New("expected a nested message")
+		}
+		return decodeMessage(payload, fv)
+	}
+
+	switch fv.Kind() {
+	case reflect.Bool:
+		fv.SetBool(scalar != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fv.SetInt(int64(scalar))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fv.SetUint(scalar)
+	case reflect.Float32:
+		fv.SetFloat(float64(math.Float32frombits(uint32(scalar))))
+	case reflect.Float64:
+		fv.SetFloat(math.Float64frombits(scalar))
+	case reflect.String:
+		if wire != wireBytes {
+			return errors.New("expected a length-delimited string")
+		}
+		fv.SetString(string(payload))
+	case reflect.Slice:
+		fv.SetBytes(append([]byte(nil), payload...))
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+func isPackable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// appendPacked decodes a packed repeated varint field
+func appendPacked(fv reflect.Value, payload []byte) error {
+	for len(payload) > 0 {
+		scalar, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return errTruncated
+		}
+		payload = payload[n:]
+		elem := reflect.New(fv.Type().Elem()).Elem()
+		if err := setField(elem, wireVarint, scalar, nil); err != nil {
+			return err
+		}
+		fv.Set(reflect.Append(fv, elem))
+	}
+	return nil
+}
+
+func decodeTimestamp(data []byte, v reflect.Value) error {
+	var sec, nanos int64
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		if tag&7 != wireVarint {
+			return errors.New("proto: malformed timestamp")
+		}
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+
+		switch tag >> 3 {
+		case 1:
+			sec = int64(value)
+		case 2:
+			nanos = int64(value)
+		}
+	}
+	v.Set(reflect.ValueOf(time.Unix(sec, nanos).UTC()))
+	return nil
+}
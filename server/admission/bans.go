@@ -0,0 +1,99 @@
+package admission
+
+import (
+	"time"
+)
+
+// BanPolicy turns repeated offences from one IP into a temporary ban: an
+// IP with Offences offences within Window is refused for Duration. Zero
+// Offences disables banning.
+type BanPolicy struct {
+	Offences int
+	Window   time.Duration
+	Duration time.Duration
+}
+
+// BannedError refuses a connection from a temporarily banned IP
+type BannedError struct {
+	Until time.Time
+}
+
+func (e *BannedError) Error() string {
+	return "address temporarily banned"
+}
+
+// SetBanPolicy configures when offending IPs are banned
+func (c *Controller) SetBanPolicy(policy BanPolicy) {
+	c.mu.Lock()
+	c.banPolicy = policy
+	c.mu.Unlock()
+}
+
+// Offence records abuse from ip, such as a connection disconnected for
+// invalid messages, and reports whether it got ip banned
+func (c *Controller) Offence(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	policy := c.banPolicy
+	if policy.Offences <= 0 {
+		return false
+	}
+	now := time.Now()
+	c.sweepOffences(now)
+
+	recent := append(c.offences[ip], now)
+	if len(recent) < policy.Offences {
+		c.offences[ip] = recent
+		return false
+	}
+	delete(c.offences, ip)
+	c.bans[ip] = now.Add(policy.Duration)
+	return true
+}
+
+// sweepOffences forgets offences older than the window and expired bans
+func (c *Controller) sweepOffences(now time.Time) {
+	cutoff := now.Add(-c.banPolicy.Window)
+	for ip, times := range c.offences {
+		i := 0
+		for i < len(times) && !times[i].After(cutoff) {
+			i++
+		}
+		if i == len(times) {
+			delete(c.offences, ip)
+		} else {
+			c.offences[ip] = times[i:]
+		}
+	}
+	for ip, until := range c.bans {
+		if !now.Before(until) {
+			delete(c.bans, ip)
+		}
+	}
+}
+
+// banned returns the ban on ip, if any. c.mu must be held.
+func (c *Controller) banned(ip string, now time.Time) (time.Time, bool) {
+	until, ok := c.bans[ip]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(until) {
+		delete(c.bans, ip)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Unban lifts the ban on ip and forgets its offences; it reports whether
+// ip was banned
+func (c *Controller) Unban(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.banned(ip, time.Now())
+	delete(c.bans, ip)
+	delete(c.offences, ip)
+	return ok
+}
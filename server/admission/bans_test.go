@@ -0,0 +1,85 @@
+package admission
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOffencesBanAnIP(t *testing.T) {
+	c := NewController(Limits{})
+	c.SetBanPolicy(BanPolicy{Offences: 3, Window: time.Minute, Duration: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		if c.Offence("10.0.0.1") {
+			t.Fatalf("banned after %d offences", i+1)
+		}
+	}
+	if c.Offence("10.0.0.2") {
+		t.Fatal("offences of another IP counted")
+	}
+	if !c.Offence("10.0.0.1") {
+		t.Fatal("not banned after 3 offences")
+	}
+
+	_, err := c.Acquire("10.0.0.1", "7")
+	var banned *BannedError
+	if !errors.As(err, &banned) {
+		t.Fatalf("Acquire from a banned IP: err = %v", err)
+	}
+	if d := time.Until(banned.Until); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("ban ends in %v, want an hour", d)
+	}
+	if _, err := c.Acquire("10.0.0.2", "7"); err != nil {
+		t.Errorf("other IP refused: %v", err)
+	}
+	if _, ok := c.Counts().Banned["10.0.0.1"]; !ok {
+		t.Error("ban missing from Counts")
+	}
+
+	if !c.Unban("10.0.0.1") {
+		t.Fatal("Unban reported no ban")
+	}
+	if c.Unban("10.0.0.1") {
+		t.Fatal("second Unban reported a ban")
+	}
+	if _, err := c.Acquire("10.0.0.1", "7"); err != nil {
+		t.Fatalf("Acquire after Unban: %v", err)
+	}
+	if c.Offence("10.0.0.1") {
+		t.Fatal("offences before the ban still counted")
+	}
+}
+
+func TestOffencesExpire(t *testing.T) {
+	c := NewController(Limits{})
+	c.SetBanPolicy(BanPolicy{Offences: 2, Window: 50 * time.Millisecond, Duration: time.Hour})
+
+	c.Offence("10.0.0.1")
+	time.Sleep(100 * time.Millisecond)
+	if c.Offence("10.0.0.1") {
+		t.Fatal("offence outside the window counted")
+	}
+}
+
+func TestBansExpire(t *testing.T) {
+	c := NewController(Limits{})
+	c.SetBanPolicy(BanPolicy{Offences: 1, Window: time.Minute, Duration: 50 * time.Millisecond})
+
+	if !c.Offence("10.0.0.1") {
+		t.Fatal("not banned")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Acquire("10.0.0.1", "7"); err != nil {
+		t.Fatalf("Acquire after the ban ended: %v", err)
+	}
+}
+
+func TestBansDisabled(t *testing.T) {
+	c := NewController(Limits{})
+	for i := 0; i < 100; i++ {
+		if c.Offence("10.0.0.1") {
+			t.Fatal("banned without a ban policy")
+		}
+	}
+}
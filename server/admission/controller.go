@@ -0,0 +1,155 @@
+package admission
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrServerFull    = errors.New("server connection limit reached")
+	ErrTooManyFromIP = errors.New("too many connections from this address")
+	ErrRoomFull      = errors.New("room connection limit reached")
+)
+
+// Limits caps the number of websocket connections. Zero means unlimited.
+type Limits struct {
+	MaxConnections int `json:"maxConnections"`
+	MaxPerIP       int `json:"maxPerIp"`
+	MaxPerRoom     int `json:"maxPerRoom"`
+}
+
+// Counts is a point-in-time view of the admitted connections
+type Counts struct {
+	Total   int64          `json:"total"`
+	PerIP   map[string]int `json:"perIp"`
+	PerRoom map[string]int `json:"perRoom"`
+	Limits  Limits         `json:"limits"`
+	// Banned lists the temporarily banned IPs and when their bans end
+	Banned map[string]time.Time `json:"banned,omitempty"`
+}
+
+// Controller decides whether a new connection may be upgraded and keeps
+// track of the connections currently held
+type Controller struct {
+	limits Limits
+	total  atomic.Int64
+
+	mu      sync.Mutex
+	perIP   map[string]int
+	perRoom map[string]int
+
+	banPolicy BanPolicy
+	offences  map[string][]time.Time // by IP, oldest first
+	bans      map[string]time.Time   // by IP, when the ban ends
+}
+
+func NewController(limits Limits) *Controller {
+	return &Controller{
+		limits:   limits,
+		perIP:    make(map[string]int),
+		perRoom:  make(map[string]int),
+		offences: make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+	}
+}
+
+// Acquire reserves a connection slot for ip in roomId. The returned release
+// func must be called exactly once when the connection goes away. A
+// banned ip gets a *BannedError.
+func (c *Controller) Acquire(ip, roomId string) (release func(), err error) {
+	c.mu.Lock()
+	until, banned := c.banned(ip, time.Now())
+	c.mu.Unlock()
+	if banned {
+		return nil, &BannedError{Until: until}
+	}
+
+	if !c.reserveTotal() {
+		return nil, ErrServerFull
+	}
+
+	c.mu.Lock()
+	if c.limits.MaxPerIP > 0 && c.perIP[ip] >= c.limits.MaxPerIP {
+		c.mu.Unlock()
+		c.total.Add(-1)
+		return nil, ErrTooManyFromIP
+	}
+	if c.limits.MaxPerRoom > 0 && c.perRoom[roomId] >= c.limits.MaxPerRoom {
+		c.mu.Unlock()
+		c.total.Add(-1)
+		return nil, ErrRoomFull
+	}
+	c.perIP[ip]++
+	c.perRoom[roomId]++
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.release(ip, roomId) })
+	}, nil
+}
+
+func (c *Controller) reserveTotal() bool {
+	for {
+		current := c.total.Load()
+		if c.limits.MaxConnections > 0 && current >= int64(c.limits.MaxConnections) {
+			return false
+		}
+		if c.total.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+func (c *Controller) release(ip, roomId string) {
+	c.mu.Lock()
+	if c.perIP[ip]--; c.perIP[ip] <= 0 {
+		delete(c.perIP, ip)
+	}
+	if c.perRoom[roomId]--; c.perRoom[roomId] <= 0 {
+		delete(c.perRoom, roomId)
+	}
+	c.mu.Unlock()
+	c.total.Add(-1)
+}
+
+// Total returns the number of admitted connections
+func (c *Controller) Total() int64 {
+	return c.total.Load()
+}
+
+// Limits returns the configured limits
+func (c *Controller) Limits() Limits {
+	return c.limits
+}
+
+// Counts returns a copy of the current connection counts
+func (c *Controller) Counts() Counts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := Counts{
+		Total:   c.total.Load(),
+		PerIP:   make(map[string]int, len(c.perIP)),
+		PerRoom: make(map[string]int, len(c.perRoom)),
+		Limits:  c.limits,
+	}
+	now := time.Now()
+	for ip, until := range c.bans {
+		if now.Before(until) {
+			if counts.Banned == nil {
+				counts.Banned = make(map[string]time.Time)
+			}
+			counts.Banned[ip] = until
+		}
+	}
+	for ip, n := range c.perIP {
+		counts.PerIP[ip] = n
+	}
+	for roomId, n := range c.perRoom {
+		counts.PerRoom[roomId] = n
+	}
+	return counts
+}
@@ -0,0 +1,94 @@
+package admission
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		ip     string
+		roomId string
+		want   error
+	}{
+		{"server full", Limits{MaxConnections: 2}, "10.0.0.9", "other", ErrServerFull},
+		{"same IP", Limits{MaxPerIP: 2}, "10.0.0.1", "other", ErrTooManyFromIP},
+		{"other IP", Limits{MaxPerIP: 2}, "10.0.0.9", "other", nil},
+		{"same room", Limits{MaxPerRoom: 2}, "10.0.0.9", "7", ErrRoomFull},
+		{"other room", Limits{MaxPerRoom: 2}, "10.0.0.9", "other", nil},
+		{"unlimited", Limits{}, "10.0.0.1", "7", nil},
+	}
+	for _, tt := range tests {
+		c := NewController(tt.limits)
+		for i := 0; i < 2; i++ {
+			if _, err := c.Acquire("10.0.0.1", "7"); err != nil {
+				t.Fatalf("%s: connection %d refused: %v", tt.name, i, err)
+			}
+		}
+		if _, err := c.Acquire(tt.ip, tt.roomId); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestReleaseFreesTheSlot(t *testing.T) {
+	c := NewController(Limits{MaxConnections: 1, MaxPerIP: 1, MaxPerRoom: 1})
+	release, err := c.Acquire("10.0.0.1", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Acquire("10.0.0.1", "7"); err == nil {
+		t.Fatal("second connection admitted")
+	}
+
+	release()
+	release() // a second call must not free a slot someone else holds
+	if c.Total() != 0 {
+		t.Fatalf("Total = %d after release", c.Total())
+	}
+	counts := c.Counts()
+	if len(counts.PerIP) != 0 || len(counts.PerRoom) != 0 {
+		t.Fatalf("counts not cleared: %+v", counts)
+	}
+	if _, err := c.Acquire("10.0.0.1", "7"); err != nil {
+		t.Fatalf("slot not freed: %v", err)
+	}
+}
+
+func TestRefusedConnectionsHoldNoSlot(t *testing.T) {
+	c := NewController(Limits{MaxConnections: 10, MaxPerIP: 1})
+	c.Acquire("10.0.0.1", "7")
+	for i := 0; i < 5; i++ {
+		c.Acquire("10.0.0.1", "7")
+	}
+	if c.Total() != 1 {
+		t.Fatalf("Total = %d, want 1", c.Total())
+	}
+}
+
+func TestConcurrentAcquireRespectsTotal(t *testing.T) {
+	const limit = 50
+	c := NewController(Limits{MaxConnections: limit})
+
+	var mu sync.Mutex
+	admitted := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Acquire("10.0.0.1", "7"); err == nil {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if admitted != limit || c.Total() != limit {
+		t.Fatalf("admitted %d, Total %d, want %d", admitted, c.Total(), limit)
+	}
+}
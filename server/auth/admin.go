@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// AdminToken checks the bearer token of administrative requests
+type AdminToken struct {
+	digest [sha256.Size]byte
+	set    bool
+}
+
+// NewAdminToken accepts requests bearing token; an empty token disables
+// the check
+func NewAdminToken(token string) *AdminToken {
+	if token == "" {
+		return &AdminToken{}
+	}
+	return &AdminToken{digest: sha256.Sum256([]byte(token)), set: true}
+}
+
+// Enabled reports whether a token is configured
+func (a *AdminToken) Enabled() bool {
+	return a != nil && a.set
+}
+
+// Check reports whether r bears the admin token. Digests of equal length
+// are compared in constant time.
+func (a *AdminToken) Check(r *http.Request) bool {
+	if !a.Enabled() {
+		return false
+	}
+	token, ok := BearerToken(r)
+	if !ok || token == "" {
+		return false
+	}
+	digest := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(digest[:], a.digest[:]) == 1
+}
@@ -0,0 +1,107 @@
+// Package auth authenticates the HTTP callers that are not chat users
+package auth
+
+import (
+	"chatroom/server/model"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Bot is an integration allowed to post into rooms over HTTP. Its messages
+// are sent as UserId with Name as the username, whatever the body says.
+type Bot struct {
+	Name   string   `json:"name"`
+	UserId string   `json:"userId"`
+	Token  string   `json:"token"`
+	Rooms  []string `json:"rooms,omitempty"` // rooms it may post to; empty means all
+}
+
+// CanPost reports whether the bot may post into roomId
+func (b Bot) CanPost(roomId string) bool {
+	if len(b.Rooms) == 0 {
+		return true
+	}
+	for _, r := range b.Rooms {
+		if r == roomId {
+			return true
+		}
+	}
+	return false
+}
+
+// Bots looks bots up by token. Tokens are kept as SHA-256 digests so the
+// lookup does not compare secrets byte by byte.
+type Bots struct {
+	byDigest map[[sha256.Size]byte]Bot
+}
+
+// NewBots indexes bots. Names, userIds and tokens must be unique, and the
+// name and userId must be a valid chat username and userId.
+func NewBots(bots []Bot) (*Bots, error) {
+	b := &Bots{byDigest: make(map[[sha256.Size]byte]Bot, len(bots))}
+	names := make(map[string]bool, len(bots))
+	userIds := make(map[string]bool, len(bots))
+	for _, bot := range bots {
+		if bot.Name == "" || bot.Token == "" {
+			return nil, errors.New("bots need a name and a token")
+		}
+		if code, errStr := model.ValidateIdentity(bot.UserId, bot.Name); code != "" {
+			return nil, fmt.Errorf("bot %q: %s", bot.Name, errStr)
+		}
+		digest := sha256.Sum256([]byte(bot.Token))
+		if names[bot.Name] {
+			return nil, fmt.Errorf("duplicate bot %q", bot.Name)
+		}
+		if userIds[bot.UserId] {
+			return nil, fmt.Errorf("bot %q reuses another bot's userId", bot.Name)
+		}
+		if _, ok := b.byDigest[digest]; ok {
+			return nil, fmt.Errorf("bot %q reuses another bot's token", bot.Name)
+		}
+		names[bot.Name] = true
+		userIds[bot.UserId] = true
+		b.byDigest[digest] = bot
+	}
+	return b, nil
+}
+
+// LoadBots reads a JSON array of bots from path
+func LoadBots(path string) (*Bots, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bots []Bot
+	if err := json.Unmarshal(data, &bots); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewBots(bots)
+}
+
+// Authenticate returns the bot owning token
+func (b *Bots) Authenticate(token string) (Bot, bool) {
+	if b == nil || token == "" {
+		return Bot{}, false
+	}
+	bot, ok := b.byDigest[sha256.Sum256([]byte(token))]
+	return bot, ok
+}
+
+// BearerToken returns the token of an "Authorization: Bearer <token>"
+// header; ok is false when the request has no Authorization header at all
+func BearerToken(r *http.Request) (token string, ok bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false
+	}
+	scheme, token, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", true
+	}
+	return strings.TrimSpace(token), true
+}
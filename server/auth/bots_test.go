@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewBots(t *testing.T) {
+	ci := Bot{Name: "cibot", UserId: "99999", Token: "s3cret-ci"}
+	tests := []struct {
+		name string
+		bots []Bot
+		ok   bool
+	}{
+		{"valid", []Bot{ci, {Name: "alerts", UserId: "99998", Token: "s3cret-al"}}, true},
+		{"no token", []Bot{{Name: "cibot", UserId: "99999"}}, false},
+		{"no userId", []Bot{{Name: "cibot", Token: "t"}}, false},
+		{"userId out of range", []Bot{{Name: "cibot", UserId: "100001", Token: "t"}}, false},
+		{"invalid name", []Bot{{Name: "ci", UserId: "99999", Token: "t"}}, false},
+		{"duplicate name", []Bot{ci, {Name: "cibot", UserId: "99998", Token: "t"}}, false},
+		{"duplicate userId", []Bot{ci, {Name: "alerts", UserId: "99999", Token: "t"}}, false},
+		{"duplicate token", []Bot{ci, {Name: "alerts", UserId: "99998", Token: "s3cret-ci"}}, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewBots(tt.bots); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	bots, err := NewBots([]Bot{{Name: "cibot", UserId: "99999", Token: "s3cret-ci", Rooms: []string{"ops"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot, ok := bots.Authenticate("s3cret-ci")
+	if !ok || bot.Name != "cibot" {
+		t.Fatalf("Authenticate = %+v, %v", bot, ok)
+	}
+	if !bot.CanPost("ops") || bot.CanPost("dev") {
+		t.Error("room restriction not applied")
+	}
+	for _, token := range []string{"", "s3cret", "s3cret-ci "} {
+		if _, ok := bots.Authenticate(token); ok {
+			t.Errorf("token %q authenticated", token)
+		}
+	}
+	var none *Bots
+	if _, ok := none.Authenticate("s3cret-ci"); ok {
+		t.Error("nil Bots authenticated")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"", "", false},
+		{"Bearer abc", "abc", true},
+		{"bearer  abc ", "abc", true},
+		{"Basic YWxhZGRpbg==", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/rooms/7/messages", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if token, ok := BearerToken(r); token != tt.token || ok != tt.ok {
+			t.Errorf("%q: got %q, %v", tt.header, token, ok)
+		}
+	}
+}
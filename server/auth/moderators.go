@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Moderator may run moderator commands on websocket connections opened
+// with its token
+type Moderator struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token"`
+	Rooms []string `json:"rooms,omitempty"` // rooms it moderates; empty means all
+}
+
+// CanModerate reports whether the moderator may moderate roomId
+func (m Moderator) CanModerate(roomId string) bool {
+	if len(m.Rooms) == 0 {
+		return true
+	}
+	for _, r := range m.Rooms {
+		if r == roomId {
+			return true
+		}
+	}
+	return false
+}
+
+// Moderators looks moderators up by token, kept as SHA-256 digests like
+// the bots'
+type Moderators struct {
+	byDigest map[[sha256.Size]byte]Moderator
+}
+
+// NewModerators indexes moderators; names and tokens must be unique and
+// non-empty
+func NewModerators(moderators []Moderator) (*Moderators, error) {
+	m := &Moderators{byDigest: make(map[[sha256.Size]byte]Moderator, len(moderators))}
+	names := make(map[string]bool, len(moderators))
+	for _, mod := range moderators {
+		if mod.Name == "" || mod.Token == "" {
+			return nil, errors.New("moderators need a name and a token")
+		}
+		digest := sha256.Sum256([]byte(mod.Token))
+		if names[mod.Name] {
+			return nil, fmt.Errorf("duplicate moderator %q", mod.Name)
+		}
+		if _, ok := m.byDigest[digest]; ok {
+			return nil, fmt.Errorf("moderator %q reuses another moderator's token", mod.Name)
+		}
+		names[mod.Name] = true
+		m.byDigest[digest] = mod
+	}
+	return m, nil
+}
+
+// LoadModerators reads a JSON array of moderators from path
+func LoadModerators(path string) (*Moderators, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var moderators []Moderator
+	if err := json.Unmarshal(data, &moderators); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewModerators(moderators)
+}
+
+// Authenticate returns the moderator owning token
+func (m *Moderators) Authenticate(token string) (Moderator, bool) {
+	if m == nil || token == "" {
+		return Moderator{}, false
+	}
+	mod, ok := m.byDigest[sha256.Sum256([]byte(token))]
+	return mod, ok
+}
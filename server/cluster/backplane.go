@@ -0,0 +1,132 @@
+// Package cluster connects the rooms of several server nodes so a message
+// accepted on one node reaches the room's clients on every node
+package cluster
+
+import (
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var backplaneRejected = metrics.NewCounter(
+	"chat_backplane_rejected_total",
+	"Envelopes from other nodes dropped because they failed validation.",
+)
+
+// Envelope carries an accepted message from the node that accepted it
+type Envelope struct {
+	Origin  string               `json:"origin"` // node ID that accepted the message
+	RoomId  string               `json:"roomId"`
+	ConnId  string               `json:"connId"` // sender's connection on the origin node
+	Message model.ServerResponse `json:"message"`
+}
+
+// validateEnvelope checks an envelope received from another node before it
+// reaches a room, with the rules of messages sent by clients
+func validateEnvelope(env *Envelope) error {
+	if env.Origin == "" || env.RoomId == "" {
+		return errors.New("envelope without an origin or room")
+	}
+	if env.Message.Status != model.StatusOK {
+		return fmt.Errorf("message status %q is not OK", env.Message.Status)
+	}
+	if code, errStr := model.ValidateAccepted(&env.Message.Message); code != "" {
+		return fmt.Errorf("%s: %s", code, errStr)
+	}
+	return nil
+}
+
+// Handler receives envelopes for a subscribed room. It is called from the
+// backplane's goroutines and must not block for long.
+type Handler func(Envelope)
+
+// Backplane fans accepted messages out to every node that has the room.
+// Publish delivers to local subscribers too, so rooms only ever broadcast
+// what comes back through their subscription.
+type Backplane interface {
+	Publish(env Envelope) error
+	Subscribe(roomId string, h Handler) (unsubscribe func(), err error)
+	Close() error
+}
+
+// localBus is the per-node subscriber registry shared by the implementations
+type localBus struct {
+	mu     sync.RWMutex
+	nextId int
+	subs   map[string]map[int]Handler
+}
+
+func newLocalBus() *localBus {
+	return &localBus{subs: make(map[string]map[int]Handler)}
+}
+
+func (b *localBus) subscribe(roomId string, h Handler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextId++
+	id := b.nextId
+	if b.subs[roomId] == nil {
+		b.subs[roomId] = make(map[int]Handler)
+	}
+	b.subs[roomId][id] = h
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[roomId], id)
+		if len(b.subs[roomId]) == 0 {
+			delete(b.subs, roomId)
+		}
+	}
+}
+
+// rooms lists the rooms with local subscribers
+func (b *localBus) rooms() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	rooms := make([]string, 0, len(b.subs))
+	for roomId := range b.subs {
+		rooms = append(rooms, roomId)
+	}
+	return rooms
+}
+
+func (b *localBus) deliver(env Envelope) {
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.subs[env.RoomId]))
+	for _, h := range b.subs[env.RoomId] {
+		handlers = append(handlers, h)
+	}
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(env)
+	}
+}
+
+// InProcess is a Backplane within a single process. Sharing one between
+// several Managers simulates a cluster, e.g. in tests.
+type InProcess struct {
+	bus *localBus
+}
+
+func NewInProcess() *InProcess {
+	return &InProcess{bus: newLocalBus()}
+}
+
+func (p *InProcess) Publish(env Envelope) error {
+	p.bus.deliver(env)
+	return nil
+}
+
+func (p *InProcess) Subscribe(roomId string, h Handler) (func(), error) {
+	return p.bus.subscribe(roomId, h), nil
+}
+
+func (p *InProcess) Close() error {
+	return nil
+}
@@ -0,0 +1,372 @@
+package cluster
+
+import (
+	"bufio"
+	"chatroom/server/metrics"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	meshQueueSize        = 4096
+	meshDialTimeout      = 3 * time.Second
+	meshHandshakeTimeout = 3 * time.Second
+	meshMaxHandshakeLine = 4096 // bytes; both handshake lines are far shorter
+	meshMaxBackoff       = 10 * time.Second
+	meshWriteDeadline    = 5 * time.Second
+)
+
+// ErrNoClusterSecret refuses a mesh whose peers could not authenticate
+var ErrNoClusterSecret = errors.New("mesh backplane needs a cluster secret")
+
+var (
+	meshSent = metrics.NewCounter(
+		"chat_backplane_mesh_sent_total",
+		"Envelopes written to mesh peers.",
+	)
+	meshReceived = metrics.NewCounter(
+		"chat_backplane_mesh_received_total",
+		"Envelopes received from mesh peers.",
+	)
+	meshDropped = metrics.NewCounter(
+		"chat_backplane_mesh_dropped_total",
+		"Envelopes dropped because a peer's queue was full or it was unreachable.",
+	)
+	meshAuthFailures = metrics.NewCounter(
+		"chat_backplane_mesh_auth_failures_total",
+		"Inbound mesh connections closed because they failed the handshake.",
+	)
+)
+
+// Mesh is a Backplane over TCP: every node listens for its peers and keeps
+// one outbound connection to each configured peer. Envelopes are sent as
+// newline-delimited JSON and never forwarded, so the peers must form a
+// full mesh (every node lists every other node).
+//
+// A connecting peer proves it knows the cluster secret by answering the
+// listener's random challenge with an HMAC, and may then only send
+// envelopes of its own node. The connection is not encrypted.
+type Mesh struct {
+	nodeId   string
+	secret   []byte
+	bus      *localBus
+	listener net.Listener
+	peers    []*meshPeer
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	inbound map[net.Conn]bool
+}
+
+type meshPeer struct {
+	addr  string
+	queue chan Envelope
+}
+
+// NewMesh listens on listenAddr and starts connecting to peers, which
+// must share secret
+func NewMesh(nodeId, listenAddr string, peers []string, secret string) (*Mesh, error) {
+	if secret == "" {
+		return nil, ErrNoClusterSecret
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mesh{
+		nodeId:   nodeId,
+		secret:   []byte(secret),
+		bus:      newLocalBus(),
+		listener: listener,
+		done:     make(chan struct{}),
+		inbound:  make(map[net.Conn]bool),
+	}
+
+	m.wg.Add(1)
+	go m.acceptLoop()
+
+	for _, addr := range peers {
+		peer := &meshPeer{addr: addr, queue: make(chan Envelope, meshQueueSize)}
+		m.peers = append(m.peers, peer)
+		m.wg.Add(1)
+		go m.peerLoop(peer)
+	}
+
+	slog.Info("mesh backplane listening", "nodeId", nodeId, "addr", listener.Addr().String(), "peers", peers)
+	return m, nil
+}
+
+// Addr returns the address the mesh listens on
+func (m *Mesh) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+func (m *Mesh) Publish(env Envelope) error {
+	m.bus.deliver(env)
+
+	for _, peer := range m.peers {
+		select {
+		case peer.queue <- env:
+		default:
+			meshDropped.Inc()
+		}
+	}
+	return nil
+}
+
+func (m *Mesh) Subscribe(roomId string, h Handler) (func(), error) {
+	return m.bus.subscribe(roomId, h), nil
+}
+
+func (m *Mesh) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.listener.Close()
+
+		m.mu.Lock()
+		for conn := range m.inbound {
+			conn.Close()
+		}
+		m.mu.Unlock()
+	})
+	m.wg.Wait()
+	return nil
+}
+
+func (m *Mesh) acceptLoop() {
+	defer m.wg.Done()
+
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			slog.Warn("mesh accept failed", "err", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		m.mu.Lock()
+		m.inbound[conn] = true
+		m.mu.Unlock()
+
+		m.wg.Add(1)
+		go m.readLoop(conn)
+	}
+}
+
+// readLoop delivers the envelopes a peer sends to the local subscribers
+func (m *Mesh) readLoop(conn net.Conn) {
+	defer m.wg.Done()
+	defer func() {
+		m.mu.Lock()
+		delete(m.inbound, conn)
+		m.mu.Unlock()
+		conn.Close()
+	}()
+
+	log := slog.With("peer", conn.RemoteAddr().String())
+	r := bufio.NewReaderSize(conn, meshMaxHandshakeLine)
+	peerId, err := m.challenge(conn, r)
+	if err != nil {
+		meshAuthFailures.Inc()
+		log.Warn("mesh peer rejected", "err", err)
+		return
+	}
+	log = log.With("peerId", peerId)
+	log.Info("mesh peer connected")
+
+	dec := json.NewDecoder(r)
+	for {
+		var env Envelope
+		if err := dec.Decode(&env); err != nil {
+			log.Info("mesh peer disconnected", "err", err)
+			return
+		}
+		// Envelopes are never forwarded, so a peer only sends its own
+		if env.Origin != peerId {
+			backplaneRejected.Inc()
+			log.Warn("mesh envelope rejected", "origin", env.Origin)
+			continue
+		}
+		if err := validateEnvelope(&env); err != nil {
+			backplaneRejected.Inc()
+			log.Warn("mesh envelope rejected", "roomId", env.RoomId, "err", err)
+			continue
+		}
+		meshReceived.Inc()
+		m.bus.deliver(env)
+	}
+}
+
+// meshChallenge is the first line the listener sends on a connection
+type meshChallenge struct {
+	Nonce string `json:"nonce"`
+}
+
+// meshAuth answers it: the connecting node and its proof of the secret
+type meshAuth struct {
+	NodeId string `json:"nodeId"`
+	MAC    string `json:"mac"`
+}
+
+// meshMAC binds the answer to the challenge and the node's ID
+func meshMAC(secret []byte, nonce, nodeId string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("chat-mesh-v1\n" + nonce + "\n" + nodeId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readHandshake decodes one newline-terminated handshake line into v. The
+// peer is not authenticated yet, so the line is capped at the size of r's
+// buffer rather than read for as long as the peer keeps sending.
+func readHandshake(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return errors.New("handshake line too long")
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// challenge authenticates an inbound connection and returns the peer's node ID
+func (m *Mesh) challenge(conn net.Conn, r *bufio.Reader) (string, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	challenge := meshChallenge{Nonce: hex.EncodeToString(nonce)}
+
+	conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := json.NewEncoder(conn).Encode(challenge); err != nil {
+		return "", err
+	}
+	var auth meshAuth
+	if err := readHandshake(r, &auth); err != nil {
+		return "", fmt.Errorf("reading handshake: %w", err)
+	}
+	want := meshMAC(m.secret, challenge.Nonce, auth.NodeId)
+	if auth.NodeId == "" || auth.NodeId == m.nodeId || !hmac.Equal([]byte(auth.MAC), []byte(want)) {
+		return "", errors.New("bad cluster secret or node ID")
+	}
+	return auth.NodeId, nil
+}
+
+// answer proves the secret to the peer listening on conn
+func (m *Mesh) answer(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var challenge meshChallenge
+	// The listener sends nothing else until it has our answer, so the
+	// reader cannot buffer past the challenge
+	if err := readHandshake(bufio.NewReaderSize(conn, meshMaxHandshakeLine), &challenge); err != nil {
+		return fmt.Errorf("reading challenge: %w", err)
+	}
+	return json.NewEncoder(conn).Encode(meshAuth{
+		NodeId: m.nodeId,
+		MAC:    meshMAC(m.secret, challenge.Nonce, m.nodeId),
+	})
+}
+
+// peerLoop keeps a connection to one peer and writes its queue, redialling
+// with exponential backoff whenever the connection fails
+func (m *Mesh) peerLoop(peer *meshPeer) {
+	defer m.wg.Done()
+
+	log := slog.With("peer", peer.addr)
+	backoff := 100 * time.Millisecond
+
+	for {
+		conn, err := net.DialTimeout("tcp", peer.addr, meshDialTimeout)
+		if err != nil {
+			log.Debug("mesh dial failed", "err", err, "retryIn", backoff)
+			if !m.sleep(backoff) {
+				return
+			}
+			backoff = min(backoff*2, meshMaxBackoff)
+			continue
+		}
+
+		if err := m.answer(conn); err != nil {
+			conn.Close()
+			log.Warn("mesh handshake failed", "err", err, "retryIn", backoff)
+			if !m.sleep(backoff) {
+				return
+			}
+			backoff = min(backoff*2, meshMaxBackoff)
+			continue
+		}
+
+		log.Info("mesh connected to peer")
+		backoff = 100 * time.Millisecond
+		err = m.writeLoop(conn, peer)
+		conn.Close()
+		if err == nil {
+			return
+		}
+		log.Warn("mesh peer connection lost", "err", err)
+	}
+}
+
+// writeLoop returns nil when the mesh is closed and the write error otherwise
+func (m *Mesh) writeLoop(conn net.Conn, peer *meshPeer) error {
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+
+	for {
+		var env Envelope
+		select {
+		case env = <-peer.queue:
+		case <-m.done:
+			return nil
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(meshWriteDeadline))
+		if err := enc.Encode(env); err != nil {
+			meshDropped.Inc()
+			return err
+		}
+		sent := uint64(1)
+		// Batch whatever else is queued into the same flush
+		for pending := len(peer.queue); pending > 0; pending-- {
+			if err := enc.Encode(<-peer.queue); err != nil {
+				meshDropped.Inc()
+				return err
+			}
+			sent++
+		}
+		if err := w.Flush(); err != nil {
+			meshDropped.Add(sent)
+			return err
+		}
+		meshSent.Add(sent)
+	}
+}
+
+// sleep waits for d unless the mesh is closed first
+func (m *Mesh) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-m.done:
+		return false
+	}
+}
@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"chatroom/server/model"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// freeAddrs reserves n loopback ports, so meshes can list each other as
+// peers before they listen
+func freeAddrs(t *testing.T, n int) []string {
+	t.Helper()
+	addrs := make([]string, n)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	return addrs
+}
+
+func newTestMesh(t *testing.T, nodeId, addr string, peers []string, secret string) *Mesh {
+	t.Helper()
+	m, err := NewMesh(nodeId, addr, peers, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func testEnvelope(origin, roomId, text string) Envelope {
+	return Envelope{
+		Origin: origin,
+		RoomId: roomId,
+		ConnId: "c1",
+		Message: model.ServerResponse{
+			Message: model.Message{
+				UserId:      "1",
+				Username:    "alice",
+				Message:     text,
+				Timestamp:   time.Now(),
+				MessageType: model.MessageTypeText,
+			},
+			Status:          model.StatusOK,
+			ServerTimestamp: time.Now(),
+		},
+	}
+}
+
+func subscribeChan(t *testing.T, bp Backplane, roomId string) <-chan Envelope {
+	t.Helper()
+	ch := make(chan Envelope, 16)
+	unsubscribe, err := bp.Subscribe(roomId, func(env Envelope) { ch <- env })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unsubscribe)
+	return ch
+}
+
+// publishUntil republishes env until it arrives on ch, since the peer
+// connection comes up in the background, then drains the extra copies
+func publishUntil(t *testing.T, bp Backplane, env Envelope, ch <-chan Envelope) Envelope {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		if err := bp.Publish(env); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-ch:
+			for {
+				select {
+				case <-ch:
+				case <-time.After(100 * time.Millisecond):
+					return got
+				}
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("envelope from %s never arrived", env.Origin)
+		}
+	}
+}
+
+func expectNothing(t *testing.T, ch <-chan Envelope) {
+	t.Helper()
+	select {
+	case env := <-ch:
+		t.Fatalf("unexpected envelope %+v", env)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMeshBroadcastsBetweenNodes(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	a := newTestMesh(t, "a", addrs[0], addrs[1:], testSecret)
+	b := newTestMesh(t, "b", addrs[1], addrs[:1], testSecret)
+
+	// Publish delivers locally too, so each direction uses its own room
+	fromA := subscribeChan(t, b, "7")
+	fromB := subscribeChan(t, a, "8")
+
+	got := publishUntil(t, a, testEnvelope("a", "7", "hello b"), fromA)
+	if got.Origin != "a" || got.Message.Message.Message != "hello b" {
+		t.Fatalf("b got %+v", got)
+	}
+	got = publishUntil(t, b, testEnvelope("b", "8", "hello a"), fromB)
+	if got.Origin != "b" || got.Message.Message.Message != "hello a" {
+		t.Fatalf("a got %+v", got)
+	}
+}
+
+func TestMeshRejectsWrongSecret(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	a := newTestMesh(t, "a", addrs[0], nil, testSecret)
+	intruder := newTestMesh(t, "x", addrs[1], addrs[:1], "wrong-secret")
+
+	received := subscribeChan(t, a, "7")
+	for i := 0; i < 5; i++ {
+		intruder.Publish(testEnvelope("x", "7", "let me in"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	expectNothing(t, received)
+}
+
+func TestMeshRejectsUnauthenticatedInjection(t *testing.T) {
+	a := newTestMesh(t, "a", "127.0.0.1:0", nil, testSecret)
+	received := subscribeChan(t, a, "7")
+
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	for i := 0; i < 3; i++ {
+		enc.Encode(testEnvelope("b", "7", "injected"))
+	}
+	expectNothing(t, received)
+}
+
+func TestMeshRejectsOversizedHandshake(t *testing.T) {
+	a := newTestMesh(t, "a", "127.0.0.1:0", nil, testSecret)
+
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	// One endless JSON string, never terminated by a newline
+	go func() {
+		conn.Write([]byte(`{"nodeId":"`))
+		conn.Write(bytes.Repeat([]byte("x"), 1<<20))
+	}()
+
+	// The listener hangs up once the cap is reached, well before the
+	// handshake timeout
+	conn.SetReadDeadline(time.Now().Add(meshHandshakeTimeout / 2))
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("listener sent data after an oversized handshake")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("listener kept reading the oversized handshake")
+	}
+}
+
+func TestMeshRejectsInvalidEnvelopes(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	a := newTestMesh(t, "a", addrs[0], nil, testSecret)
+	b := newTestMesh(t, "b", addrs[1], addrs[:1], testSecret)
+
+	received := subscribeChan(t, a, "7")
+	publishUntil(t, b, testEnvelope("b", "7", "valid"), received)
+
+	spoofed := testEnvelope("c", "7", "from another node")
+	tooLong := testEnvelope("b", "7", string(make([]byte, model.MaxMessageLength+1)))
+	badUser := testEnvelope("b", "7", "hi")
+	badUser.Message.Username = "<script>"
+	notAccepted := testEnvelope("b", "7", "hi")
+	notAccepted.Message.Status = model.StatusError
+
+	for _, env := range []Envelope{spoofed, tooLong, badUser, notAccepted} {
+		b.Publish(env)
+	}
+	// A valid envelope sent after them arrives first if they were dropped
+	b.Publish(testEnvelope("b", "7", "still valid"))
+	select {
+	case got := <-received:
+		if got.Message.Message.Message != "still valid" {
+			t.Fatalf("invalid envelope delivered: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("valid envelope never arrived")
+	}
+}
+
+func TestNewMeshNeedsSecret(t *testing.T) {
+	if _, err := NewMesh("a", "127.0.0.1:0", nil, ""); err != ErrNoClusterSecret {
+		t.Fatalf("err = %v, want ErrNoClusterSecret", err)
+	}
+}
@@ -0,0 +1,403 @@
+package cluster
+
+import (
+	"bufio"
+	"chatroom/server/metrics"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	redisQueueSize     = 4096
+	redisDialTimeout   = 3 * time.Second
+	redisMaxBackoff    = 10 * time.Second
+	redisWriteDeadline = 5 * time.Second
+
+	// RedisChannelPrefix is prepended to the room ID to name its channel
+	RedisChannelPrefix = "chat:room:"
+)
+
+var (
+	redisPublished = metrics.NewCounter(
+		"chat_backplane_redis_published_total",
+		"Envelopes published to Redis.",
+	)
+	redisReceived = metrics.NewCounter(
+		"chat_backplane_redis_received_total",
+		"Envelopes received from Redis that originated on other nodes.",
+	)
+	redisDropped = metrics.NewCounter(
+		"chat_backplane_redis_dropped_total",
+		"Envelopes not published because the queue was full or Redis was unreachable.",
+	)
+)
+
+// Redis is a Backplane over Redis pub/sub with one channel per room. It
+// keeps two connections: one that pipelines PUBLISH commands and one in
+// subscriber mode that follows the rooms with local subscribers. Both
+// reconnect with exponential backoff, and the subscriber re-subscribes
+// every local room after a reconnect. Messages published while Redis is
+// unreachable are lost for remote nodes; local subscribers always get them.
+//
+// Subscribe and unsubscribe never touch the network: they only signal the
+// subscribe loop, which brings the connection's channels in line with the
+// rooms that have local subscribers.
+type Redis struct {
+	nodeId   string
+	addr     string
+	password string
+	bus      *localBus
+	queue    chan Envelope
+	resync   chan struct{} // the set of local rooms changed
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	mu  sync.Mutex // guards sub
+	sub *redisConn // nil while the subscriber is disconnected
+
+	pubConnected atomic.Bool
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// NewRedis starts the publisher and subscriber connections to addr. It
+// does not wait for Redis to be reachable.
+func NewRedis(nodeId, addr, password string) *Redis {
+	b := &Redis{
+		nodeId:   nodeId,
+		addr:     addr,
+		password: password,
+		bus:      newLocalBus(),
+		queue:    make(chan Envelope, redisQueueSize),
+		resync:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	b.wg.Add(2)
+	go b.publishLoop()
+	go b.subscribeLoop()
+
+	slog.Info("redis backplane started", "nodeId", nodeId, "addr", addr)
+	return b
+}
+
+// Connected reports whether both Redis connections are up
+func (b *Redis) Connected() bool {
+	b.mu.Lock()
+	subscribed := b.sub != nil
+	b.mu.Unlock()
+	return subscribed && b.pubConnected.Load()
+}
+
+func (b *Redis) Publish(env Envelope) error {
+	b.bus.deliver(env)
+
+	select {
+	case b.queue <- env:
+	default:
+		redisDropped.Inc()
+	}
+	return nil
+}
+
+func (b *Redis) Subscribe(roomId string, h Handler) (func(), error) {
+	unsubscribe := b.bus.subscribe(roomId, h)
+	b.requestResync()
+
+	return func() {
+		unsubscribe()
+		b.requestResync()
+	}, nil
+}
+
+// requestResync wakes the subscribe loop without blocking; one pending
+// signal covers any number of changes
+func (b *Redis) requestResync() {
+	select {
+	case b.resync <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Redis) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+
+		b.mu.Lock()
+		if b.sub != nil {
+			b.sub.conn.Close()
+		}
+		b.mu.Unlock()
+	})
+	b.wg.Wait()
+	return nil
+}
+
+// subscribeLoop keeps the subscriber connection up, subscribed to the
+// rooms with local subscribers, and delivers the envelopes other nodes
+// publish
+func (b *Redis) subscribeLoop() {
+	defer b.wg.Done()
+
+	b.reconnectLoop("subscriber", func(rc *redisConn) error {
+		b.mu.Lock()
+		select {
+		case <-b.done:
+			// Closed while dialling; Close did not see this connection
+			b.mu.Unlock()
+			return nil
+		default:
+		}
+		b.sub = rc
+		b.mu.Unlock()
+
+		defer func() {
+			b.mu.Lock()
+			b.sub = nil
+			b.mu.Unlock()
+		}()
+
+		// Pushes are read concurrently so that (un)subscribing is never
+		// held up by an idle connection
+		lost := make(chan error, 1)
+		go func() {
+			for {
+				reply, err := readReply(rc.r)
+				if err != nil {
+					lost <- err
+					return
+				}
+				b.handlePush(reply)
+			}
+		}()
+
+		// A new connection starts with no channels
+		subscribed := make(map[string]bool)
+		if err := b.syncChannels(rc, subscribed); err != nil {
+			return err
+		}
+		for {
+			select {
+			case <-b.resync:
+				if err := b.syncChannels(rc, subscribed); err != nil {
+					return err
+				}
+			case err := <-lost:
+				return err
+			case <-b.done:
+				return nil
+			}
+		}
+	})
+}
+
+// syncChannels subscribes rc to the rooms that gained local subscribers
+// and unsubscribes it from those that lost them; subscribed tracks the
+// connection's channels by room
+func (b *Redis) syncChannels(rc *redisConn, subscribed map[string]bool) error {
+	want := make(map[string]bool)
+	for _, roomId := range b.bus.rooms() {
+		want[roomId] = true
+	}
+
+	rc.conn.SetWriteDeadline(time.Now().Add(redisWriteDeadline))
+	for roomId := range want {
+		if subscribed[roomId] {
+			continue
+		}
+		if err := writeCommand(rc.w, "SUBSCRIBE", RedisChannelPrefix+roomId); err != nil {
+			return err
+		}
+		subscribed[roomId] = true
+	}
+	for roomId := range subscribed {
+		if want[roomId] {
+			continue
+		}
+		if err := writeCommand(rc.w, "UNSUBSCRIBE", RedisChannelPrefix+roomId); err != nil {
+			return err
+		}
+		delete(subscribed, roomId)
+	}
+	return rc.w.Flush()
+}
+
+// handlePush handles one reply in subscriber mode; only "message" pushes
+// carry envelopes, the rest confirm (un)subscriptions
+func (b *Redis) handlePush(reply interface{}) {
+	push, ok := reply.([]interface{})
+	if !ok || len(push) != 3 || replyString(push[0]) != "message" {
+		if err, isErr := reply.(redisError); isErr {
+			slog.Warn("redis subscriber error reply", "err", err)
+		}
+		return
+	}
+
+	payload, _ := push[2].([]byte)
+	var env Envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		slog.Warn("redis message is not an envelope", "channel", replyString(push[1]), "err", err)
+		return
+	}
+	// Our own publishes were delivered locally by Publish
+	if env.Origin == b.nodeId {
+		return
+	}
+	if err := validateEnvelope(&env); err != nil {
+		backplaneRejected.Inc()
+		slog.Warn("redis envelope rejected", "origin", env.Origin, "roomId", env.RoomId, "err", err)
+		return
+	}
+	redisReceived.Inc()
+	b.bus.deliver(env)
+}
+
+// publishLoop keeps the publisher connection up and pipelines the queue
+func (b *Redis) publishLoop() {
+	defer b.wg.Done()
+
+	b.reconnectLoop("publisher", func(rc *redisConn) error {
+		b.pubConnected.Store(true)
+		defer b.pubConnected.Store(false)
+
+		// Replies are drained concurrently so a connection Redis closes is
+		// noticed while idle rather than on the next publish
+		lost := make(chan error, 1)
+		go func() {
+			for {
+				reply, err := readReply(rc.r)
+				if err != nil {
+					lost <- err
+					return
+				}
+				if err, ok := reply.(redisError); ok {
+					slog.Warn("redis publish failed", "err", err)
+				}
+			}
+		}()
+
+		for {
+			var env Envelope
+			select {
+			case env = <-b.queue:
+			case err := <-lost:
+				return err
+			case <-b.done:
+				return nil
+			}
+
+			batch := []Envelope{env}
+			for pending := len(b.queue); pending > 0; pending-- {
+				batch = append(batch, <-b.queue)
+			}
+			if err := b.publishBatch(rc, batch); err != nil {
+				redisDropped.Add(uint64(len(batch)))
+				return err
+			}
+			redisPublished.Add(uint64(len(batch)))
+		}
+	})
+}
+
+func (b *Redis) publishBatch(rc *redisConn, batch []Envelope) error {
+	rc.conn.SetWriteDeadline(time.Now().Add(redisWriteDeadline))
+	for _, env := range batch {
+		payload, err := json.Marshal(env)
+		if err != nil {
+			return err
+		}
+		if err := writeCommand(rc.w, "PUBLISH", RedisChannelPrefix+env.RoomId, string(payload)); err != nil {
+			return err
+		}
+	}
+	return rc.w.Flush()
+}
+
+// reconnectLoop dials Redis and runs serve on each connection until the
+// backplane is closed, backing off exponentially between failed attempts.
+// serve returns nil only on shutdown.
+func (b *Redis) reconnectLoop(role string, serve func(*redisConn) error) {
+	log := slog.With("redis", b.addr, "role", role)
+	backoff := 100 * time.Millisecond
+
+	for {
+		rc, err := b.dial()
+		if err != nil {
+			log.Debug("redis dial failed", "err", err, "retryIn", backoff)
+			if !b.sleep(backoff) {
+				return
+			}
+			backoff = min(backoff*2, redisMaxBackoff)
+			continue
+		}
+
+		log.Info("redis connected")
+		backoff = 100 * time.Millisecond
+		err = serve(rc)
+		rc.conn.Close()
+
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		if err == nil {
+			return
+		}
+		log.Warn("redis connection lost", "err", err)
+	}
+}
+
+func (b *Redis) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if b.password != "" {
+		conn.SetDeadline(time.Now().Add(redisWriteDeadline))
+		err := writeCommand(rc.w, "AUTH", b.password)
+		if err == nil {
+			err = rc.w.Flush()
+		}
+		var reply interface{}
+		if err == nil {
+			reply, err = readReply(rc.r)
+		}
+		if err == nil {
+			if replyErr, ok := reply.(redisError); ok {
+				err = replyErr
+			} else if replyString(reply) != "OK" {
+				err = errors.New("redis: unexpected AUTH reply")
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return rc, nil
+}
+
+// sleep waits for d unless the backplane is closed first
+func (b *Redis) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-b.done:
+		return false
+	}
+}
@@ -0,0 +1,288 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for the pub/sub subset of Redis the
+// backplane uses: AUTH, PUBLISH, SUBSCRIBE and UNSUBSCRIBE
+type fakeRedis struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	clients  map[*fakeRedisClient]bool
+	commands []string // "SUBSCRIBE chat:room:7", in arrival order
+}
+
+type fakeRedisClient struct {
+	conn     net.Conn
+	mu       sync.Mutex
+	w        *bufio.Writer
+	channels map[string]bool // guarded by fakeRedis.mu
+}
+
+func (c *fakeRedisClient) send(reply string) {
+	c.mu.Lock()
+	c.w.WriteString(reply)
+	c.w.Flush()
+	c.mu.Unlock()
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{listener: listener, clients: make(map[*fakeRedisClient]bool)}
+	t.Cleanup(func() {
+		listener.Close()
+		s.dropClients()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeRedisClient{conn: conn, w: bufio.NewWriter(conn), channels: make(map[string]bool)}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *fakeRedis) handle(c *fakeRedisClient) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = replyString(item)
+		}
+		if len(args) == 0 {
+			c.send("-ERR empty command\r\n")
+			continue
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		s.mu.Unlock()
+
+		switch args[0] {
+		case "AUTH":
+			c.send("+OK\r\n")
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			for _, channel := range args[1:] {
+				s.mu.Lock()
+				c.channels[channel] = args[0] == "SUBSCRIBE"
+				s.mu.Unlock()
+				c.send("*3\r\n" + bulk(strings.ToLower(args[0])) + bulk(channel) + ":1\r\n")
+			}
+		case "PUBLISH":
+			n := s.publish(args[1], args[2])
+			c.send(":" + strconv.Itoa(n) + "\r\n")
+		default:
+			c.send("-ERR unknown command\r\n")
+		}
+	}
+}
+
+// publish pushes payload to the clients subscribed to channel
+func (s *fakeRedis) publish(channel, payload string) int {
+	s.mu.Lock()
+	var targets []*fakeRedisClient
+	for c := range s.clients {
+		if c.channels[channel] {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range targets {
+		c.send("*3\r\n" + bulk("message") + bulk(channel) + bulk(payload))
+	}
+	return len(targets)
+}
+
+// dropClients closes every connection, as a Redis restart would
+func (s *fakeRedis) dropClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// waitForCommand waits until the server has received command
+func (s *fakeRedis) waitForCommand(t *testing.T, command string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		for _, c := range s.commands {
+			if c == command {
+				s.mu.Unlock()
+				return
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server never received %q", command)
+}
+
+func newTestRedis(t *testing.T, nodeId, addr string) *Redis {
+	t.Helper()
+	b := NewRedis(nodeId, addr, "")
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func waitConnected(t *testing.T, b *Redis) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("backplane never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBroadcastsBetweenNodes(t *testing.T) {
+	server := newFakeRedis(t)
+	a := newTestRedis(t, "a", server.addr())
+	b := newTestRedis(t, "b", server.addr())
+
+	fromA := subscribeChan(t, b, "7")
+	got := publishUntil(t, a, testEnvelope("a", "7", "hello b"), fromA)
+	if got.Origin != "a" || got.Message.Message.Message != "hello b" {
+		t.Fatalf("b got %+v", got)
+	}
+}
+
+func TestRedisUnsubscribesLastSubscriber(t *testing.T) {
+	server := newFakeRedis(t)
+	b := newTestRedis(t, "b", server.addr())
+
+	unsubscribeFirst, _ := b.Subscribe("7", func(Envelope) {})
+	unsubscribeSecond, _ := b.Subscribe("7", func(Envelope) {})
+	server.waitForCommand(t, "SUBSCRIBE "+RedisChannelPrefix+"7")
+
+	unsubscribeFirst()
+	time.Sleep(100 * time.Millisecond)
+	server.mu.Lock()
+	for _, c := range server.commands {
+		if strings.HasPrefix(c, "UNSUBSCRIBE") {
+			t.Errorf("unsubscribed with a subscriber left: %q", c)
+		}
+	}
+	server.mu.Unlock()
+
+	unsubscribeSecond()
+	server.waitForCommand(t, "UNSUBSCRIBE "+RedisChannelPrefix+"7")
+}
+
+func TestRedisResubscribesAfterReconnect(t *testing.T) {
+	server := newFakeRedis(t)
+	a := newTestRedis(t, "a", server.addr())
+	b := newTestRedis(t, "b", server.addr())
+
+	fromA := subscribeChan(t, b, "7")
+	publishUntil(t, a, testEnvelope("a", "7", "before"), fromA)
+
+	server.dropClients()
+	got := publishUntil(t, a, testEnvelope("a", "7", "after"), fromA)
+	if got.Message.Message.Message != "after" {
+		t.Fatalf("b got %+v", got)
+	}
+}
+
+func TestRedisRejectsInvalidEnvelopes(t *testing.T) {
+	server := newFakeRedis(t)
+	b := newTestRedis(t, "b", server.addr())
+	received := subscribeChan(t, b, "7")
+	server.waitForCommand(t, "SUBSCRIBE "+RedisChannelPrefix+"7")
+
+	invalid := testEnvelope("a", "7", "hi")
+	invalid.Message.UserId = "0"
+	for _, payload := range []interface{}{invalid, "not an envelope"} {
+		data, _ := json.Marshal(payload)
+		server.publish(RedisChannelPrefix+"7", string(data))
+	}
+	data, _ := json.Marshal(testEnvelope("a", "7", "valid"))
+	server.publish(RedisChannelPrefix+"7", string(data))
+
+	select {
+	case got := <-received:
+		if got.Message.Message.Message != "valid" {
+			t.Fatalf("invalid envelope delivered: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("valid envelope never arrived")
+	}
+}
+
+// A Redis that stops reading must not stall Subscribe, which rooms call
+// while the room manager is locked
+func TestRedisSubscribeDoesNotBlockOnStalledServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // accept, never read
+		}
+	}()
+
+	b := newTestRedis(t, "b", listener.Addr().String())
+	waitConnected(t, b)
+
+	// Enough channel names to fill the socket buffers many times over
+	name := strings.Repeat("x", 64<<10)
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		b.Subscribe(name+strconv.Itoa(i), func(Envelope) {})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Subscribe blocked for %v", elapsed)
+	}
+}
@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points each member gets on the ring
+const DefaultVirtualNodes = 128
+
+// Member is a node that can own rooms
+type Member struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"` // host:port, or ws(s)://host:port, that clients connect to
+}
+
+// URL returns the websocket URL for path on this member
+func (m Member) URL(path string) string {
+	if strings.HasPrefix(m.Addr, "ws://") || strings.HasPrefix(m.Addr, "wss://") {
+		return strings.TrimSuffix(m.Addr, "/") + path
+	}
+	return "ws://" + m.Addr + path
+}
+
+// HTTPURL returns the plain HTTP URL for path on this member, for
+// endpoints other than the websocket one
+func (m Member) HTTPURL(path string) string {
+	u := m.URL(path)
+	if strings.HasPrefix(u, "wss://") {
+		return "https://" + strings.TrimPrefix(u, "wss://")
+	}
+	return "http://" + strings.TrimPrefix(u, "ws://")
+}
+
+// ParseMembers parses a comma-separated list of id=addr pairs
+func ParseMembers(s string) ([]Member, error) {
+	var members []Member
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("member %q is not id=addr", item)
+		}
+		members = append(members, Member{ID: strings.TrimSpace(id), Addr: strings.TrimSpace(addr)})
+	}
+	return members, nil
+}
+
+type ringPoint struct {
+	hash   uint64
+	member int // index into Ring.members
+}
+
+// Ring assigns keys to members by consistent hashing, so changing the
+// membership only moves the keys of the members that joined or left
+type Ring struct {
+	mu      sync.RWMutex
+	vnodes  int
+	members []Member
+	points  []ringPoint // sorted by hash
+	version uint64
+}
+
+// NewRing returns an empty ring giving every member vnodes points
+func NewRing(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{vnodes: vnodes}
+}
+
+// Set replaces the membership. IDs must be unique and non-empty; the order
+// of members does not matter.
+func (r *Ring) Set(members []Member) error {
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		if m.ID == "" || m.Addr == "" {
+			return errors.New("members need an id and an addr")
+		}
+		if seen[m.ID] {
+			return fmt.Errorf("duplicate member %q", m.ID)
+		}
+		seen[m.ID] = true
+	}
+
+	members = append([]Member(nil), members...)
+	points := make([]ringPoint, 0, len(members)*r.vnodes)
+	for i, m := range members {
+		for v := 0; v < r.vnodes; v++ {
+			points = append(points, ringPoint{hash: hashKey(m.ID + "#" + strconv.Itoa(v)), member: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r.mu.Lock()
+	r.members = members
+	r.points = points
+	r.version++
+	r.mu.Unlock()
+	return nil
+}
+
+// Owner returns the member owning key; ok is false while the ring is empty
+func (r *Ring) Owner(key string) (owner Member, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return Member{}, false
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i].member], true
+}
+
+// Members returns the current membership
+func (r *Ring) Members() []Member {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Member(nil), r.members...)
+}
+
+// Version counts membership changes
+func (r *Ring) Version() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.version
+}
+
+// hashKey is FNV-1a followed by a 64-bit finalizer; FNV alone clusters
+// keys that differ only in their last characters, such as room numbers
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingOwnership(t *testing.T) {
+	members := []Member{{ID: "a", Addr: "a:8080"}, {ID: "b", Addr: "b:8080"}, {ID: "c", Addr: "c:8080"}}
+	ring := NewRing(0)
+	if _, ok := ring.Owner("7"); ok {
+		t.Fatal("empty ring has an owner")
+	}
+	if err := ring.Set(members); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every node computes the same owner, whatever order it lists members in
+	reversed := NewRing(0)
+	reversed.Set([]Member{members[2], members[1], members[0]})
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		room := strconv.Itoa(i)
+		owner, _ := ring.Owner(room)
+		other, _ := reversed.Owner(room)
+		if owner != other {
+			t.Fatalf("room %s owned by %s and %s", room, owner.ID, other.ID)
+		}
+		counts[owner.ID]++
+	}
+	for _, m := range members {
+		if counts[m.ID] < 500 {
+			t.Errorf("member %s owns only %d of 3000 rooms", m.ID, counts[m.ID])
+		}
+	}
+}
+
+func TestRingMovesOnlyRemovedMembersRooms(t *testing.T) {
+	ring := NewRing(0)
+	ring.Set([]Member{{ID: "a", Addr: "a:8080"}, {ID: "b", Addr: "b:8080"}, {ID: "c", Addr: "c:8080"}})
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		owner, _ := ring.Owner(strconv.Itoa(i))
+		before[strconv.Itoa(i)] = owner.ID
+	}
+
+	ring.Set([]Member{{ID: "a", Addr: "a:8080"}, {ID: "b", Addr: "b:8080"}})
+	for room, was := range before {
+		owner, _ := ring.Owner(room)
+		if was != "c" && owner.ID != was {
+			t.Fatalf("room %s moved from %s to %s", room, was, owner.ID)
+		}
+		if owner.ID == "c" {
+			t.Fatalf("room %s still owned by removed member", room)
+		}
+	}
+}
+
+func TestRingRejectsBadMembers(t *testing.T) {
+	ring := NewRing(0)
+	if err := ring.Set([]Member{{ID: "a", Addr: "a:1"}, {ID: "a", Addr: "a:2"}}); err == nil {
+		t.Error("duplicate IDs accepted")
+	}
+	if err := ring.Set([]Member{{ID: "", Addr: "a:1"}}); err == nil {
+		t.Error("empty ID accepted")
+	}
+}
+
+func TestMemberURLs(t *testing.T) {
+	tests := []struct {
+		addr, ws, http string
+	}{
+		{"b:8081", "ws://b:8081/chat/7", "http://b:8081/chat/7"},
+		{"wss://chat.example.com/", "wss://chat.example.com/chat/7", "https://chat.example.com/chat/7"},
+	}
+	for _, tt := range tests {
+		m := Member{ID: "b", Addr: tt.addr}
+		if got := m.URL("/chat/7"); got != tt.ws {
+			t.Errorf("URL(%q) = %q, want %q", tt.addr, got, tt.ws)
+		}
+		if got := m.HTTPURL("/chat/7"); got != tt.http {
+			t.Errorf("HTTPURL(%q) = %q, want %q", tt.addr, got, tt.http)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package command
+
+import (
+	"chatroom/server/model"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	Default.MustRegister(helpCommand{registry: Default})
+	Default.MustRegister(whoCommand{})
+	Default.MustRegister(nickCommand{})
+	Default.MustRegister(meCommand{})
+	Default.MustRegister(topicCommand{})
+	Default.MustRegister(roomsCommand{})
+}
+
+// helpCommand lists the commands of its registry
+type helpCommand struct {
+	registry *Registry
+}
+
+func (helpCommand) Name() string           { return "help" }
+func (helpCommand) Usage() string          { return "/help" }
+func (helpCommand) Help() string           { return "list the available commands" }
+func (helpCommand) Permission() Permission { return Everyone }
+
+func (c helpCommand) Run(ctx *Context, args string) (string, error) {
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, cmd := range c.registry.Commands() {
+		if cmd.Permission() == Moderator && !ctx.Moderator {
+			continue
+		}
+		fmt.Fprintf(&b, "\n  %-16s %s", cmd.Usage(), cmd.Help())
+	}
+	return b.String(), nil
+}
+
+// whoCommand lists the room's members on this node
+type whoCommand struct{}
+
+func (whoCommand) Name() string           { return "who" }
+func (whoCommand) Usage() string          { return "/who" }
+func (whoCommand) Help() string           { return "list who is in the room" }
+func (whoCommand) Permission() Permission { return Everyone }
+
+func (whoCommand) Run(ctx *Context, args string) (string, error) {
+	members := ctx.Room.Members()
+	if len(members) == 0 {
+		return "Nobody is here.", nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d in %s:", len(members), ctx.Room.ID)
+	for _, m := range members {
+		name := m.Username
+		if name == "" {
+			name = "(anonymous)"
+		}
+		fmt.Fprintf(&b, "\n  %s", name)
+		if m.UserId != "" {
+			fmt.Fprintf(&b, " [%s]", m.UserId)
+		}
+		if m.Transport != "websocket" {
+			fmt.Fprintf(&b, " via %s", m.Transport)
+		}
+	}
+	return b.String(), nil
+}
+
+var nickRegex = regexp.MustCompile(`^[a-zA-Z0-9]{3,20}$`)
+
+// nickCommand sets the name the caller's messages are shown under
+type nickCommand struct{}
+
+func (nickCommand) Name() string           { return "nick" }
+func (nickCommand) Usage() string          { return "/nick <name>" }
+func (nickCommand) Help() string           { return "change the name your messages are shown under" }
+func (nickCommand) Permission() Permission { return Everyone }
+
+func (c nickCommand) Run(ctx *Context, args string) (string, error) {
+	if !nickRegex.MatchString(args) {
+		return "", UsageError{Usage: c.Usage() + " (3-20 alphanumeric characters)"}
+	}
+	old := ctx.Caller.Username()
+	if old == args {
+		return "You are already " + args + ".", nil
+	}
+
+	ctx.Caller.SetNick(args)
+	if err := ctx.Announce(model.MessageTypeSystem, old+" is now known as "+args); err != nil {
+		return "", err
+	}
+	return "You are now " + args + ".", nil
+}
+
+// meCommand broadcasts an action, shown as "* name text"
+type meCommand struct{}
+
+func (meCommand) Name() string           { return "me" }
+func (meCommand) Usage() string          { return "/me <action>" }
+func (meCommand) Help() string           { return "describe what you are doing" }
+func (meCommand) Permission() Permission { return Everyone }
+
+func (c meCommand) Run(ctx *Context, args string) (string, error) {
+	if args == "" {
+		return "", UsageError{Usage: c.Usage()}
+	}
+	return "", ctx.Announce(model.MessageTypeAction, args)
+}
+
+// topicCommand shows the room's topic; moderators may change it
+type topicCommand struct{}
+
+func (topicCommand) Name() string  { return "topic" }
+func (topicCommand) Usage() string { return "/topic [text]" }
+func (topicCommand) Help() string  { return "show the room topic; moderators can set it" }
+
+// Permission is Everyone so anyone can read the topic; setting it is
+// checked in Run
+func (topicCommand) Permission() Permission { return Everyone }
+
+func (topicCommand) Run(ctx *Context, args string) (string, error) {
+	if args == "" {
+		if topic := ctx.Room.Topic(); topic != "" {
+			return "Topic: " + topic, nil
+		}
+		return "No topic is set.", nil
+	}
+	if !ctx.Moderator {
+		return "", ErrPermissionDenied
+	}
+
+	ctx.Room.SetTopic(args)
+	if err := ctx.Announce(model.MessageTypeSystem, ctx.Caller.Username()+" set the topic: "+args); err != nil {
+		return "", err
+	}
+	return "Topic set.", nil
+}
+
+// roomsCommand lists the rooms on this node
+type roomsCommand struct{}
+
+func (roomsCommand) Name() string           { return "rooms" }
+func (roomsCommand) Usage() string          { return "/rooms" }
+func (roomsCommand) Help() string           { return "list the rooms on this server" }
+func (roomsCommand) Permission() Permission { return Everyone }
+
+func (roomsCommand) Run(ctx *Context, args string) (string, error) {
+	rooms := ctx.Manager.RoomList()
+	if len(rooms) == 0 {
+		return "No rooms.", nil
+	}
+
+	var b strings.Builder
+	b.WriteString("Rooms:")
+	for _, r := range rooms {
+		fmt.Fprintf(&b, "\n  %-20s %d", r.ID, len(r.Members()))
+		if topic := r.Topic(); topic != "" {
+			fmt.Fprintf(&b, "  %s", topic)
+		}
+	}
+	return b.String(), nil
+}
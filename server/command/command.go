@@ -0,0 +1,159 @@
+// Package command runs the slash commands users type in TEXT messages.
+// Commands implement Command and are added to a Registry; Default holds
+// the built-ins and is what the server dispatches to.
+package command
+
+import (
+	"chatroom/server/metrics"
+	"chatroom/server/room"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Permission is the role a caller needs to run a command
+type Permission int
+
+const (
+	Everyone Permission = iota
+	Moderator
+)
+
+func (p Permission) String() string {
+	if p == Moderator {
+		return "moderator"
+	}
+	return "everyone"
+}
+
+var (
+	ErrUnknownCommand   = errors.New("unknown command, try /help")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// UsageError reports arguments a command cannot use
+type UsageError struct {
+	Usage string
+}
+
+func (e UsageError) Error() string {
+	return "usage: " + e.Usage
+}
+
+// Caller is the connection that sent a command
+type Caller interface {
+	ConnID() string
+	UserId() string
+	Username() string
+	SetNick(nick string)
+}
+
+// Context is what a command can see and do
+type Context struct {
+	Manager   *room.Manager
+	Room      *room.Room
+	Caller    Caller
+	Moderator bool // the caller's connection was opened with a moderator token
+
+	// Announce broadcasts a server-generated message of messageType to
+	// the room, as the caller
+	Announce func(messageType, text string) error
+}
+
+// Command is one slash command. Run returns the reply shown only to the
+// caller; commands that talk to the room do so through Context.Announce.
+type Command interface {
+	Name() string  // without the slash, lower case
+	Usage() string // e.g. "/nick <name>"
+	Help() string  // one line for /help
+	Permission() Permission
+	Run(ctx *Context, args string) (reply string, err error)
+}
+
+// Registry maps command names to commands
+type Registry struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+}
+
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]Command)}
+}
+
+// Default is the registry the server dispatches to
+var Default = NewRegistry()
+
+// Register adds c; names must be unique
+func (r *Registry) Register(c Command) error {
+	name := strings.ToLower(c.Name())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.commands[name]; exists {
+		return fmt.Errorf("command /%s already registered", name)
+	}
+	r.commands[name] = c
+	return nil
+}
+
+// MustRegister is Register for package initialisation
+func (r *Registry) MustRegister(c Command) {
+	if err := r.Register(c); err != nil {
+		panic(err)
+	}
+}
+
+func (r *Registry) Lookup(name string) (Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.commands[strings.ToLower(name)]
+	return c, ok
+}
+
+// Commands returns every command sorted by name
+func (r *Registry) Commands() []Command {
+	r.mu.RLock()
+	commands := make([]Command, 0, len(r.commands))
+	for _, c := range r.commands {
+		commands = append(commands, c)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name() < commands[j].Name() })
+	return commands
+}
+
+// IsCommand reports whether a TEXT message is a command rather than chat
+func IsCommand(text string) bool {
+	return len(text) > 1 && text[0] == '/'
+}
+
+// Dispatch parses "/name args" and runs the command if the caller may
+func (r *Registry) Dispatch(ctx *Context, text string) (string, error) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(text, "/"), " ")
+	args = strings.TrimSpace(args)
+
+	c, ok := r.Lookup(name)
+	if !ok {
+		metrics.Commands.Inc("unknown", "unknown")
+		return "", ErrUnknownCommand
+	}
+	if c.Permission() == Moderator && !ctx.Moderator {
+		metrics.Commands.Inc(c.Name(), "denied")
+		return "", ErrPermissionDenied
+	}
+
+	reply, err := c.Run(ctx, args)
+	if errors.Is(err, ErrPermissionDenied) {
+		metrics.Commands.Inc(c.Name(), "denied")
+		return "", err
+	}
+	if err != nil {
+		metrics.Commands.Inc(c.Name(), "error")
+		return "", err
+	}
+	metrics.Commands.Inc(c.Name(), "ok")
+	return reply, nil
+}
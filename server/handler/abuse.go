@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"time"
+)
+
+// AbuseOptions bounds what one websocket connection may send
+type AbuseOptions struct {
+	MaxFrameBytes int64         // read limit per frame; 0 is unlimited
+	MaxStrikes    int           // invalid frames before a disconnect; 0 disables
+	StrikeWindow  time.Duration // strikes older than this are forgotten
+}
+
+var abuse AbuseOptions
+
+// SetAbuseLimits sets the frame size limit and strike rules of new connections
+func SetAbuseLimits(opts AbuseOptions) {
+	abuse = opts
+}
+
+// strikeCodes are the errors of frames a well-behaved client never sends
+var strikeCodes = map[string]bool{
+	model.ErrorInvalidJSON:   true,
+	model.ErrorInvalidFormat: true,
+	model.ErrorBatchSize:     true,
+	model.ErrorUserIdRange:   true,
+	model.ErrorUsername:      true,
+	model.ErrorMessageLength: true,
+	model.ErrorTimestamp:     true,
+	model.ErrorMessageType:   true,
+}
+
+// isStrike reports whether the response to a frame rejects any of it as
+// malformed or invalid. A batch counts once however many messages fail.
+func isStrike(response interface{}) bool {
+	switch r := response.(type) {
+	case model.ServerResponse:
+		return strikeCodes[r.Code]
+	case []model.ServerResponse:
+		for _, item := range r {
+			if strikeCodes[item.Code] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// strikes counts one connection's invalid frames within abuse.StrikeWindow
+type strikes struct {
+	times []time.Time
+}
+
+// add records a strike and reports whether the connection is out
+func (s *strikes) add(now time.Time) bool {
+	if abuse.MaxStrikes <= 0 {
+		return false
+	}
+	if abuse.StrikeWindow > 0 {
+		cutoff := now.Add(-abuse.StrikeWindow)
+		i := 0
+		for i < len(s.times) && !s.times[i].After(cutoff) {
+			i++
+		}
+		s.times = s.times[i:]
+	}
+	s.times = append(s.times, now)
+	return len(s.times) >= abuse.MaxStrikes
+}
+
+// offence counts a disconnect for abuse against the client's IP, which
+// may get it banned
+func offence(admit *admission.Controller, client *room.Client, ip, reason string) {
+	metrics.AbuseDisconnects.Inc(reason)
+	if admit.Offence(ip) {
+		metrics.IPBans.Inc()
+		client.Log().Warn("address banned", "ip", ip, "reason", reason)
+	}
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func setAbuseLimits(t *testing.T, opts AbuseOptions) {
+	SetAbuseLimits(opts)
+	t.Cleanup(func() { SetAbuseLimits(AbuseOptions{}) })
+}
+
+// expectClose reads from conn until the server closes it with code
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Fatalf("read: %v, want close %d", err, code)
+		}
+		return
+	}
+}
+
+func TestStrikesDisconnect(t *testing.T) {
+	setAbuseLimits(t, AbuseOptions{MaxStrikes: 3, StrikeWindow: time.Minute})
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	conn := s.dial(t, "/chat/7")
+
+	send(t, conn, textMessage("1", "alice", strings.Repeat("x", 501)))
+	readResponse(t, conn)
+	conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+	readResponse(t, conn)
+	// Valid messages in between do not clear the strikes
+	send(t, conn, textMessage("1", "alice", "still here"))
+	if resp := readResponse(t, conn); resp.Error != "" {
+		t.Fatalf("valid message rejected: %+v", resp)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+	expectClose(t, conn, websocket.ClosePolicyViolation)
+}
+
+func TestOversizedFrameDisconnects(t *testing.T) {
+	setAbuseLimits(t, AbuseOptions{MaxFrameBytes: 1024})
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	conn := s.dial(t, "/chat/7")
+
+	send(t, conn, textMessage("1", "alice", strings.Repeat("x", 2048)))
+	expectClose(t, conn, websocket.CloseMessageTooBig)
+}
+
+func TestRepeatedAbuseBansTheIP(t *testing.T) {
+	setAbuseLimits(t, AbuseOptions{MaxStrikes: 1})
+	admit := admission.NewController(admission.Limits{})
+	admit.SetBanPolicy(admission.BanPolicy{Offences: 2, Window: time.Minute, Duration: time.Minute})
+	s := newTestServer(t, admit)
+
+	for i := 0; i < 2; i++ {
+		conn := s.dial(t, "/chat/7")
+		conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+		expectClose(t, conn, websocket.ClosePolicyViolation)
+	}
+
+	var resp *http.Response
+	waitFor(t, "the ban", func() bool {
+		conn, r, err := websocket.DefaultDialer.Dial(s.url("/chat/7"), nil)
+		if err == nil {
+			conn.Close()
+			return false
+		}
+		resp = r
+		return true
+	})
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("banned upgrade: %+v", resp)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("no Retry-After on a banned upgrade")
+	}
+}
+
+func TestBansBehindTrustedProxy(t *testing.T) {
+	proxies, _ := ParseTrustedProxies("127.0.0.1")
+	SetTrustedProxies(proxies)
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+	setAbuseLimits(t, AbuseOptions{MaxStrikes: 1})
+	admit := admission.NewController(admission.Limits{})
+	admit.SetBanPolicy(admission.BanPolicy{Offences: 1, Window: time.Minute, Duration: time.Minute})
+	s := newTestServer(t, admit)
+
+	from := func(ip string) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(s.url("/chat/7"), http.Header{"X-Forwarded-For": {ip}})
+	}
+	conn, _, err := from("198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+	expectClose(t, conn, websocket.ClosePolicyViolation)
+	waitFor(t, "the ban", func() bool { return len(admit.Counts().Banned) == 1 })
+
+	if _, ok := admit.Counts().Banned["198.51.100.1"]; !ok {
+		t.Fatalf("banned %v, want the client", admit.Counts().Banned)
+	}
+	if _, resp, err := from("198.51.100.1"); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("banned client admitted: %v", err)
+	}
+	other, _, err := from("198.51.100.2")
+	if err != nil {
+		t.Fatalf("other client through the same proxy refused: %v", err)
+	}
+	other.Close()
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/auth"
+	"chatroom/server/cluster"
+	"chatroom/server/metrics"
+	"chatroom/server/room"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultDrainWaves    = 10
+	defaultDrainInterval = time.Second
+)
+
+// HandleDrain starts draining the node. Optional query parameters:
+// waves (number of client groups) and interval (pause between waves, e.g. 2s)
+func HandleDrain(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts := room.DrainOptions{
+			Waves:    defaultDrainWaves,
+			Interval: defaultDrainInterval,
+		}
+
+		if v := r.URL.Query().Get("waves"); v != "" {
+			waves, err := strconv.Atoi(v)
+			if err != nil || waves < 1 {
+				http.Error(w, "waves must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			opts.Waves = waves
+		}
+		if v := r.URL.Query().Get("interval"); v != "" {
+			interval, err := time.ParseDuration(v)
+			if err != nil || interval < 0 {
+				http.Error(w, "interval must be a duration such as 500ms or 2s", http.StatusBadRequest)
+				return
+			}
+			opts.Interval = interval
+		}
+
+		status, err := manager.StartDrain(opts)
+		if err == room.ErrAlreadyDraining {
+			writeJSON(w, http.StatusConflict, status)
+			return
+		}
+
+		slog.Info("drain started", "clients", status.TotalClients, "waves", opts.Waves, "interval", opts.Interval)
+		writeJSON(w, http.StatusAccepted, status)
+	}
+}
+
+// HandleDrainStatus reports the progress of the current drain
+func HandleDrainStatus(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, manager.DrainStatus())
+	}
+}
+
+// HandleConnections reports the admitted connection counts and limits
+func HandleConnections(admit *admission.Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, admit.Counts())
+	}
+}
+
+// HandleUnbanIP lifts the temporary ban on an IP
+func HandleUnbanIP(admit *admission.Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := mux.Vars(r)["ip"]
+		if !admit.Unban(ip) {
+			http.Error(w, "Address is not banned", http.StatusNotFound)
+			return
+		}
+		slog.Info("address unbanned", "ip", ip)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ClusterStatus describes room ownership on this node
+type ClusterStatus struct {
+	NodeId            string           `json:"nodeId"`
+	Ownership         bool             `json:"ownership"`
+	Version           uint64           `json:"version"`
+	Members           []cluster.Member `json:"members"`
+	ClientsRedirected int              `json:"clientsRedirected,omitempty"`
+}
+
+func clusterStatus(manager *room.Manager) ClusterStatus {
+	status := ClusterStatus{NodeId: manager.NodeID(), Members: []cluster.Member{}}
+	if ring := manager.Ring(); ring != nil {
+		status.Ownership = true
+		status.Version = ring.Version()
+		status.Members = ring.Members()
+	}
+	return status
+}
+
+// HandleCluster reports the ownership ring membership
+func HandleCluster(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, clusterStatus(manager))
+	}
+}
+
+// HandleSetMembers replaces the ring membership with the JSON array of
+// {"id","addr"} in the body. Clients of rooms that move to another node are
+// redirected there.
+func HandleSetMembers(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var members []cluster.Member
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+			http.Error(w, "body must be a JSON array of {\"id\", \"addr\"}", http.StatusBadRequest)
+			return
+		}
+
+		moved, err := manager.SetMembers(members)
+		if err == room.ErrOwnershipDisabled {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status := clusterStatus(manager)
+		status.ClientsRedirected = moved
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// RequireAdmin only lets through requests bearing the admin token. With
+// no token configured every request is refused.
+func RequireAdmin(token *auth.AdminToken) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !token.Enabled() {
+				http.Error(w, "Admin token not configured", http.StatusForbidden)
+				return
+			}
+			if !token.Check(r) {
+				metrics.AdminAuthFailures.Inc()
+				slog.Warn("admin request rejected", "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chat-admin"`)
+				http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
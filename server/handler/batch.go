@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"bytes"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"encoding/json"
+	"fmt"
+)
+
+// maxBatchSize caps the number of messages accepted in one batch frame
+var maxBatchSize = 100
+
+// SetMaxBatchSize sets the largest batch a client may send in one frame
+func SetMaxBatchSize(n int) {
+	maxBatchSize = n
+}
+
+// isBatch reports whether a JSON frame holds an array of messages
+func isBatch(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// handleBatch processes a JSON array of messages. Each message is decoded
+// and validated on its own, and the reply is an array of responses in the
+// same order. A frame that is not a valid batch gets a single error response.
+func handleBatch(chatRoom *room.Room, client *room.Client, data []byte) interface{} {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		code, errStr := invalidFormat(client.Codec)
+		response := errorResponse(nil, code, errStr)
+		metrics.MessagesRejected.Inc(response.Code)
+		client.Log().Info("batch rejected", "code", response.Code)
+		return response
+	}
+
+	if len(items) == 0 || len(items) > maxBatchSize {
+		response := errorResponse(nil, model.ErrorBatchSize, fmt.Sprintf("batch must contain 1-%d messages", maxBatchSize))
+		metrics.MessagesRejected.Inc(response.Code)
+		client.Log().Info("batch rejected", "code", response.Code, "size", len(items))
+		return response
+	}
+
+	responses := make([]model.ServerResponse, len(items))
+	for i, item := range items {
+		responses[i] = handleFrame(chatRoom, client, item)
+	}
+	return responses
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/model"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readBatch reads the next frame from conn as an array of responses
+func readBatch(t *testing.T, conn *websocket.Conn) []model.ServerResponse {
+	t.Helper()
+	var resp []model.ServerResponse
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestBatchAnswersEachMessageInOrder(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	sender := s.dial(t, "/chat/7")
+	peer := s.dial(t, "/chat/7")
+	send(t, peer, textMessage("2", "bob", "joined"))
+	readResponse(t, peer)
+	readResponse(t, sender) // the broadcast of peer's message
+
+	send(t, sender, []interface{}{
+		textMessage("1", "alice", "first"),
+		textMessage("1", "alice", strings.Repeat("x", 501)),
+		json.RawMessage(`{"userId": 7}`),
+		textMessage("1", "alice", "last"),
+	})
+	got := readBatch(t, sender)
+
+	want := []struct{ status, code, text string }{
+		{model.StatusOK, "", "first"},
+		{model.StatusError, model.ErrorMessageLength, ""},
+		{model.StatusError, model.ErrorInvalidJSON, ""},
+		{model.StatusOK, "", "last"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d responses, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Status != w.status || got[i].Code != w.code || (w.text != "" && got[i].Message.Message != w.text) {
+			t.Errorf("response %d = %+v, want %+v", i, got[i], w)
+		}
+	}
+
+	// Only the accepted messages reach the room, in order
+	for _, text := range []string{"first", "last"} {
+		if msg := readResponse(t, peer); msg.Message.Message != text || msg.Status != model.StatusBroadcast {
+			t.Fatalf("peer got %+v, want broadcast %q", msg, text)
+		}
+	}
+}
+
+func TestBatchRejectedAsAWhole(t *testing.T) {
+	SetMaxBatchSize(2)
+	t.Cleanup(func() { SetMaxBatchSize(100) })
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	conn := s.dial(t, "/chat/7")
+
+	msg := textMessage("1", "alice", "hi")
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{"empty", `[]`, model.ErrorBatchSize},
+		{"too large", mustJSON(t, []model.Message{msg, msg, msg}), model.ErrorBatchSize},
+		{"malformed", ` [{"userId": "1"},`, model.ErrorInvalidJSON},
+	}
+	for _, tt := range tests {
+		conn.WriteMessage(websocket.TextMessage, []byte(tt.frame))
+		if resp := readResponse(t, conn); resp.Status != model.StatusError || resp.Code != tt.code {
+			t.Errorf("%s: got %+v, want %s", tt.name, resp, tt.code)
+		}
+	}
+
+	send(t, conn, []model.Message{msg, msg})
+	if got := readBatch(t, conn); len(got) != 2 {
+		t.Fatalf("batch at the limit: %+v", got)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
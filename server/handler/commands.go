@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"chatroom/server/auth"
+	"chatroom/server/command"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// CommandOptions configures slash commands in TEXT messages
+type CommandOptions struct {
+	Registry   *command.Registry // nil sends "/..." messages to the room as text
+	Manager    *room.Manager
+	Moderators *auth.Moderators // tokens that open websocket connections as moderators
+}
+
+var commands CommandOptions
+
+// SetCommands runs TEXT messages starting with "/" as commands
+func SetCommands(opts CommandOptions) {
+	commands = opts
+}
+
+// isCommand reports whether msg should be run rather than published
+func isCommand(msg *model.Message) bool {
+	return commands.Registry != nil && msg.MessageType == model.MessageTypeText && command.IsCommand(msg.Message)
+}
+
+// commandErrorCode classifies the error of a failed command
+func commandErrorCode(err error) string {
+	var usage command.UsageError
+	switch {
+	case errors.Is(err, command.ErrUnknownCommand):
+		return model.ErrorUnknownCommand
+	case errors.Is(err, command.ErrPermissionDenied):
+		return model.ErrorPermissionDenied
+	case errors.As(err, &usage):
+		return model.ErrorCommandUsage
+	}
+	return model.ErrorCommandFailed
+}
+
+// authenticateModerator returns the name of the moderator whose bearer
+// token is on the upgrade request r for roomId, or "" without a token. A
+// token that is unknown or not valid in roomId is answered and ok is false.
+// Without configured moderators, and for schemes other than Bearer, the
+// Authorization header is left to whatever else uses it, such as a proxy.
+func authenticateModerator(w http.ResponseWriter, r *http.Request, roomId string) (name string, ok bool) {
+	token, _ := auth.BearerToken(r)
+	if token == "" || commands.Moderators == nil {
+		return "", true
+	}
+	mod, found := commands.Moderators.Authenticate(token)
+	if !found {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+		http.Error(w, "Invalid moderator token", http.StatusUnauthorized)
+		return "", false
+	}
+	if !mod.CanModerate(roomId) {
+		http.Error(w, "Not a moderator of this room", http.StatusForbidden)
+		return "", false
+	}
+	return mod.Name, true
+}
+
+// runCommand runs the command in msg for from. The response goes only to
+// the caller: OK with the command's reply, or ERROR.
+func runCommand(chatRoom *room.Room, from sender, msg *model.Message) model.ServerResponse {
+	ctx := &command.Context{
+		Manager:   commands.Manager,
+		Room:      chatRoom,
+		Caller:    from,
+		Moderator: from.Moderator() != "",
+		Announce: func(messageType, text string) error {
+			announcement := model.ServerResponse{
+				Message: model.Message{
+					UserId:      from.UserId(),
+					Username:    from.Username(),
+					Message:     text,
+					Timestamp:   time.Now(),
+					MessageType: messageType,
+				},
+				Status:          model.StatusOK,
+				ServerTimestamp: time.Now(),
+			}
+			// No connId: the caller sees the announcement like everyone else
+			return chatRoom.Publish("", announcement)
+		},
+	}
+
+	response := model.ServerResponse{
+		Message:         *msg,
+		Status:          model.StatusOK,
+		ServerTimestamp: time.Now(),
+	}
+	reply, err := commands.Registry.Dispatch(ctx, msg.Message)
+	if err != nil {
+		from.Log().Info("command failed", "command", msg.Message, "err", err)
+		response.Status = model.StatusError
+		response.Error = err.Error()
+		response.Code = commandErrorCode(err)
+		return response
+	}
+	response.Reply = reply
+	return response
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/auth"
+	"chatroom/server/command"
+	"chatroom/server/model"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// setModerators enables commands on s with moderators
+func setModerators(t *testing.T, s *testServer, moderators []auth.Moderator) {
+	t.Helper()
+	opts := CommandOptions{Registry: command.Default, Manager: s.manager}
+	if moderators != nil {
+		m, err := auth.NewModerators(moderators)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Moderators = m
+	}
+	SetCommands(opts)
+	t.Cleanup(func() { SetCommands(CommandOptions{}) })
+}
+
+func dialStatus(t *testing.T, s *testServer, path, authorization string) int {
+	t.Helper()
+	header := http.Header{}
+	if authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(s.url(path), header)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestModeratorAuthentication(t *testing.T) {
+	tests := []struct {
+		name          string
+		moderators    []auth.Moderator
+		path          string
+		authorization string
+		status        int
+	}{
+		{"no header", []auth.Moderator{{Name: "ops", Token: "m0d"}}, "/chat/7", "", http.StatusSwitchingProtocols},
+		{"moderator", []auth.Moderator{{Name: "ops", Token: "m0d"}}, "/chat/7", "Bearer m0d", http.StatusSwitchingProtocols},
+		{"unknown token", []auth.Moderator{{Name: "ops", Token: "m0d"}}, "/chat/7", "Bearer other", http.StatusUnauthorized},
+		{"other room", []auth.Moderator{{Name: "ops", Token: "m0d", Rooms: []string{"8"}}}, "/chat/7", "Bearer m0d", http.StatusForbidden},
+		{"other scheme", []auth.Moderator{{Name: "ops", Token: "m0d"}}, "/chat/7", "Basic b3BzOm0wZA==", http.StatusSwitchingProtocols},
+		{"no moderators configured", nil, "/chat/7", "Bearer proxy-token", http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, admission.NewController(admission.Limits{}))
+		setModerators(t, s, tt.moderators)
+		if status := dialStatus(t, s, tt.path, tt.authorization); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestModeratorCommandsNeedTheToken(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	setModerators(t, s, []auth.Moderator{{Name: "ops", Token: "m0d"}})
+
+	user := s.dial(t, "/chat/7")
+	send(t, user, textMessage("1", "alice", "/topic mine now"))
+	if resp := readResponse(t, user); resp.Code != model.ErrorPermissionDenied {
+		t.Fatalf("user set the topic: %+v", resp)
+	}
+
+	mod, _, err := websocket.DefaultDialer.Dial(s.url("/chat/7"), http.Header{"Authorization": {"Bearer m0d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	send(t, mod, textMessage("1", "alice", "/topic release day"))
+	if resp := readResponse(t, mod); resp.Status != model.StatusOK {
+		t.Fatalf("moderator could not set the topic: %+v", resp)
+	}
+	if topic := s.manager.GetRoom("7").Topic(); topic != "release day" {
+		t.Fatalf("topic %q", topic)
+	}
+}
@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"bufio"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"chatroom/server/store"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exportPageSize is how many messages are read from the store at a time,
+// which bounds an export's memory whatever the size of the room
+const exportPageSize = 500
+
+// ExportRecord is one exported message
+type ExportRecord struct {
+	Seq             uint64    `json:"seq"`
+	ServerTimestamp time.Time `json:"serverTimestamp"`
+	UserId          string    `json:"userId"`
+	Username        string    `json:"username"`
+	MessageType     string    `json:"messageType"`
+	Message         string    `json:"message"`
+	Bot             bool      `json:"bot,omitempty"`
+}
+
+func exportRecord(msg model.ServerResponse) ExportRecord {
+	return ExportRecord{
+		Seq:             msg.Seq,
+		ServerTimestamp: msg.ServerTimestamp,
+		UserId:          msg.UserId,
+		Username:        msg.Username,
+		MessageType:     msg.MessageType,
+		Message:         msg.Message.Message,
+		Bot:             msg.Bot,
+	}
+}
+
+// exportWriter writes records in one format
+type exportWriter interface {
+	Begin() error
+	Write(rec ExportRecord) error
+	End() error
+	Flush() error
+}
+
+// jsonExport writes a JSON array, one record per line
+type jsonExport struct {
+	w     *bufio.Writer
+	count int
+}
+
+func (e *jsonExport) Begin() error {
+	_, err := e.w.WriteString("[")
+	return err
+}
+
+func (e *jsonExport) Write(rec ExportRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		e.w.WriteString(",")
+	}
+	e.count++
+	e.w.WriteString("\n")
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExport) End() error {
+	_, err := e.w.WriteString("\n]\n")
+	return err
+}
+
+func (e *jsonExport) Flush() error {
+	return e.w.Flush()
+}
+
+// csvExport writes a header row and one row per record
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) Begin() error {
+	return e.w.Write([]string{"seq", "serverTimestamp", "userId", "username", "messageType", "message", "bot"})
+}
+
+func (e *csvExport) Write(rec ExportRecord) error {
+	return e.w.Write([]string{
+		strconv.FormatUint(rec.Seq, 10),
+		rec.ServerTimestamp.Format(time.RFC3339Nano),
+		rec.UserId,
+		rec.Username,
+		rec.MessageType,
+		rec.Message,
+		strconv.FormatBool(rec.Bot),
+	})
+}
+
+func (e *csvExport) End() error {
+	return nil
+}
+
+func (e *csvExport) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// textExport writes a transcript for people to read
+type textExport struct {
+	w      *bufio.Writer
+	roomId string
+}
+
+func (e *textExport) Begin() error {
+	_, err := fmt.Fprintf(e.w, "# Transcript of room %s, exported %s\n", e.roomId, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (e *textExport) Write(rec ExportRecord) error {
+	ts := rec.ServerTimestamp.UTC().Format("2006-01-02 15:04:05")
+	var err error
+	switch rec.MessageType {
+	case model.MessageTypeAction:
+		_, err = fmt.Fprintf(e.w, "[%s] #%d * %s %s\n", ts, rec.Seq, rec.Username, rec.Message)
+	case model.MessageTypeSystem:
+		_, err = fmt.Fprintf(e.w, "[%s] #%d -- %s\n", ts, rec.Seq, rec.Message)
+	case model.MessageTypeJoin:
+		_, err = fmt.Fprintf(e.w, "[%s] #%d -> %s joined\n", ts, rec.Seq, rec.Username)
+	case model.MessageTypeLeave:
+		_, err = fmt.Fprintf(e.w, "[%s] #%d <- %s left\n", ts, rec.Seq, rec.Username)
+	default:
+		_, err = fmt.Fprintf(e.w, "[%s] #%d <%s> %s\n", ts, rec.Seq, rec.Username, rec.Message)
+	}
+	return err
+}
+
+func (e *textExport) End() error {
+	return nil
+}
+
+func (e *textExport) Flush() error {
+	return e.w.Flush()
+}
+
+// exportFormats maps ?format= to content type and file extension
+var exportFormats = map[string]struct {
+	contentType string
+	ext         string
+}{
+	"json": {"application/json", "json"},
+	"csv":  {"text/csv; charset=utf-8", "csv"},
+	"txt":  {"text/plain; charset=utf-8", "txt"},
+}
+
+func newExportWriter(format, roomId string, w io.Writer) exportWriter {
+	switch format {
+	case "csv":
+		return &csvExport{w: csv.NewWriter(w)}
+	case "txt":
+		return &textExport{w: bufio.NewWriter(w), roomId: roomId}
+	}
+	return &jsonExport{w: bufio.NewWriter(w)}
+}
+
+// HandleExport streams the room's retained history. Query parameters:
+// format (json, the default, csv or txt), from and to (RFC 3339, on the
+// server timestamp; from inclusive, to exclusive).
+func HandleExport(manager *room.Manager, history store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+
+		if owner, local := manager.Owner(roomId); !local {
+			metrics.Redirects.Inc(RedirectHTTP)
+			http.Redirect(w, r, owner.HTTPURL(r.URL.RequestURI()), http.StatusTemporaryRedirect)
+			return
+		}
+
+		params := r.URL.Query()
+		format := params.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		f, ok := exportFormats[format]
+		if !ok {
+			http.Error(w, "format must be json, csv or txt", http.StatusBadRequest)
+			return
+		}
+		from, err := parseTimeParam(params.Get("from"))
+		if err != nil {
+			http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		to, err := parseTimeParam(params.Get("to"))
+		if err != nil {
+			http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+
+		// Exports can take longer than the server's write timeout
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+
+		w.Header().Set("Content-Type", f.contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": "room-" + roomId + "." + f.ext,
+		}))
+		w.WriteHeader(http.StatusOK)
+
+		out := newExportWriter(format, roomId, w)
+		count, err := streamExport(r.Context(), history, roomId, from, to, out, rc.Flush)
+		if err != nil {
+			// The status is already sent; a truncated body is all we can do
+			slog.Warn("export failed", "roomId", roomId, "format", format, "exported", count, "err", err)
+			return
+		}
+		slog.Info("room exported", "roomId", roomId, "format", format, "messages", count)
+	}
+}
+
+// streamExport writes the messages between from and to page by page,
+// flushing each page to the client
+func streamExport(ctx context.Context, history store.Store, roomId string, from, to time.Time, out exportWriter, flush func() error) (int, error) {
+	if err := out.Begin(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var after uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		page, err := history.Since(roomId, after, exportPageSize)
+		if err != nil {
+			return count, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		done := false
+		for _, msg := range page {
+			after = msg.Seq
+			if !from.IsZero() && msg.ServerTimestamp.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !msg.ServerTimestamp.Before(to) {
+				// Timestamps follow the sequence, so nothing later matches
+				done = true
+				break
+			}
+			if err := out.Write(exportRecord(msg)); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err := out.Flush(); err != nil {
+			return count, err
+		}
+		if err := flush(); err != nil {
+			return count, err
+		}
+		if done {
+			break
+		}
+	}
+
+	if err := out.End(); err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
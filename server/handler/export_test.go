@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"bytes"
+	"chatroom/server/admission"
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// export downloads the export of roomId with the given query
+func (s *testServer) export(t *testing.T, roomId, query string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(s.URL + "/rooms/" + url.PathEscape(roomId) + "/export?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestExportFormats(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	appendAged(t, s.history, "7", "hello, \"world\"", time.Minute)
+	appendAged(t, s.history, "7", "bye", 0)
+
+	resp, body := s.export(t, "7", "")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("json: Content-Type %q", ct)
+	}
+	var records []ExportRecord
+	if err := json.Unmarshal([]byte(body), &records); err != nil {
+		t.Fatalf("json: %v in %q", err, body)
+	}
+	if len(records) != 2 || records[0].Message != "hello, \"world\"" || records[0].Seq != 1 || records[1].Username != "alice" {
+		t.Fatalf("json: %+v", records)
+	}
+
+	resp, body = s.export(t, "7", "format=csv")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Fatalf("csv: Content-Type %q", ct)
+	}
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "seq" || rows[1][5] != "hello, \"world\"" || rows[2][0] != "2" {
+		t.Fatalf("csv: %q", rows)
+	}
+
+	_, body = s.export(t, "7", "format=txt")
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "# Transcript of room 7") ||
+		!strings.HasSuffix(lines[2], "#2 <alice> bye") {
+		t.Fatalf("txt: %q", body)
+	}
+
+	if resp, _ := s.export(t, "7", "format=xml"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown format: status %d", resp.StatusCode)
+	}
+	if resp, _ := s.export(t, "7", "from=yesterday"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad from: status %d", resp.StatusCode)
+	}
+}
+
+func TestExportTimeRange(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	for _, age := range []time.Duration{4 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour} {
+		appendAged(t, s.history, "7", age.String(), age)
+	}
+	msgs, _ := s.history.Since("7", 0, 0)
+
+	// from is inclusive and to exclusive
+	query := url.Values{
+		"from": {msgs[1].ServerTimestamp.Format(time.RFC3339Nano)},
+		"to":   {msgs[3].ServerTimestamp.Format(time.RFC3339Nano)},
+	}
+	_, body := s.export(t, "7", query.Encode())
+	var records []ExportRecord
+	if err := json.Unmarshal([]byte(body), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Message != "3h0m0s" || records[1].Message != "2h0m0s" {
+		t.Fatalf("exported %+v", records)
+	}
+}
+
+// countingStore counts the pages read from the history
+type countingStore struct {
+	store.Store
+	reads int
+}
+
+func (c *countingStore) Since(roomId string, afterSeq uint64, limit int) ([]model.ServerResponse, error) {
+	c.reads++
+	return c.Store.Since(roomId, afterSeq, limit)
+}
+
+func TestExportStopsAtTo(t *testing.T) {
+	history := &countingStore{Store: store.NewMemoryStore(3 * exportPageSize)}
+	for i := 0; i < 3*exportPageSize; i++ {
+		appendAged(t, history, "7", "hi", time.Duration(3*exportPageSize-i)*time.Second)
+	}
+	msgs, _ := history.Since("7", 0, 0)
+	history.reads = 0
+
+	var buf bytes.Buffer
+	out := newExportWriter("json", "7", &buf)
+	to := msgs[10].ServerTimestamp
+	count, err := streamExport(context.Background(), history, "7", time.Time{}, to, out, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 || history.reads != 1 {
+		t.Fatalf("exported %d in %d reads, want 10 in 1", count, history.reads)
+	}
+	var records []ExportRecord
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil || len(records) != 10 {
+		t.Fatalf("body not a complete array of 10: %v", err)
+	}
+}
+
+func TestExportFilename(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	roomId := "a\"b; filename=evil.sh"
+	appendAged(t, s.history, roomId, "hi", 0)
+
+	resp, _ := s.export(t, roomId, "format=csv")
+	disposition, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatalf("Content-Disposition %q: %v", resp.Header.Get("Content-Disposition"), err)
+	}
+	if disposition != "attachment" || params["filename"] != "room-"+roomId+".csv" {
+		t.Fatalf("Content-Disposition %q", resp.Header.Get("Content-Disposition"))
+	}
+}
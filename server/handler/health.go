@@ -1,22 +1,180 @@
 package handler
 
 import (
-	"encoding/json"
+	"chatroom/server/admission"
+	"chatroom/server/room"
+	"chatroom/server/store"
 	"net/http"
+	"runtime"
+	"sync"
 	"time"
 )
 
+// Health statuses
+const (
+	StatusUp   = "UP"
+	StatusDown = "DOWN"
+)
+
 type HealthResponse struct {
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
+	Status     string                     `json:"status"`
+	Timestamp  time.Time                  `json:"timestamp"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// ComponentStatus is the state of a single part of the server
+type ComponentStatus struct {
+	Status  string                 `json:"status"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Check reports the status of one component
+type Check func() ComponentStatus
+
+// Health serves liveness and readiness probes. Liveness only says the
+// process is serving requests; readiness also says whether it should get
+// new connections.
+type Health struct {
+	manager *room.Manager
+	admit   *admission.Controller
+	started time.Time
+
+	mu     sync.RWMutex
+	checks map[string]Check
+}
+
+func NewHealth(manager *room.Manager, admit *admission.Controller) *Health {
+	h := &Health{
+		manager: manager,
+		admit:   admit,
+		started: time.Now(),
+		checks:  make(map[string]Check),
+	}
+	h.AddReadinessCheck("drain", h.checkDrain)
+	h.AddReadinessCheck("connections", h.checkConnections)
+	return h
 }
 
-func HandleHealth(w http.ResponseWriter, r *http.Request) {
-	response := HealthResponse{
-		Status:    "UP",
-		Timestamp: time.Now(),
+// AddReadinessCheck registers a component that must be UP for the node to be ready
+func (h *Health) AddReadinessCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// HandleLive always answers 200 while the process can serve HTTP
+func (h *Health) HandleLive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, HealthResponse{
+			Status:     StatusUp,
+			Timestamp:  time.Now(),
+			Components: map[string]ComponentStatus{"server": h.checkServer()},
+		})
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
 }
 
+// HandleReady answers 503 if any readiness check is DOWN
+func (h *Health) HandleReady() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := HealthResponse{
+			Status:     StatusUp,
+			Timestamp:  time.Now(),
+			Components: map[string]ComponentStatus{"server": h.checkServer()},
+		}
+
+		h.mu.RLock()
+		checks := make(map[string]Check, len(h.checks))
+		for name, check := range h.checks {
+			checks[name] = check
+		}
+		h.mu.RUnlock()
+
+		for name, check := range checks {
+			status := check()
+			response.Components[name] = status
+			if status.Status != StatusUp {
+				response.Status = StatusDown
+			}
+		}
+
+		code := http.StatusOK
+		if response.Status != StatusUp {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, response)
+	}
+}
+
+func (h *Health) checkServer() ComponentStatus {
+	return ComponentStatus{
+		Status: StatusUp,
+		Details: map[string]interface{}{
+			"uptimeSeconds": int64(time.Since(h.started).Seconds()),
+			"goroutines":    runtime.NumGoroutine(),
+			"rooms":         h.manager.RoomCount(),
+			"connections":   h.admit.Total(),
+		},
+	}
+}
+
+func (h *Health) checkDrain() ComponentStatus {
+	drain := h.manager.DrainStatus()
+	status := StatusUp
+	if h.manager.Draining() {
+		status = StatusDown
+	}
+	return ComponentStatus{
+		Status:  status,
+		Details: map[string]interface{}{"state": drain.State},
+	}
+}
+
+// storeProbeRoom is the room whose stats the store check reads; it need not exist
+const storeProbeRoom = "_health"
+
+// StoreCheck is DOWN when history does not answer a stats read within
+// timeout, since rooms could not record or replay messages
+func StoreCheck(history store.Store, timeout time.Duration) Check {
+	return func() ComponentStatus {
+		result := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			_, err := history.Stats(storeProbeRoom)
+			result <- err
+		}()
+
+		details := map[string]interface{}{}
+		select {
+		case err := <-result:
+			details["latencyMs"] = time.Since(start).Milliseconds()
+			if err != nil {
+				details["error"] = err.Error()
+				return ComponentStatus{Status: StatusDown, Details: details}
+			}
+			return ComponentStatus{Status: StatusUp, Details: details}
+		case <-time.After(timeout):
+			details["error"] = "timed out after " + timeout.String()
+			return ComponentStatus{Status: StatusDown, Details: details}
+		}
+	}
+}
+
+// checkConnections is DOWN when the global connection limit leaves no headroom
+func (h *Health) checkConnections() ComponentStatus {
+	limits := h.admit.Limits()
+	total := h.admit.Total()
+	details := map[string]interface{}{
+		"active": total,
+		"max":    limits.MaxConnections,
+	}
+
+	status := StatusUp
+	if limits.MaxConnections > 0 {
+		headroom := int64(limits.MaxConnections) - total
+		details["headroom"] = headroom
+		if headroom <= 0 {
+			status = StatusDown
+		}
+	}
+	return ComponentStatus{Status: status, Details: details}
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"chatroom/codec"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"fmt"
+)
+
+var minProtocol = model.MinProtocolVersion
+
+// SetMinProtocol refuses clients older than version; with 2 or more every
+// client must open with HELLO
+func SetMinProtocol(version int) {
+	minProtocol = version
+}
+
+// protocol is what a connection negotiated
+type protocol struct {
+	version  int
+	features map[string]bool
+}
+
+func (p protocol) has(feature string) bool {
+	return p.features[feature]
+}
+
+// serverFeatures lists the optional features this connection could use
+func serverFeatures(cdc codec.Codec, compressed bool) map[string]bool {
+	features := map[string]bool{}
+	if cdc == codec.JSON {
+		features[model.FeatureBatching] = true
+	}
+	if compressed {
+		features[model.FeatureCompression] = true
+	}
+	if commands.Registry != nil {
+		features[model.FeatureCommands] = true
+	}
+	if resumption != nil {
+		features[model.FeatureAcks] = true
+		features[model.FeatureHistory] = true
+	}
+	return features
+}
+
+// handshake handles the first frame of a connection. If it is a HELLO the
+// server answers with welcome, completed with the negotiated version,
+// features and limits, and handled is true. Other frames mean a version 1
+// client, whose frame must then be processed as a message. A non-nil error
+// means the connection was closed.
+func handshake(client *room.Client, data []byte, compressed bool, welcome model.Welcome) (proto protocol, handled bool, err error) {
+	var hello model.Hello
+	if client.Codec.Unmarshal(data, &hello) != nil || hello.Type != model.ControlTypeHello {
+		if minProtocol > model.MinProtocolVersion {
+			metrics.Handshakes.Inc("rejected")
+			return proto, false, closeProtocol(client, fmt.Sprintf("HELLO with protocol version %d or later required", minProtocol))
+		}
+		metrics.Handshakes.Inc("legacy")
+		return protocol{version: model.MinProtocolVersion}, false, nil
+	}
+
+	if hello.Version < minProtocol || hello.Version > model.ProtocolVersion {
+		metrics.Handshakes.Inc("rejected")
+		client.Log().Info("protocol version rejected", "version", hello.Version, "client", hello.Client)
+		return proto, true, closeProtocol(client, fmt.Sprintf("unsupported protocol version %d, server supports %d-%d",
+			hello.Version, minProtocol, model.ProtocolVersion))
+	}
+
+	supported := serverFeatures(client.Codec, compressed)
+	proto = protocol{version: hello.Version, features: make(map[string]bool)}
+	welcome.Type = model.ControlTypeWelcome
+	welcome.Version = hello.Version
+	welcome.Features = []string{}
+	welcome.Limits = model.Limits{
+		MaxMessageLength: model.MaxMessageLength,
+		MaxBatchSize:     maxBatchSize,
+		MaxFrameBytes:    abuse.MaxFrameBytes,
+	}
+	for _, f := range hello.Features {
+		if supported[f] && !proto.features[f] {
+			proto.features[f] = true
+			welcome.Features = append(welcome.Features, f)
+		}
+	}
+	if !proto.has(model.FeatureHistory) {
+		welcome.ResumeToken = ""
+	}
+
+	metrics.Handshakes.Inc("hello")
+	client.Log().Debug("handshake", "version", hello.Version, "features", welcome.Features, "client", hello.Client)
+	return proto, true, client.Write(welcome)
+}
+
+func closeProtocol(client *room.Client, reason string) error {
+	client.CloseWithError(model.ErrorProtocolVersion, reason)
+	return fmt.Errorf("%s", reason)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/model"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// hello sends a HELLO and reads the WELCOME
+func hello(t *testing.T, conn *websocket.Conn, version int, features ...string) model.Welcome {
+	t.Helper()
+	send(t, conn, model.Hello{Type: model.ControlTypeHello, Version: version, Features: features, Client: "test"})
+	var welcome model.Welcome
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Type != model.ControlTypeWelcome {
+		t.Fatalf("got %+v, want WELCOME", welcome)
+	}
+	return welcome
+}
+
+// setResumeWindow enables session resumption for one test
+func setResumeWindow(t *testing.T, window time.Duration) {
+	t.Helper()
+	saved := resumption
+	SetResumeWindow(window)
+	t.Cleanup(func() { resumption = saved })
+}
+
+func TestHelloNegotiatesFeatures(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	conn := s.dial(t, "/chat/7")
+
+	// Unknown, unsupported and repeated features are left out
+	welcome := hello(t, conn, model.ProtocolVersion, model.FeatureBatching, model.FeatureCommands,
+		model.FeatureHistory, "teleport", model.FeatureBatching)
+	if welcome.Version != model.ProtocolVersion || strings.Join(welcome.Features, ",") != model.FeatureBatching {
+		t.Fatalf("welcome %+v", welcome)
+	}
+	if welcome.Limits.MaxMessageLength != model.MaxMessageLength || welcome.Limits.MaxBatchSize != maxBatchSize {
+		t.Fatalf("limits %+v", welcome.Limits)
+	}
+	if welcome.NodeId != "a" || welcome.ConnId == "" || welcome.ResumeToken != "" {
+		t.Fatalf("welcome %+v", welcome)
+	}
+
+	// Messages follow the handshake as before
+	send(t, conn, textMessage("1", "alice", "hi"))
+	if resp := readResponse(t, conn); resp.Status != model.StatusOK {
+		t.Fatalf("response %+v", resp)
+	}
+}
+
+func TestHelloHistoryGivesResumeToken(t *testing.T) {
+	setResumeWindow(t, time.Minute)
+	admit := admission.NewController(admission.Limits{})
+	s := newTestServer(t, admit)
+
+	conn := s.dial(t, "/chat/7")
+	welcome := hello(t, conn, model.ProtocolVersion, model.FeatureAcks, model.FeatureHistory)
+	if strings.Join(welcome.Features, ",") != "acks,history" || welcome.ResumeToken == "" {
+		t.Fatalf("welcome %+v", welcome)
+	}
+
+	// Without history there is nothing to resume
+	other := s.dial(t, "/chat/7")
+	welcome = hello(t, other, model.ProtocolVersion, model.FeatureAcks)
+	if welcome.ResumeToken != "" {
+		t.Fatalf("welcome %+v", welcome)
+	}
+
+	// The handlers must be done with the sessions before resumption is reset
+	conn.Close()
+	other.Close()
+	waitFor(t, "the connections to end", func() bool { return admit.Total() == 0 })
+}
+
+func TestLegacyClientsNeedNoHello(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	conn := s.dial(t, "/chat/7")
+
+	send(t, conn, textMessage("1", "alice", "hi"))
+	if resp := readResponse(t, conn); resp.Status != model.StatusOK || resp.Message.Message != "hi" {
+		t.Fatalf("response %+v", resp)
+	}
+}
+
+func TestUnsupportedVersionsAreClosed(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	for _, version := range []int{0, model.ProtocolVersion + 1} {
+		conn := s.dial(t, "/chat/7")
+		send(t, conn, model.Hello{Type: model.ControlTypeHello, Version: version})
+		expectClose(t, conn, websocket.CloseProtocolError)
+	}
+}
+
+func TestMinProtocolRequiresHello(t *testing.T) {
+	saved := minProtocol
+	SetMinProtocol(2)
+	t.Cleanup(func() { minProtocol = saved })
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+
+	conn := s.dial(t, "/chat/7")
+	send(t, conn, textMessage("1", "alice", "hi"))
+	expectClose(t, conn, websocket.CloseProtocolError)
+
+	conn = s.dial(t, "/chat/7")
+	send(t, conn, model.Hello{Type: model.ControlTypeHello, Version: 1})
+	expectClose(t, conn, websocket.CloseProtocolError)
+
+	if welcome := hello(t, s.dial(t, "/chat/7"), 2); welcome.Version != 2 {
+		t.Fatalf("welcome %+v", welcome)
+	}
+}
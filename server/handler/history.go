@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"chatroom/server/auth"
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// historyAccess decides how much retained history a request may read.
+// Export and search are behind the admin token; event streams and polls
+// catching up after a reconnect get everything with the token and only
+// the messages of the last catchUp without it, the same as a resumed
+// websocket session.
+var historyAccess = struct {
+	admin   *auth.AdminToken
+	catchUp time.Duration
+}{catchUp: 2 * time.Minute}
+
+// SetHistoryAccess sets the token that may replay the whole history and
+// how far back other clients catch up; 0 replays nothing to them
+func SetHistoryAccess(admin *auth.AdminToken, catchUp time.Duration) {
+	historyAccess.admin = admin
+	historyAccess.catchUp = catchUp
+}
+
+// catchUp reads up to limit (0 for all) retained messages after seq that
+// r may be replayed. more reports that the history had a full page, so
+// there may be more to read after the last message returned.
+func catchUp(r *http.Request, history store.Store, roomId string, after uint64, limit int) (msgs []model.ServerResponse, more bool, err error) {
+	if historyAccess.admin.Check(r) {
+		msgs, err = history.Since(roomId, after, limit)
+		return msgs, limit > 0 && len(msgs) == limit, err
+	}
+	cutoff := time.Now().Add(-historyAccess.catchUp)
+	for {
+		page, err := history.Since(roomId, after, limit)
+		if err != nil || len(page) == 0 {
+			return page, false, err
+		}
+		full := limit > 0 && len(page) == limit
+		i := sort.Search(len(page), func(i int) bool { return page[i].ServerTimestamp.After(cutoff) })
+		if i < len(page) || !full {
+			return page[i:], full, nil
+		}
+		// The whole page is too old; skip past it
+		after = page[len(page)-1].Seq
+	}
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/auth"
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setHistoryAccess changes the history access policy for one test
+func setHistoryAccess(t *testing.T, admin *auth.AdminToken, catchUp time.Duration) {
+	t.Helper()
+	saved := historyAccess
+	SetHistoryAccess(admin, catchUp)
+	t.Cleanup(func() { historyAccess = saved })
+}
+
+// appendAged adds a message sent age ago straight to the history
+func appendAged(t *testing.T, history store.Store, roomId, text string, age time.Duration) uint64 {
+	t.Helper()
+	msg, err := history.Append(roomId, model.ServerResponse{
+		Message:         textMessage("1", "alice", text),
+		Status:          model.StatusBroadcast,
+		ServerTimestamp: time.Now().Add(-age),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Seq
+}
+
+func texts(msgs []model.ServerResponse) []string {
+	out := []string{}
+	for _, msg := range msgs {
+		out = append(out, msg.Message.Message)
+	}
+	return out
+}
+
+func TestCatchUp(t *testing.T) {
+	history := store.NewMemoryStore(100)
+	for _, text := range []string{"old1", "old2", "old3"} {
+		appendAged(t, history, "7", text, time.Hour)
+	}
+	appendAged(t, history, "7", "new1", time.Second)
+	appendAged(t, history, "7", "new2", 0)
+
+	tests := []struct {
+		name    string
+		token   string
+		catchUp time.Duration
+		limit   int
+		want    []string
+		more    bool
+	}{
+		{"admin token", "s3cret", time.Minute, 0, []string{"old1", "old2", "old3", "new1", "new2"}, false},
+		{"no token", "", time.Minute, 0, []string{"new1", "new2"}, false},
+		{"wrong token", "guess", time.Minute, 0, []string{"new1", "new2"}, false},
+		{"window disabled", "", 0, 0, []string{}, false},
+		{"old pages skipped", "", time.Minute, 2, []string{"new1"}, true},
+		{"admin pages", "s3cret", time.Minute, 2, []string{"old1", "old2"}, true},
+	}
+	for _, tt := range tests {
+		setHistoryAccess(t, auth.NewAdminToken("s3cret"), tt.catchUp)
+		r := httptest.NewRequest("GET", "/rooms/7/events", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		msgs, more, err := catchUp(r, history, "7", 0, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := texts(msgs); len(got) != len(tt.want) || more != tt.more {
+			t.Errorf("%s: got %v more=%v, want %v more=%v", tt.name, got, more, tt.want, tt.more)
+			continue
+		}
+		for i := range tt.want {
+			if got := texts(msgs); got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestEventsReplayOldHistoryOnlyToAdmin(t *testing.T) {
+	setHistoryAccess(t, auth.NewAdminToken("s3cret"), time.Minute)
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	appendAged(t, s.history, "7", "old", time.Hour)
+	appendAged(t, s.history, "7", "recent", time.Second)
+
+	// Last-Event-ID 0 without the token only reaches back the window
+	stream := s.openEvents(t, "/rooms/7/events", "0")
+	expectMessage(t, stream.next(t), "recent")
+
+	req, err := http.NewRequest("GET", s.URL+"/rooms/7/events?lastEventId=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	stream = streamEvents(t, req)
+	expectMessage(t, stream.next(t), "old")
+	expectMessage(t, stream.next(t), "recent")
+}
+
+func TestLongPollReplaysOldHistoryOnlyToAdmin(t *testing.T) {
+	setHistoryAccess(t, auth.NewAdminToken("s3cret"), time.Minute)
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	appendAged(t, s.history, "7", "old", time.Hour)
+	appendAged(t, s.history, "7", "recent", time.Second)
+
+	_, poll := s.getPoll(t, "/rooms/7/poll?cursor=0")
+	if got := texts(poll.Messages); len(got) != 1 || got[0] != "recent" {
+		t.Fatalf("without token polled %v", got)
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"/rooms/7/poll?cursor=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&poll); err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(poll.Messages); len(got) != 2 || got[0] != "old" {
+		t.Fatalf("with token polled %v", got)
+	}
+}
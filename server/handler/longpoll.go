@@ -0,0 +1,499 @@
+package handler
+
+import (
+	"chatroom/codec"
+	"chatroom/server/admission"
+	"chatroom/server/auth"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"chatroom/server/store"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// pollQueueSize is how many broadcasts a session buffers between polls;
+	// older ones are dropped and recovered from the history by cursor
+	pollQueueSize = 256
+	// pollSessionTTL ends sessions that have not polled for this long
+	pollSessionTTL = 60 * time.Second
+	// maxPostBody limits the body of a posted message
+	maxPostBody = 64 << 10
+)
+
+// PollResponse is the body returned by a poll
+type PollResponse struct {
+	SessionId string                 `json:"sessionId"`
+	Cursor    uint64                 `json:"cursor"` // pass back as ?cursor= on the next poll
+	Messages  []model.ServerResponse `json:"messages"`
+}
+
+// pollSession is a long-poll client's membership of a room. It buffers the
+// room's broadcasts until the next poll picks them up.
+type pollSession struct {
+	room.Identity
+
+	id      string
+	roomId  string
+	base    *slog.Logger
+	logger  atomic.Pointer[slog.Logger]
+	release func()
+
+	mu       sync.Mutex
+	pending  []model.ServerResponse
+	gap      bool // messages may be missing before pending: new session or overflow
+	lastPoll time.Time
+	polling  int
+	kicked   string        // "CODE: reason", once a moderator removed the session
+	drained  bool          // the node is draining; the session ends at its next poll
+	retryMs  int64         // suggested reconnect delay once drained
+	notify   chan struct{} // signalled when pending becomes non-empty, on a kick or a drain
+}
+
+func (s *pollSession) ConnID() string {
+	return s.id
+}
+
+func (s *pollSession) Log() *slog.Logger {
+	return s.logger.Load()
+}
+
+func (s *pollSession) Transport() string {
+	return "longpoll"
+}
+
+func (s *pollSession) SetUser(userId, username string) {
+	if s.Remember(userId, username) {
+		s.logger.Store(s.base.With("userId", userId))
+	}
+}
+
+func (s *pollSession) Deliver(msg model.ServerResponse) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := true
+	if len(s.pending) >= pollQueueSize {
+		s.pending = s.pending[1:]
+		s.gap = true
+		kept = false
+	}
+	s.pending = append(s.pending, msg)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return kept
+}
+
+// Kick ends the session at its next or current poll
+func (s *pollSession) Kick(code, reason string) {
+	s.mu.Lock()
+	s.kicked = code + ": " + reason
+	s.mu.Unlock()
+	s.Log().Info("long-poll session kicked", "code", code, "reason", reason)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Drain ends the session: a waiting poll is answered with 503 and a
+// Retry-After, and an idle session is removed by the next expiry sweep.
+// See room.Drainer.
+func (s *pollSession) Drain(retryAfterMs int64) {
+	s.mu.Lock()
+	s.drained = true
+	s.retryMs = retryAfterMs
+	s.mu.Unlock()
+	s.Log().Debug("asking long-poll session to reconnect", "retryAfterMs", retryAfterMs)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// drainedRetry returns the reconnect delay of a drained session
+func (s *pollSession) drainedRetry() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.retryMs) * time.Millisecond, s.drained
+}
+
+func (s *pollSession) kickReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kicked
+}
+
+// take removes and returns the buffered messages after cursor, and whether
+// messages may be missing before them
+func (s *pollSession) take(cursor uint64) ([]model.ServerResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []model.ServerResponse
+	for _, msg := range s.pending {
+		if msg.Seq > cursor {
+			out = append(out, msg)
+		}
+	}
+	gap := s.gap
+	s.pending, s.gap = nil, false
+	return out, gap
+}
+
+// LongPoll serves the HTTP long-polling transport. A session is created by
+// the first poll and stays a member of the room until it stops polling.
+type LongPoll struct {
+	manager *room.Manager
+	admit   *admission.Controller
+	history store.Store
+	bots    *auth.Bots
+	timeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+// NewLongPoll creates the transport; polls wait up to timeout for messages
+func NewLongPoll(manager *room.Manager, admit *admission.Controller, history store.Store, timeout time.Duration) *LongPoll {
+	lp := &LongPoll{
+		manager:  manager,
+		admit:    admit,
+		history:  history,
+		timeout:  timeout,
+		sessions: make(map[string]*pollSession),
+	}
+	go lp.expireLoop()
+	return lp
+}
+
+// SetBots lets the bots in bots post with an "Authorization: Bearer" token
+func (lp *LongPoll) SetBots(bots *auth.Bots) {
+	lp.bots = bots
+}
+
+// checkRoom answers requests this node should not serve and reports whether it did
+func (lp *LongPoll) checkRoom(w http.ResponseWriter, r *http.Request, roomId string) bool {
+	if lp.manager.Draining() {
+		w.Header().Set("Retry-After", drainRetryAfter)
+		http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+		return true
+	}
+	if owner, local := lp.manager.Owner(roomId); !local {
+		metrics.Redirects.Inc(RedirectHTTP)
+		http.Redirect(w, r, owner.HTTPURL(r.URL.RequestURI()), http.StatusTemporaryRedirect)
+		return true
+	}
+	return false
+}
+
+// session returns the session named by the session query parameter,
+// creating one when it is missing or has expired
+func (lp *LongPoll) session(w http.ResponseWriter, r *http.Request, roomId string) *pollSession {
+	id := r.URL.Query().Get("session")
+
+	lp.mu.Lock()
+	s, ok := lp.sessions[id]
+	if ok && s.roomId == roomId {
+		s.mu.Lock()
+		s.polling++
+		s.mu.Unlock()
+		lp.mu.Unlock()
+		return s
+	}
+	lp.mu.Unlock()
+	if ok {
+		http.Error(w, "Session belongs to another room", http.StatusBadRequest)
+		return nil
+	}
+
+	release, err := lp.admit.Acquire(clientIP(r), roomId)
+	if err != nil {
+		rejectAdmission(w, err)
+		return nil
+	}
+
+	s = &pollSession{
+		id:       room.NewConnID(),
+		roomId:   roomId,
+		release:  release,
+		gap:      true,
+		lastPoll: time.Now(),
+		polling:  1,
+		notify:   make(chan struct{}, 1),
+	}
+	s.base = slog.With("roomId", roomId, "remoteAddr", r.RemoteAddr, "connId", s.id, "transport", "longpoll")
+	s.logger.Store(s.base)
+
+	lp.mu.Lock()
+	lp.sessions[s.id] = s
+	lp.mu.Unlock()
+	lp.manager.GetRoom(roomId).AddSubscriber(s)
+	metrics.LongPollSessions.Inc()
+	s.Log().Info("long-poll session opened")
+	return s
+}
+
+// HandlePoll returns the messages after ?cursor=, waiting up to the poll
+// timeout when there are none yet. Without a cursor only new messages are
+// returned.
+func (lp *LongPoll) HandlePoll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+		if lp.checkRoom(w, r, roomId) {
+			return
+		}
+
+		var cursor uint64
+		hasCursor := false
+		if v := r.URL.Query().Get("cursor"); v != "" {
+			c, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "cursor must be a message sequence number", http.StatusBadRequest)
+				return
+			}
+			cursor, hasCursor = c, true
+		}
+
+		s := lp.session(w, r, roomId)
+		if s == nil {
+			return
+		}
+		defer func() {
+			s.mu.Lock()
+			s.polling--
+			s.lastPoll = time.Now()
+			s.mu.Unlock()
+		}()
+
+		// The server's WriteTimeout is shorter than a poll may wait
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(lp.timeout + 5*time.Second))
+
+		msgs := lp.collect(r, s, cursor, hasCursor)
+		timer := time.NewTimer(lp.timeout)
+		defer timer.Stop()
+	wait:
+		for len(msgs) == 0 {
+			if retry, drained := s.drainedRetry(); drained {
+				lp.end(s)
+				w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retry.Seconds())), 1)))
+				http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+				return
+			}
+			if reason := s.kickReason(); reason != "" {
+				lp.end(s)
+				http.Error(w, "Session ended: "+reason, http.StatusForbidden)
+				return
+			}
+			select {
+			case <-s.notify:
+				// May be left over from messages an earlier poll already took
+				msgs = lp.collect(r, s, cursor, hasCursor)
+			case <-timer.C:
+				break wait
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if len(msgs) > 0 {
+			cursor = msgs[len(msgs)-1].Seq
+		}
+		if msgs == nil {
+			msgs = []model.ServerResponse{}
+		}
+		writeJSON(w, http.StatusOK, PollResponse{SessionId: s.id, Cursor: cursor, Messages: msgs})
+	}
+}
+
+// collect returns the session's buffered messages after cursor. When the
+// session is new or overflowed, the messages it may have missed since the
+// cursor are read from the room history first, as far back as
+// historyAccess allows.
+func (lp *LongPoll) collect(r *http.Request, s *pollSession, cursor uint64, hasCursor bool) []model.ServerResponse {
+	msgs, gap := s.take(cursor)
+	if !hasCursor || !gap || (len(msgs) > 0 && msgs[0].Seq == cursor+1) {
+		return msgs
+	}
+
+	missed, more, err := catchUp(r, lp.history, s.roomId, cursor, pollQueueSize)
+	if err != nil {
+		s.Log().Warn("history read failed", "err", err)
+		return msgs
+	}
+	if len(missed) == 0 {
+		return msgs
+	}
+	if more {
+		// More pages to read on the next poll
+		s.mu.Lock()
+		s.gap = true
+		s.mu.Unlock()
+	}
+	// Only append what continues the sequence; anything past a gap is
+	// still in the history for the next poll
+	last := missed[len(missed)-1].Seq
+	for _, msg := range msgs {
+		if msg.Seq == last+1 {
+			missed = append(missed, msg)
+			last = msg.Seq
+		}
+	}
+	return missed
+}
+
+// HandlePost accepts one message with the same validation and response as
+// a websocket frame. Requests with a bearer token post as that bot, under
+// its configured userId and name, and are marked as such; the others are
+// long-poll users, and passing ?session= keeps the message out of that
+// session's own polls.
+func (lp *LongPoll) HandlePost() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+		if lp.checkRoom(w, r, roomId) {
+			return
+		}
+
+		var from sender
+		if token, ok := auth.BearerToken(r); ok {
+			bot, ok := lp.bots.Authenticate(token)
+			if !ok {
+				metrics.BotAuthFailures.Inc()
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+				http.Error(w, "Invalid bot token", http.StatusUnauthorized)
+				return
+			}
+			if !bot.CanPost(roomId) {
+				http.Error(w, "Bot may not post to this room", http.StatusForbidden)
+				return
+			}
+			from = newBotSender(r, roomId, bot)
+		} else {
+			lp.mu.Lock()
+			if s, ok := lp.sessions[r.URL.Query().Get("session")]; ok && s.roomId == roomId {
+				from = s
+			}
+			lp.mu.Unlock()
+			if from == nil {
+				from = newHTTPSender(r, roomId)
+			}
+		}
+
+		var msg model.Message
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostBody)).Decode(&msg); err != nil {
+			code, errStr := invalidFormat(codec.JSON)
+			response := errorResponse(nil, code, errStr)
+			metrics.MessagesRejected.Inc(response.Code)
+			writeJSON(w, http.StatusBadRequest, response)
+			return
+		}
+
+		if bot, ok := from.(*botSender); ok {
+			// A bot's identity comes from its token, not the body
+			msg.UserId, msg.Username = bot.userId, bot.name
+		}
+		response := processMessage(lp.manager.GetRoom(roomId), from, &msg)
+		status := http.StatusOK
+		switch {
+		case response.Code == model.ErrorBanned:
+			status = http.StatusForbidden
+		case response.Status == model.StatusError:
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, response)
+	}
+}
+
+// expireLoop ends sessions that stopped polling
+func (lp *LongPoll) expireLoop() {
+	ticker := time.NewTicker(pollSessionTTL / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*pollSession
+		lp.mu.Lock()
+		for id, s := range lp.sessions {
+			s.mu.Lock()
+			idle := s.polling == 0 && (s.drained || time.Since(s.lastPoll) > pollSessionTTL)
+			s.mu.Unlock()
+			if idle {
+				delete(lp.sessions, id)
+				expired = append(expired, s)
+			}
+		}
+		lp.mu.Unlock()
+
+		for _, s := range expired {
+			lp.close(s)
+			s.Log().Info("long-poll session expired")
+		}
+	}
+}
+
+// end removes a session that is still registered
+func (lp *LongPoll) end(s *pollSession) {
+	lp.mu.Lock()
+	_, ok := lp.sessions[s.id]
+	delete(lp.sessions, s.id)
+	lp.mu.Unlock()
+	if ok {
+		lp.close(s)
+	}
+}
+
+// close takes an unregistered session out of its room
+func (lp *LongPoll) close(s *pollSession) {
+	lp.manager.GetRoom(s.roomId).RemoveSubscriber(s)
+	s.release()
+	metrics.LongPollSessions.Dec()
+}
+
+// httpSender is a one-off sender for a message posted without a session
+type httpSender struct {
+	room.Identity
+
+	id  string
+	log *slog.Logger
+}
+
+func newHTTPSender(r *http.Request, roomId string) *httpSender {
+	id := room.NewConnID()
+	return &httpSender{
+		id:  id,
+		log: slog.With("roomId", roomId, "remoteAddr", r.RemoteAddr, "connId", id, "transport", "http"),
+	}
+}
+
+func (s *httpSender) ConnID() string    { return s.id }
+func (s *httpSender) Log() *slog.Logger { return s.log }
+
+func (s *httpSender) SetUser(userId, username string) {
+	s.Remember(userId, username)
+	s.log = s.log.With("userId", userId)
+}
+
+// botSender posts for an authenticated bot; its messages are marked Bot
+type botSender struct {
+	httpSender
+	userId, name string
+}
+
+func newBotSender(r *http.Request, roomId string, bot auth.Bot) *botSender {
+	s := newHTTPSender(r, roomId)
+	s.log = s.log.With("bot", bot.Name)
+	return &botSender{httpSender: httpSender{id: s.id, log: s.log}, userId: bot.UserId, name: bot.Name}
+}
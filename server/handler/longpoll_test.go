@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"bytes"
+	"chatroom/server/admission"
+	"chatroom/server/auth"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// getPoll polls path and decodes the response
+func (s *testServer) getPoll(t *testing.T, path string) (*http.Response, PollResponse) {
+	t.Helper()
+	resp, err := http.Get(s.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var poll PollResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&poll); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, poll
+}
+
+// post sends msg to path and decodes the response
+func (s *testServer) post(t *testing.T, path string, msg interface{}) (int, model.ServerResponse) {
+	t.Helper()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(s.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response model.ServerResponse
+	json.NewDecoder(resp.Body).Decode(&response)
+	return resp.StatusCode, response
+}
+
+func pollPath(roomId, session string, cursor uint64) string {
+	return "/rooms/" + roomId + "/poll?session=" + session + "&cursor=" + strconv.FormatUint(cursor, 10)
+}
+
+func TestLongPollSessions(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+
+	_, alice := s.getPoll(t, "/rooms/7/poll")
+	_, bob := s.getPoll(t, "/rooms/7/poll")
+	if alice.SessionId == "" || alice.SessionId == bob.SessionId || len(alice.Messages) != 0 {
+		t.Fatalf("sessions %+v, %+v", alice, bob)
+	}
+
+	status, resp := s.post(t, "/rooms/7/messages?session="+alice.SessionId, textMessage("1", "alice", "hi"))
+	if status != http.StatusOK || resp.Status != model.StatusOK {
+		t.Fatalf("post: %d %+v", status, resp)
+	}
+
+	_, got := s.getPoll(t, pollPath("7", bob.SessionId, bob.Cursor))
+	if len(got.Messages) != 1 || got.Messages[0].Message.Message != "hi" || got.Cursor != got.Messages[0].Seq {
+		t.Fatalf("bob polled %+v", got)
+	}
+	if _, own := s.getPoll(t, pollPath("7", alice.SessionId, alice.Cursor)); len(own.Messages) != 0 {
+		t.Fatalf("alice got her own message back: %+v", own)
+	}
+	if _, again := s.getPoll(t, pollPath("7", bob.SessionId, got.Cursor)); len(again.Messages) != 0 {
+		t.Fatalf("message delivered twice: %+v", again)
+	}
+}
+
+func TestLongPollWaitsForMessages(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	_, first := s.getPoll(t, "/rooms/7/poll")
+
+	done := make(chan PollResponse)
+	go func() {
+		_, poll := s.getPoll(t, pollPath("7", first.SessionId, first.Cursor))
+		done <- poll
+	}()
+	time.Sleep(100 * time.Millisecond)
+	s.post(t, "/rooms/7/messages", textMessage("1", "alice", "wake up"))
+
+	select {
+	case poll := <-done:
+		if len(poll.Messages) != 1 || poll.Messages[0].Message.Message != "wake up" {
+			t.Fatalf("polled %+v", poll)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("poll not answered")
+	}
+}
+
+func TestLongPollCatchesUpFromHistory(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	first := s.publish(t, "7", "one")
+	s.publish(t, "7", "two")
+	s.publish(t, "7", "three")
+
+	// A new session with a cursor reads what it missed from the history
+	_, poll := s.getPoll(t, "/rooms/7/poll?cursor="+strconv.FormatUint(first, 10))
+	if len(poll.Messages) != 2 || poll.Messages[0].Message.Message != "two" || poll.Messages[1].Message.Message != "three" {
+		t.Fatalf("polled %+v", poll)
+	}
+}
+
+func TestLongPollRejects(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	_, session := s.getPoll(t, "/rooms/7/poll")
+
+	if resp, _ := s.getPoll(t, "/rooms/8/poll?session="+session.SessionId); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("session used in another room: status %d", resp.StatusCode)
+	}
+	if resp, _ := s.getPoll(t, "/rooms/7/poll?cursor=abc"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid cursor: status %d", resp.StatusCode)
+	}
+	status, resp := s.post(t, "/rooms/7/messages", textMessage("0", "alice", "hi"))
+	if status != http.StatusBadRequest || resp.Code != model.ErrorUserIdRange {
+		t.Errorf("invalid message: %d %+v", status, resp)
+	}
+}
+
+func TestDrainEndsLongPollSessions(t *testing.T) {
+	admit := admission.NewController(admission.Limits{})
+	s := newTestServer(t, admit)
+	_, waiting := s.getPoll(t, "/rooms/7/poll?cursor=0")
+	_, idle := s.getPoll(t, "/rooms/7/poll?cursor=0")
+	s.poll.timeout = 5 * time.Second
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, _ := s.getPoll(t, pollPath("7", waiting.SessionId, 0))
+		done <- resp
+	}()
+	waitFor(t, "the poll to wait", func() bool {
+		s.poll.mu.Lock()
+		defer s.poll.mu.Unlock()
+		sess := s.poll.sessions[waiting.SessionId]
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		return sess.polling == 1
+	})
+
+	if _, err := s.manager.StartDrain(room.DrainOptions{Waves: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-done:
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("drained poll: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting poll not answered")
+	}
+
+	waitFor(t, "the drain", func() bool { return s.manager.DrainStatus().State == room.DrainStateDrained })
+	if status := s.manager.DrainStatus(); status.TotalClients != 2 {
+		t.Fatalf("drain status %+v, want 2 clients", status)
+	}
+	s.poll.mu.Lock()
+	_, stillOpen := s.poll.sessions[waiting.SessionId]
+	idleSession := s.poll.sessions[idle.SessionId]
+	s.poll.mu.Unlock()
+	if stillOpen {
+		t.Error("drained session still registered")
+	}
+	if _, drained := idleSession.drainedRetry(); !drained {
+		t.Error("idle session not drained")
+	}
+}
+
+func TestBotPostsAsItself(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	bots, err := auth.NewBots([]auth.Bot{{Name: "cibot", UserId: "99999", Token: "s3cret-ci", Rooms: []string{"7"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.poll.SetBots(bots)
+	peer := s.dial(t, "/chat/7")
+	send(t, peer, textMessage("2", "bob", "joined"))
+	readResponse(t, peer)
+
+	postAs := func(token, roomId string, msg interface{}) (int, model.ServerResponse) {
+		body, _ := json.Marshal(msg)
+		req, _ := http.NewRequest("POST", s.URL+"/rooms/"+roomId+"/messages", bytes.NewReader(body))
+		req.Header.Set("Authorization", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var response model.ServerResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		return resp.StatusCode, response
+	}
+
+	// Whatever identity the body claims, the message is the bot's
+	for _, msg := range []interface{}{
+		textMessage("2", "bob", "build green"),
+		map[string]string{"message": "build green", "timestamp": time.Now().Format(time.RFC3339), "messageType": model.MessageTypeText},
+	} {
+		status, resp := postAs("Bearer s3cret-ci", "7", msg)
+		if status != http.StatusOK || resp.UserId != "99999" || resp.Username != "cibot" || !resp.Bot {
+			t.Fatalf("post: %d %+v", status, resp)
+		}
+		broadcast := readResponse(t, peer)
+		if broadcast.UserId != "99999" || broadcast.Username != "cibot" || !broadcast.Bot {
+			t.Fatalf("peer got %+v", broadcast)
+		}
+	}
+
+	if status, _ := postAs("Bearer wrong", "7", textMessage("2", "bob", "hi")); status != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %d", status)
+	}
+	if status, _ := postAs("Bearer s3cret-ci", "8", textMessage("2", "bob", "hi")); status != http.StatusForbidden {
+		t.Errorf("room outside the bot's rooms: status %d", status)
+	}
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"chatroom/server/cluster"
+	"chatroom/server/room"
+	"chatroom/server/store"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// roomOwnedBy finds a room that the ring of manager assigns to nodeId
+func roomOwnedBy(t *testing.T, manager *room.Manager, nodeId string) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		roomId := strconv.Itoa(i)
+		if owner, _ := manager.Owner(roomId); owner.ID == nodeId {
+			return roomId
+		}
+	}
+	t.Fatalf("no room owned by %s", nodeId)
+	return ""
+}
+
+func TestNonOwnerRedirects(t *testing.T) {
+	manager := room.NewManager("a", cluster.NewInProcess(), store.NewMemoryStore(10))
+	manager.EnableOwnership(cluster.NewRing(0))
+	if _, err := manager.SetMembers([]cluster.Member{
+		{ID: "a", Addr: "localhost:8080"},
+		{ID: "b", Addr: "localhost:8081"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	SetRedirectMode(RedirectHTTP)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/chat/{roomId}", HandleWebSocket(manager, nil))
+	r.HandleFunc("/rooms/{roomId}", HandleRoomInfo(manager)).Methods("GET")
+
+	remote := roomOwnedBy(t, manager, "b")
+	local := roomOwnedBy(t, manager, "a")
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/chat/" + remote, http.StatusTemporaryRedirect, "ws://localhost:8081/chat/" + remote},
+		{"/rooms/" + remote + "?verbose=1", http.StatusTemporaryRedirect, "http://localhost:8081/rooms/" + remote + "?verbose=1"},
+		{"/rooms/" + local, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+		if got := rec.Header().Get("Location"); got != tt.location {
+			t.Errorf("GET %s: Location %q, want %q", tt.path, got, tt.location)
+		}
+	}
+	if _, ok := manager.Room(remote); ok {
+		t.Error("redirected room was created on the non-owner")
+	}
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resumeSession lets a websocket client pick up where it left off after its
+// connection drops: same identity, no JOIN, and the messages after the last
+// sequence it acknowledged
+type resumeSession struct {
+	token  string
+	roomId string
+	acked  atomic.Uint64
+
+	// guarded by resumeStore.mu
+	client  *room.Client // the connection that holds the session, or held it when parked
+	parked  bool
+	expires time.Time
+}
+
+// resumeStore tracks the sessions of connections that negotiated history,
+// open or dropped, until they end or their resume window passes. Sessions
+// are local to the node.
+type resumeStore struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*resumeSession
+}
+
+// resumption is nil when sessions cannot be resumed
+var resumption *resumeStore
+
+// SetResumeWindow keeps the sessions of dropped connections that negotiated
+// history resumable for window; 0 disables resumption
+func SetResumeWindow(window time.Duration) {
+	if window <= 0 {
+		resumption = nil
+		return
+	}
+	resumption = &resumeStore{window: window, sessions: make(map[string]*resumeSession)}
+	go resumption.expireLoop()
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// resumeParams reads the token and optional last sequence a reconnecting
+// client passes as ?resume= and ?lastSeq=
+func resumeParams(r *http.Request) (token string, lastSeq uint64, hasLastSeq bool, err error) {
+	q := r.URL.Query()
+	token = q.Get("resume")
+	if v := q.Get("lastSeq"); v != "" {
+		lastSeq, err = strconv.ParseUint(v, 10, 64)
+		hasLastSeq = true
+	}
+	return token, lastSeq, hasLastSeq, err
+}
+
+// open starts the session of a new connection to chatRoom. The session
+// named by token is resumed, whether parked or still held by a connection
+// the server has not seen drop yet, which is then closed: the client takes
+// over its identity and the session's acked is where the replay starts.
+// Otherwise a new session starts at the room's latest message.
+func (rs *resumeStore) open(token string, chatRoom *room.Room, client *room.Client) (sess *resumeSession, resumed bool) {
+	if token != "" {
+		sess, previous, result := rs.takeOver(token, chatRoom, client)
+		metrics.Resumptions.Inc(result)
+		if sess != nil {
+			client.Restore(&previous.Identity)
+			if result == "replaced" {
+				previous.CloseWithError(model.ErrorSessionReplaced, "session resumed by another connection")
+			}
+			return sess, true
+		}
+		client.Log().Info("session not resumed", "reason", result)
+	}
+
+	sess = &resumeSession{token: newResumeToken(), roomId: chatRoom.ID, client: client}
+	if stats, err := chatRoom.History(); err == nil {
+		sess.acked.Store(stats.LastSeq)
+	}
+	return sess, false
+}
+
+// takeOver hands the session token of chatRoom to client and returns it
+// with the connection that held it before. result is "resumed" for a parked
+// session, "replaced" for one whose connection is still open, or why the
+// session could not be resumed.
+func (rs *resumeStore) takeOver(token string, chatRoom *room.Room, client *room.Client) (sess *resumeSession, previous *room.Client, result string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	sess, ok := rs.sessions[token]
+	if !ok || sess.roomId != chatRoom.ID || (sess.parked && time.Now().After(sess.expires)) {
+		return nil, nil, "unknown"
+	}
+	if chatRoom.Banned(sess.client.UserId()) {
+		return nil, nil, "banned"
+	}
+	previous, result = sess.client, "replaced"
+	if sess.parked {
+		metrics.ResumableSessions.Dec()
+		result = "resumed"
+	}
+	sess.client, sess.parked = client, false
+	return sess, previous, result
+}
+
+// track registers the session of a connection that negotiated history so
+// that it can be resumed
+func (rs *resumeStore) track(sess *resumeSession) {
+	rs.mu.Lock()
+	rs.sessions[sess.token] = sess
+	rs.mu.Unlock()
+}
+
+// park keeps the session of client's dropped connection resumable for the
+// window, unless another connection has taken it over
+func (rs *resumeStore) park(sess *resumeSession, client *room.Client) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if sess.client != client || sess.parked {
+		return
+	}
+	sess.parked = true
+	sess.expires = time.Now().Add(rs.window)
+	metrics.ResumableSessions.Inc()
+}
+
+// end forgets the session of client's connection, which left the room, was
+// removed from it or did not negotiate history
+func (rs *resumeStore) end(sess *resumeSession, client *room.Client) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if sess.client == client && !sess.parked {
+		delete(rs.sessions, sess.token)
+	}
+}
+
+// expireLoop drops parked sessions whose window has passed
+func (rs *resumeStore) expireLoop() {
+	ticker := time.NewTicker(rs.window / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		rs.mu.Lock()
+		for token, sess := range rs.sessions {
+			if sess.parked && now.After(sess.expires) {
+				delete(rs.sessions, token)
+				metrics.ResumableSessions.Dec()
+			}
+		}
+		rs.mu.Unlock()
+	}
+}
+
+// decodeAck reads an ACK frame; other frames return false
+func decodeAck(client *room.Client, data []byte) (model.Ack, bool) {
+	var ack model.Ack
+	if client.Codec.Unmarshal(data, &ack) != nil || ack.Type != model.ControlTypeAck {
+		return model.Ack{}, false
+	}
+	return ack, true
+}
+
+// leftRoom reports whether the client has left the room after response.
+// The last message accepted decides, so a LEAVE followed by more messages
+// on the same connection does not end the session.
+func leftRoom(left bool, response interface{}) bool {
+	switch r := response.(type) {
+	case model.ServerResponse:
+		if r.Status == model.StatusOK {
+			left = r.MessageType == model.MessageTypeLeave
+		}
+	case []model.ServerResponse:
+		for _, item := range r {
+			if item.Status == model.StatusOK {
+				left = item.MessageType == model.MessageTypeLeave
+			}
+		}
+	}
+	return left
+}
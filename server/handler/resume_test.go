@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/model"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// resumeServer runs a test server with session resumption
+func resumeServer(t *testing.T) (*testServer, *admission.Controller) {
+	t.Helper()
+	setResumeWindow(t, time.Minute)
+	admit := admission.NewController(admission.Limits{})
+	s := newTestServer(t, admit)
+	// The handlers must be done with their sessions before resumption is reset
+	t.Cleanup(func() {
+		waitFor(t, "the connections to end", func() bool { return admit.Total() == 0 })
+	})
+	return s, admit
+}
+
+// openSession connects as alice with history, sends one message and
+// returns the session's resume token and the message's sequence number
+func (s *testServer) openSession(t *testing.T) (*websocket.Conn, string, uint64) {
+	t.Helper()
+	conn := s.dial(t, "/chat/7")
+	welcome := hello(t, conn, model.ProtocolVersion, model.FeatureAcks, model.FeatureHistory)
+	send(t, conn, textMessage("1", "alice", "hi"))
+	if resp := readResponse(t, conn); resp.Status != model.StatusOK {
+		t.Fatalf("response %+v", resp)
+	}
+	msgs, _ := s.history.Since("7", 0, 0)
+	return conn, welcome.ResumeToken, msgs[len(msgs)-1].Seq
+}
+
+// waitParked waits until the session of token is parked
+func waitParked(t *testing.T, token string) {
+	t.Helper()
+	waitFor(t, "the session to be parked", func() bool {
+		resumption.mu.Lock()
+		defer resumption.mu.Unlock()
+		sess, ok := resumption.sessions[token]
+		return ok && sess.parked
+	})
+}
+
+func resumePath(token string, lastSeq uint64) string {
+	q := url.Values{"resume": {token}}
+	if lastSeq > 0 {
+		q.Set("lastSeq", strconv.FormatUint(lastSeq, 10))
+	}
+	return "/chat/7?" + q.Encode()
+}
+
+func expectReplay(t *testing.T, conn *websocket.Conn, texts ...string) {
+	t.Helper()
+	for _, text := range texts {
+		if resp := readResponse(t, conn); resp.Status != model.StatusBroadcast || resp.Message.Message != text {
+			t.Fatalf("got %+v, want replay of %q", resp, text)
+		}
+	}
+}
+
+func TestResumeReplaysMissedMessages(t *testing.T) {
+	s, _ := resumeServer(t)
+	conn, token, seq := s.openSession(t)
+	conn.Close()
+	waitParked(t, token)
+
+	s.publish(t, "7", "missed1")
+	s.publish(t, "7", "missed2")
+
+	conn = s.dial(t, resumePath(token, seq))
+	expectReplay(t, conn, "missed1", "missed2")
+	welcome := hello(t, conn, model.ProtocolVersion, model.FeatureAcks, model.FeatureHistory)
+	if !welcome.Resumed || welcome.ResumeToken != token {
+		t.Fatalf("welcome %+v", welcome)
+	}
+	conn.Close()
+}
+
+func TestResumeFromAck(t *testing.T) {
+	s, _ := resumeServer(t)
+	conn, token, _ := s.openSession(t)
+	acked := s.publish(t, "7", "seen")
+	readResponse(t, conn)
+	send(t, conn, model.Ack{Type: model.ControlTypeAck, Seq: acked})
+	s.publish(t, "7", "unseen")
+	readResponse(t, conn)
+	conn.Close()
+	waitParked(t, token)
+
+	// Without lastSeq the replay starts after the acknowledged message
+	conn = s.dial(t, resumePath(token, 0))
+	expectReplay(t, conn, "unseen")
+	conn.Close()
+}
+
+func TestResumeUnknownToken(t *testing.T) {
+	s, _ := resumeServer(t)
+	conn := s.dial(t, resumePath("0123456789abcdef", 0))
+	welcome := hello(t, conn, model.ProtocolVersion, model.FeatureHistory)
+	if welcome.Resumed || welcome.ResumeToken == "" || welcome.ResumeToken == "0123456789abcdef" {
+		t.Fatalf("welcome %+v", welcome)
+	}
+	conn.Close()
+}
+
+func TestLeaveEndsSession(t *testing.T) {
+	s, _ := resumeServer(t)
+	conn, token, _ := s.openSession(t)
+	leave := textMessage("1", "alice", "bye")
+	leave.MessageType = model.MessageTypeLeave
+	send(t, conn, leave)
+	readResponse(t, conn)
+	conn.Close()
+
+	waitFor(t, "the session to end", func() bool {
+		resumption.mu.Lock()
+		defer resumption.mu.Unlock()
+		_, ok := resumption.sessions[token]
+		return !ok
+	})
+	conn = s.dial(t, resumePath(token, 0))
+	if welcome := hello(t, conn, model.ProtocolVersion, model.FeatureHistory); welcome.Resumed {
+		t.Fatalf("welcome %+v", welcome)
+	}
+	conn.Close()
+}
+
+func TestResumeReplacesOpenConnection(t *testing.T) {
+	s, _ := resumeServer(t)
+	old, token, _ := s.openSession(t)
+
+	conn := s.dial(t, resumePath(token, 0))
+	expectClose(t, old, websocket.CloseNormalClosure)
+	// Nothing was acknowledged, so the replay starts where the session did
+	expectReplay(t, conn, "hi")
+	if welcome := hello(t, conn, model.ProtocolVersion, model.FeatureHistory); !welcome.Resumed {
+		t.Fatalf("welcome %+v", welcome)
+	}
+	conn.Close()
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"chatroom/server/metrics"
+	"chatroom/server/room"
+	"chatroom/server/store"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RoomInfo is a room's metadata
+type RoomInfo struct {
+	RoomId    string          `json:"roomId"`
+	NodeId    string          `json:"nodeId"`
+	Topic     string          `json:"topic,omitempty"`
+	Members   int             `json:"members"`
+	Retention store.Retention `json:"retention"`
+	History   store.Stats     `json:"history"`
+}
+
+func roomInfo(manager *room.Manager, chatRoom *room.Room) (RoomInfo, error) {
+	history, err := chatRoom.History()
+	return RoomInfo{
+		RoomId:    chatRoom.ID,
+		NodeId:    manager.NodeID(),
+		Topic:     chatRoom.Topic(),
+		Members:   len(chatRoom.Members()),
+		Retention: chatRoom.Retention(),
+		History:   history,
+	}, err
+}
+
+// HandleRoomInfo returns the metadata of a room that exists on this node
+func HandleRoomInfo(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+
+		if redirectRoomOwner(w, r, manager, roomId) {
+			return
+		}
+
+		chatRoom, ok := manager.Room(roomId)
+		if !ok {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		info, err := roomInfo(manager, chatRoom)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// HandleSetRetention sets a room's retention from a JSON body such as
+// {"policy":"messages","messages":500}, {"policy":"age","maxAge":"24h"} or
+// {"policy":"forever"}. The compactor applies it on its next run.
+func HandleSetRetention(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+		if redirectRoomOwner(w, r, manager, roomId) {
+			return
+		}
+
+		var keep store.Retention
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostBody)).Decode(&keep); err != nil {
+			http.Error(w, "body must be a JSON retention policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		chatRoom := manager.GetRoom(roomId)
+		chatRoom.SetRetention(keep)
+		slog.Info("room retention changed", "roomId", roomId, "retention", keep.String())
+
+		info, err := roomInfo(manager, chatRoom)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// HandleListRooms returns the metadata of every room on this node
+func HandleListRooms(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rooms := manager.RoomList()
+		infos := make([]RoomInfo, 0, len(rooms))
+		for _, chatRoom := range rooms {
+			info, err := roomInfo(manager, chatRoom)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			infos = append(infos, info)
+		}
+		writeJSON(w, http.StatusOK, infos)
+	}
+}
+
+// redirectRoomOwner sends a request for a room another node owns to that
+// node with a 307, which keeps the method and body, and reports whether it
+// did
+func redirectRoomOwner(w http.ResponseWriter, r *http.Request, manager *room.Manager, roomId string) bool {
+	owner, local := manager.Owner(roomId)
+	if local {
+		return false
+	}
+	metrics.Redirects.Inc(RedirectHTTP)
+	http.Redirect(w, r, owner.HTTPURL(r.URL.RequestURI()), http.StatusTemporaryRedirect)
+	return true
+}
+
+// adminRoom returns the room of an admin request, redirecting to the
+// room's owner and answering 404 when it does not exist on this node
+func adminRoom(w http.ResponseWriter, r *http.Request, manager *room.Manager) (*room.Room, bool) {
+	roomId := mux.Vars(r)["roomId"]
+	if redirectRoomOwner(w, r, manager, roomId) {
+		return nil, false
+	}
+	chatRoom, ok := manager.Room(roomId)
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+	}
+	return chatRoom, ok
+}
+
+// HandleRoster lists the connections in a room on this node
+func HandleRoster(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatRoom, ok := adminRoom(w, r, manager)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, chatRoom.Members())
+	}
+}
+
+// ModerationRequest names the user to kick or ban. Duration, e.g. "1h",
+// makes a ban temporary.
+type ModerationRequest struct {
+	UserId   string `json:"userId"`
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// ModerationResult reports what a kick or ban did
+type ModerationResult struct {
+	RoomId string    `json:"roomId"`
+	UserId string    `json:"userId"`
+	Kicked int       `json:"kicked"` // connections closed on this node
+	Ban    *room.Ban `json:"ban,omitempty"`
+}
+
+func decodeModeration(w http.ResponseWriter, r *http.Request) (ModerationRequest, bool) {
+	var req ModerationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostBody)).Decode(&req); err != nil || req.UserId == "" {
+		http.Error(w, "body must be JSON with a userId", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// HandleKick closes every connection of a user in a room. The user may
+// reconnect; ban them to keep them out.
+func HandleKick(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatRoom, ok := adminRoom(w, r, manager)
+		if !ok {
+			return
+		}
+		req, ok := decodeModeration(w, r)
+		if !ok {
+			return
+		}
+		reason := req.Reason
+		if reason == "" {
+			reason = "kicked"
+		}
+
+		kicked := chatRoom.Kick(req.UserId, reason)
+		slog.Info("user kicked", "roomId", chatRoom.ID, "userId", req.UserId, "connections", kicked)
+		writeJSON(w, http.StatusOK, ModerationResult{RoomId: chatRoom.ID, UserId: req.UserId, Kicked: kicked})
+	}
+}
+
+// HandleListBans lists a room's bans
+func HandleListBans(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatRoom, ok := adminRoom(w, r, manager)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, chatRoom.Bans())
+	}
+}
+
+// HandleBan bans a user from a room, creating the room if needed so users
+// can be banned before they arrive
+func HandleBan(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+		if redirectRoomOwner(w, r, manager, roomId) {
+			return
+		}
+		req, ok := decodeModeration(w, r)
+		if !ok {
+			return
+		}
+		var until time.Time
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				http.Error(w, "duration must be a positive duration such as 30m or 24h", http.StatusBadRequest)
+				return
+			}
+			until = time.Now().Add(d)
+		}
+
+		chatRoom := manager.GetRoom(roomId)
+		kicked := chatRoom.Ban(req.UserId, req.Reason, until)
+		slog.Info("user banned", "roomId", chatRoom.ID, "userId", req.UserId, "duration", req.Duration, "connections", kicked)
+
+		result := ModerationResult{RoomId: chatRoom.ID, UserId: req.UserId, Kicked: kicked}
+		for _, ban := range chatRoom.Bans() {
+			if ban.UserId == req.UserId {
+				result.Ban = &ban
+			}
+		}
+		writeJSON(w, http.StatusCreated, result)
+	}
+}
+
+// HandleUnban lifts a ban
+func HandleUnban(manager *room.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chatRoom, ok := adminRoom(w, r, manager)
+		if !ok {
+			return
+		}
+		userId := mux.Vars(r)["userId"]
+		if !chatRoom.Unban(userId) {
+			http.Error(w, "User is not banned", http.StatusNotFound)
+			return
+		}
+		slog.Info("user unbanned", "roomId", chatRoom.ID, "userId", userId)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"chatroom/server/metrics"
+	"chatroom/server/room"
+	"chatroom/server/search"
+	"chatroom/server/store"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchResponse is the body returned by a search
+type SearchResponse struct {
+	RoomId string `json:"roomId"`
+	Query  string `json:"query"`
+	search.Result
+}
+
+// HandleSearch searches the room's retained history. Query parameters:
+// q (words and "quoted phrases", all required), user, from and to
+// (RFC 3339, on the server timestamp), limit and before (the next value of
+// the previous page).
+func HandleSearch(manager *room.Manager, index *search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+
+		if owner, local := manager.Owner(roomId); !local {
+			metrics.Redirects.Inc(RedirectHTTP)
+			http.Redirect(w, r, owner.HTTPURL(r.URL.RequestURI()), http.StatusTemporaryRedirect)
+			return
+		}
+
+		params := r.URL.Query()
+		q := search.ParseQuery(params.Get("q"))
+		if q.Empty() {
+			http.Error(w, "q must contain at least one word", http.StatusBadRequest)
+			return
+		}
+		q.Username = params.Get("user")
+
+		var err error
+		if q.From, err = parseTimeParam(params.Get("from")); err != nil {
+			http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		if q.To, err = parseTimeParam(params.Get("to")); err != nil {
+			http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+
+		q.Limit = defaultSearchLimit
+		if v := params.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxSearchLimit {
+				http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+				return
+			}
+			q.Limit = limit
+		}
+		if v := params.Get("before"); v != "" {
+			before, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "before must be a message sequence number", http.StatusBadRequest)
+				return
+			}
+			q.Before = before
+		}
+
+		metrics.SearchQueries.Inc()
+		writeJSON(w, http.StatusOK, SearchResponse{
+			RoomId: roomId,
+			Query:  params.Get("q"),
+			Result: index.Search(roomId, q),
+		})
+	}
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// HandleRebuildSearch rebuilds the search index of ?roomId= from the
+// history store, or of every indexed and active room without it
+func HandleRebuildSearch(manager *room.Manager, index *search.Index, history store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var roomIds []string
+		if roomId := r.URL.Query().Get("roomId"); roomId != "" {
+			roomIds = []string{roomId}
+		} else {
+			seen := make(map[string]bool)
+			for _, roomId := range index.Rooms() {
+				seen[roomId] = true
+				roomIds = append(roomIds, roomId)
+			}
+			for _, rm := range manager.RoomList() {
+				if !seen[rm.ID] {
+					roomIds = append(roomIds, rm.ID)
+				}
+			}
+		}
+
+		indexed := make(map[string]int, len(roomIds))
+		for _, roomId := range roomIds {
+			n, err := index.Rebuild(roomId, history)
+			if err != nil {
+				http.Error(w, "rebuilding "+roomId+": "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			indexed[roomId] = n
+		}
+		slog.Info("search index rebuilt", "rooms", len(indexed))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"indexed": indexed})
+	}
+}
@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"chatroom/server/store"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sseQueueSize buffers broadcasts for one stream; a stream that falls
+// further behind is ended and the client resumes from the history
+const sseQueueSize = 256
+
+// sseRetryMs is the reconnect delay suggested to EventSource clients
+const sseRetryMs = 3000
+
+var sseHeartbeat = 15 * time.Second
+
+// SetSSEHeartbeat sets how often idle event streams get a comment line,
+// which keeps proxies from timing them out
+func SetSSEHeartbeat(d time.Duration) {
+	sseHeartbeat = d
+}
+
+// sseSubscriber queues a room's broadcasts for one event stream
+type sseSubscriber struct {
+	queue    chan model.ServerResponse
+	overflow chan struct{}
+	once     sync.Once
+
+	drained      chan struct{} // closed when the node drains
+	drainOnce    sync.Once
+	retryAfterMs int64 // set before drained is closed
+}
+
+func newSSESubscriber() *sseSubscriber {
+	return &sseSubscriber{
+		queue:    make(chan model.ServerResponse, sseQueueSize),
+		overflow: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+}
+
+func (s *sseSubscriber) ConnID() string {
+	return ""
+}
+
+func (s *sseSubscriber) Transport() string {
+	return "sse"
+}
+
+func (s *sseSubscriber) Deliver(msg model.ServerResponse) bool {
+	select {
+	case s.queue <- msg:
+		return true
+	default:
+		s.once.Do(func() { close(s.overflow) })
+		return false
+	}
+}
+
+// Drain ends the stream after a reconnect event, see room.Drainer
+func (s *sseSubscriber) Drain(retryAfterMs int64) {
+	s.drainOnce.Do(func() {
+		s.retryAfterMs = retryAfterMs
+		close(s.drained)
+	})
+}
+
+// lastEventID reads the sequence to resume after from the Last-Event-ID
+// header, or the lastEventId query parameter for clients that cannot set it
+func lastEventID(r *http.Request) (uint64, bool, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("lastEventId")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	return seq, true, err
+}
+
+func writeEvent(w io.Writer, msg model.ServerResponse) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", msg.Seq, data)
+	return err
+}
+
+// writeReconnect tells the client to reconnect in retryAfterMs, through the
+// retry field for EventSource and a reconnect event for other readers
+func writeReconnect(w io.Writer, retryAfterMs int64) error {
+	data, err := json.Marshal(model.ControlMessage{
+		Type:         model.ControlTypeReconnect,
+		Reason:       "server draining",
+		RetryAfterMs: retryAfterMs,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "retry: %d\nevent: reconnect\ndata: %s\n\n", retryAfterMs, data)
+	return err
+}
+
+// HandleEvents streams the broadcasts of a room as Server-Sent Events.
+// Each event's id is the message's sequence number; a client reconnecting
+// with Last-Event-ID first gets the retained messages it missed, as far
+// back as historyAccess allows.
+func HandleEvents(manager *room.Manager, admit *admission.Controller, history store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId := mux.Vars(r)["roomId"]
+
+		if manager.Draining() {
+			w.Header().Set("Retry-After", drainRetryAfter)
+			http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+			return
+		}
+		if owner, local := manager.Owner(roomId); !local {
+			metrics.Redirects.Inc(RedirectHTTP)
+			http.Redirect(w, r, owner.HTTPURL(r.URL.RequestURI()), http.StatusTemporaryRedirect)
+			return
+		}
+
+		after, resume, err := lastEventID(r)
+		if err != nil {
+			http.Error(w, "Last-Event-ID must be a message sequence number", http.StatusBadRequest)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		release, err := admit.Acquire(clientIP(r), roomId)
+		if err != nil {
+			rejectAdmission(w, err)
+			return
+		}
+		defer release()
+
+		// The server's WriteTimeout would otherwise end the stream
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			slog.Warn("cannot clear write deadline for event stream", "err", err)
+		}
+
+		// Subscribe before reading the history so nothing falls in between;
+		// the overlap is skipped by sequence number below
+		chatRoom := manager.GetRoom(roomId)
+		sub := newSSESubscriber()
+		chatRoom.AddSubscriber(sub)
+		defer chatRoom.RemoveSubscriber(sub)
+
+		metrics.SSESubscribers.Inc()
+		defer metrics.SSESubscribers.Dec()
+
+		log := slog.With("roomId", roomId, "remoteAddr", r.RemoteAddr, "transport", "sse")
+		log.Info("event stream opened", "lastEventId", after)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering (nginx)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", sseRetryMs)
+
+		// send writes msg unless the stream already carried it
+		send := func(msg model.ServerResponse) error {
+			if msg.Seq != 0 && msg.Seq <= after {
+				return nil
+			}
+			after = msg.Seq
+			return writeEvent(w, msg)
+		}
+
+		if resume {
+			missed, _, err := catchUp(r, history, roomId, after, 0)
+			if err != nil {
+				log.Warn("history read failed", "err", err)
+			}
+			for _, msg := range missed {
+				if err := send(msg); err != nil {
+					return
+				}
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case msg := <-sub.queue:
+				err := send(msg)
+				// Write whatever else is queued before flushing
+				for pending := len(sub.queue); pending > 0 && err == nil; pending-- {
+					err = send(<-sub.queue)
+				}
+				if err != nil {
+					log.Info("event stream closed", "err", err)
+					return
+				}
+				flusher.Flush()
+			case <-heartbeat.C:
+				if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-sub.overflow:
+				log.Warn("ending slow event stream")
+				return
+			case <-sub.drained:
+				log.Debug("asking event stream to reconnect", "retryAfterMs", sub.retryAfterMs)
+				writeReconnect(w, sub.retryAfterMs)
+				flusher.Flush()
+				return
+			case <-r.Context().Done():
+				log.Info("event stream closed")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"bufio"
+	"chatroom/server/admission"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// event is one parsed Server-Sent Event
+type event struct {
+	id, name, data, retry string
+}
+
+// eventStream reads the events of an open stream
+type eventStream struct {
+	resp   *http.Response
+	events chan event
+}
+
+// openEvents opens the event stream at path with the given Last-Event-ID
+func (s *testServer) openEvents(t *testing.T, path, lastEventId string) *eventStream {
+	t.Helper()
+	req, err := http.NewRequest("GET", s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	return streamEvents(t, req)
+}
+
+// streamEvents sends req and reads its response as an event stream
+func streamEvents(t *testing.T, req *http.Request) *eventStream {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	stream := &eventStream{resp: resp, events: make(chan event, 64)}
+	go func() {
+		defer close(stream.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev event
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch field {
+			case "id":
+				ev.id = value
+			case "event":
+				ev.name = value
+			case "data":
+				ev.data = value
+			case "retry":
+				ev.retry = value
+			case "":
+				if ev != (event{}) {
+					stream.events <- ev
+				}
+				ev = event{}
+			}
+		}
+	}()
+	return stream
+}
+
+// next returns the next event other than a bare retry field
+func (es *eventStream) next(t *testing.T) event {
+	t.Helper()
+	for {
+		select {
+		case ev, ok := <-es.events:
+			if !ok {
+				t.Fatal("event stream ended")
+			}
+			if ev.name == "" && ev.data == "" {
+				continue
+			}
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event")
+		}
+	}
+}
+
+// expectEnd waits for the server to end the stream
+func (es *eventStream) expectEnd(t *testing.T) {
+	t.Helper()
+	select {
+	case ev, ok := <-es.events:
+		if ok {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event stream not ended")
+	}
+}
+
+// publish sends text to roomId as a websocket client would and waits
+// until it is in the history
+func (s *testServer) publish(t *testing.T, roomId, text string) uint64 {
+	t.Helper()
+	chatRoom := s.manager.GetRoom(roomId)
+	before, _ := s.history.Since(roomId, 0, 0)
+	if err := chatRoom.Publish("", model.ServerResponse{
+		Message:         textMessage("1", "alice", text),
+		Status:          model.StatusOK,
+		ServerTimestamp: time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var seq uint64
+	waitFor(t, "the message to be recorded", func() bool {
+		msgs, _ := s.history.Since(roomId, 0, 0)
+		if len(msgs) == len(before) {
+			return false
+		}
+		seq = msgs[len(msgs)-1].Seq
+		return true
+	})
+	return seq
+}
+
+func expectMessage(t *testing.T, ev event, text string) {
+	t.Helper()
+	var msg model.ServerResponse
+	if err := json.Unmarshal([]byte(ev.data), &msg); err != nil {
+		t.Fatalf("event %+v: %v", ev, err)
+	}
+	if ev.name != "message" || msg.Message.Message != text || ev.id != strconv.FormatUint(msg.Seq, 10) {
+		t.Fatalf("got event %+v, want message %q", ev, text)
+	}
+}
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	first := s.publish(t, "7", "one")
+	s.publish(t, "7", "two")
+	s.publish(t, "7", "three")
+
+	stream := s.openEvents(t, "/rooms/7/events", strconv.FormatUint(first, 10))
+	if ct := stream.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	expectMessage(t, stream.next(t), "two")
+	expectMessage(t, stream.next(t), "three")
+
+	s.publish(t, "7", "four")
+	expectMessage(t, stream.next(t), "four")
+}
+
+func TestEventsWithoutLastEventIDStreamLiveOnly(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	s.publish(t, "7", "old")
+
+	stream := s.openEvents(t, "/rooms/7/events", "")
+	waitFor(t, "the subscription", func() bool { return len(s.manager.GetRoom("7").Members()) == 1 })
+	s.publish(t, "7", "new")
+	expectMessage(t, stream.next(t), "new")
+}
+
+func TestEventsQueryParameter(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	first := s.publish(t, "7", "one")
+	s.publish(t, "7", "two")
+
+	stream := s.openEvents(t, "/rooms/7/events?lastEventId="+strconv.FormatUint(first, 10), "")
+	expectMessage(t, stream.next(t), "two")
+
+	if resp := s.openEvents(t, "/rooms/7/events", "abc").resp; resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid Last-Event-ID: status %d", resp.StatusCode)
+	}
+}
+
+func TestDrainEndsEventStreams(t *testing.T) {
+	s := newTestServer(t, admission.NewController(admission.Limits{}))
+	stream := s.openEvents(t, "/rooms/7/events", "")
+	s.dial(t, "/chat/7")
+	waitFor(t, "both members", func() bool { return len(s.manager.GetRoom("7").Members()) == 2 })
+
+	if _, err := s.manager.StartDrain(room.DrainOptions{Waves: 1, Interval: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	ev := stream.next(t)
+	var control model.ControlMessage
+	if err := json.Unmarshal([]byte(ev.data), &control); err != nil || ev.name != "reconnect" ||
+		control.Type != model.ControlTypeReconnect || ev.retry != strconv.FormatInt(control.RetryAfterMs, 10) {
+		t.Fatalf("got event %+v", ev)
+	}
+	stream.expectEnd(t)
+
+	waitFor(t, "the drain", func() bool { return s.manager.DrainStatus().State == room.DrainStateDrained })
+	if status := s.manager.DrainStatus(); status.TotalClients != 2 || status.ClientsClosed != 2 {
+		t.Fatalf("drain status %+v, want 2 clients", status)
+	}
+	if resp := s.openEvents(t, "/rooms/7/events", "").resp; resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("stream opened while draining: status %d", resp.StatusCode)
+	}
+}
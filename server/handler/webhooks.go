@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"chatroom/server/model"
+	"chatroom/server/webhook"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var webhooks *webhook.Dispatcher
+
+// SetWebhooks sends accepted messages to d as webhook events
+func SetWebhooks(d *webhook.Dispatcher) {
+	webhooks = d
+}
+
+// emitMessageEvent queues the webhook event for an accepted message
+func emitMessageEvent(roomId string, response model.ServerResponse) {
+	eventType := webhook.EventMessageAccepted
+	switch response.MessageType {
+	case model.MessageTypeJoin:
+		eventType = webhook.EventUserJoined
+	case model.MessageTypeLeave:
+		eventType = webhook.EventUserLeft
+	}
+	webhooks.Emit(eventType, roomId, &response)
+}
+
+// HandleListWebhooks returns the registered hooks, without secrets
+func HandleListWebhooks(d *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Hooks())
+	}
+}
+
+// HandleCreateWebhook registers the hook in the body, e.g.
+// {"url":"https://ci.example.com/hook","roomId":"dev","events":["message.accepted"]}.
+// The response is the only place a generated secret is shown.
+func HandleCreateWebhook(d *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var hook webhook.Hook
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostBody)).Decode(&hook); err != nil {
+			http.Error(w, "body must be a JSON webhook", http.StatusBadRequest)
+			return
+		}
+		hook, err := d.Register(hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, hook)
+	}
+}
+
+// HandleDeleteWebhook removes a hook
+func HandleDeleteWebhook(d *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !d.Unregister(mux.Vars(r)["hookId"]) {
+			http.Error(w, "Unknown webhook", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleWebhookDeliveries returns the latest delivery attempts, newest
+// first. Optional query parameters: hook (a hook ID) and limit (default 100).
+func HandleWebhookDeliveries(d *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		deliveries := d.Deliveries(r.URL.Query().Get("hook"), limit)
+		if deliveries == nil {
+			deliveries = []webhook.Delivery{}
+		}
+		writeJSON(w, http.StatusOK, deliveries)
+	}
+}
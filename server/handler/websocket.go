@@ -1,13 +1,18 @@
 package handler
 
 import (
+	"chatroom/codec"
+	"chatroom/server/admission"
+	"chatroom/server/cluster"
+	"chatroom/server/metrics"
 	"chatroom/server/model"
 	"chatroom/server/room"
-	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"math"
 	"net/http"
-	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,47 +22,131 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    codec.Protocols,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
-var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9]{3,20}$`)
+// CompressionOptions configures permessage-deflate (RFC 7692)
+type CompressionOptions struct {
+	Enabled bool
+	Level   int // flate level, 1 (best speed) to 9 (best compression)
+	MinSize int // frames smaller than this many bytes are sent uncompressed
+}
+
+var compression CompressionOptions
+
+// SetCompression enables negotiation of permessage-deflate on new upgrades
+func SetCompression(opts CompressionOptions) {
+	compression = opts
+	upgrader.EnableCompression = opts.Enabled
+}
+
+// compressionNegotiated reports whether the upgrade for r will use permessage-deflate
+func compressionNegotiated(r *http.Request) bool {
+	if !compression.Enabled {
+		return false
+	}
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// Ways of sending a client to the node that owns its room
+const (
+	RedirectHTTP  = "http"  // 307 Temporary Redirect instead of the upgrade
+	RedirectFrame = "frame" // upgrade, send a REDIRECT control frame, close
+)
 
-func validateMessage(msg *model.Message) string {
-	// userId validation
-	uid, err := strconv.Atoi(msg.UserId)
-	if err != nil || uid < 1 || uid > 100000 {
-		return "userId must be between 1 and 100000"
+var redirectMode = RedirectHTTP
+
+// SetRedirectMode selects how upgrades for rooms owned by another node are answered
+func SetRedirectMode(mode string) {
+	redirectMode = mode
+}
+
+// redirectToOwner sends the upgrade request r for roomId to owner
+func redirectToOwner(w http.ResponseWriter, r *http.Request, owner cluster.Member, roomId string) {
+	if redirectMode == RedirectHTTP {
+		metrics.Redirects.Inc(RedirectHTTP)
+		target := room.RedirectURL(owner, roomId)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		return
 	}
 
-	// username validation
-	if !usernameRegex.MatchString(msg.Username) {
-		return "username must be 3-20 alphanumeric characters"
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		metrics.UpgradeFailures.Inc("handshake")
+		return
 	}
+	metrics.Redirects.Inc(RedirectFrame)
+	cdc, _ := codec.ForProtocol(conn.Subprotocol())
+	client := room.NewClient(conn, cdc, room.NewConnID(), slog.With("roomId", roomId, "remoteAddr", r.RemoteAddr))
+	room.RedirectClient(client, owner, roomId)
+}
+
+// drainRetryAfter is the Retry-After (seconds) sent to upgrades rejected while draining
+const drainRetryAfter = "5"
 
-	// message validation
-	if len(msg.Message) < 1 || len(msg.Message) > 500 {
-		return "message must be 1-500 characters"
+// admissionRetryAfter is the Retry-After (seconds) sent to upgrades over a connection limit
+const admissionRetryAfter = "1"
+
+// invalidFormat is the error for a frame the connection's codec can't decode
+func invalidFormat(cdc codec.Codec) (code, errStr string) {
+	if cdc == codec.JSON {
+		return model.ErrorInvalidJSON, "Invalid JSON format"
 	}
+	return model.ErrorInvalidFormat, "Invalid message format"
+}
 
-	// timestamp validation (checked implicitly by unmarshal, but ensure it's not zero)
-	if msg.Timestamp.IsZero() {
-		return "timestamp is invalid"
+// errorResponse rejects msg, which is nil for a frame that did not decode
+func errorResponse(msg *model.Message, code, errStr string) model.ServerResponse {
+	response := model.ServerResponse{
+		Status:          model.StatusError,
+		Error:           errStr,
+		Code:            code,
+		ServerTimestamp: time.Now(),
+	}
+	if msg != nil {
+		response.Message = *msg
 	}
+	return response
+}
 
-	// messageType validation
-	switch msg.MessageType {
-	case model.MessageTypeText, model.MessageTypeJoin, model.MessageTypeLeave:
-		// valid
-	default:
-		return "invalid messageType"
+// rejectAdmission answers an upgrade that is over a connection limit or
+// comes from a banned address
+func rejectAdmission(w http.ResponseWriter, err error) {
+	var banned *admission.BannedError
+	if errors.As(err, &banned) {
+		metrics.UpgradeFailures.Inc("ip_banned")
+		retry := math.Ceil(time.Until(banned.Until).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(retry), 1)))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
 
-	return ""
+	status := http.StatusServiceUnavailable
+	switch err {
+	case admission.ErrServerFull:
+		metrics.UpgradeFailures.Inc("server_full")
+	case admission.ErrRoomFull:
+		metrics.UpgradeFailures.Inc("room_full")
+	case admission.ErrTooManyFromIP:
+		metrics.UpgradeFailures.Inc("ip_limit")
+		status = http.StatusTooManyRequests
+	}
+	w.Header().Set("Retry-After", admissionRetryAfter)
+	http.Error(w, err.Error(), status)
 }
 
-func HandleWebSocket(manager *room.Manager) http.HandlerFunc {
+func HandleWebSocket(manager *room.Manager, admit *admission.Controller) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		roomId := vars["roomId"]
@@ -67,61 +156,257 @@ func HandleWebSocket(manager *room.Manager) http.HandlerFunc {
 			return
 		}
 
+		if manager.Draining() {
+			metrics.UpgradeFailures.Inc("draining")
+			w.Header().Set("Retry-After", drainRetryAfter)
+			http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+			return
+		}
+
+		if owner, local := manager.Owner(roomId); !local {
+			redirectToOwner(w, r, owner, roomId)
+			return
+		}
+
+		moderator, ok := authenticateModerator(w, r, roomId)
+		if !ok {
+			return
+		}
+
+		resumeToken, lastSeq, hasLastSeq, err := resumeParams(r)
+		if err != nil {
+			http.Error(w, "lastSeq must be a message sequence number", http.StatusBadRequest)
+			return
+		}
+
+		ip := clientIP(r)
+		release, err := admit.Acquire(ip, roomId)
+		if err != nil {
+			rejectAdmission(w, err)
+			return
+		}
+		defer release()
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println("Upgrade error:", err)
+			slog.Warn("upgrade failed", "roomId", roomId, "remoteAddr", r.RemoteAddr, "err", err)
+			metrics.UpgradeFailures.Inc("handshake")
 			return
 		}
+		if abuse.MaxFrameBytes > 0 {
+			conn.SetReadLimit(abuse.MaxFrameBytes)
+		}
+		metrics.ActiveConnections.Inc()
+		defer metrics.ActiveConnections.Dec()
+
+		compressed := compressionNegotiated(r)
+		if compressed {
+			if err := conn.SetCompressionLevel(compression.Level); err != nil {
+				slog.Warn("invalid compression level", "level", compression.Level, "err", err)
+			}
+		}
 
-		room := manager.GetRoom(roomId)
-		room.Register <- conn
+		// The upgrader only negotiates subprotocols from codec.Protocols
+		cdc, _ := codec.ForProtocol(conn.Subprotocol())
+
+		client := room.NewClient(conn, cdc, room.NewConnID(), slog.With("roomId", roomId, "remoteAddr", r.RemoteAddr))
+		client.CompressMinSize = compression.MinSize
+		if moderator != "" {
+			client.SetModerator(moderator)
+			client.Log().Info("moderator connected", "moderator", moderator)
+		}
+		client.Log().Info("connection opened", "compression", compressed, "codec", cdc.Name())
+		defer client.Stop()
+
+		chatRoom := manager.GetRoom(roomId)
+		var sess *resumeSession
+		resumed := false
+		if resumption != nil {
+			sess, resumed = resumption.open(resumeToken, chatRoom, client)
+			if hasLastSeq {
+				sess.acked.Store(lastSeq)
+			}
+		}
+		chatRoom.Register <- client
 
 		defer func() {
-			room.Unregister <- conn
+			chatRoom.Unregister <- client
 		}()
 
+		// A dropped connection parks its session for the client to resume
+		var proto protocol
+		left := false
+		abused := false // disconnected for abuse; not resumable
+		defer func() {
+			if sess == nil {
+				return
+			}
+			if !proto.has(model.FeatureHistory) || left || abused || client.Kicked() ||
+				client.UserId() == "" || chatRoom.Banned(client.UserId()) {
+				resumption.end(sess, client)
+				return
+			}
+			resumption.park(sess, client)
+		}()
+
+		// Registered before reading the history so nothing falls in between;
+		// the write pump skips the overlap by sequence number
+		if resumed {
+			after := sess.acked.Load()
+			missed, err := chatRoom.Since(after)
+			if err != nil {
+				client.Log().Warn("history read failed", "err", err)
+			}
+			client.Log().Info("session resumed", "after", after, "replayed", len(missed))
+			if err := client.Replay(missed); err != nil {
+				return
+			}
+		}
+		go client.WritePump()
+
+		// The ring may have changed after the check above without this
+		// client being in the room yet
+		if owner, local := manager.Owner(roomId); !local {
+			metrics.Redirects.Inc("rebalance")
+			room.RedirectClient(client, owner, roomId)
+		}
+
+		first := true
+		var strikes strikes
 		for {
 			_, p, err := conn.ReadMessage()
 			if err != nil {
-				log.Println("Read error:", err)
+				if errors.Is(err, websocket.ErrReadLimit) {
+					// The websocket library has already closed with 1009
+					client.Log().Warn("frame too large", "limit", abuse.MaxFrameBytes)
+					abused = true
+					offence(admit, client, ip, "frame_too_large")
+				} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					client.Log().Warn("read failed", "err", err)
+				} else {
+					client.Log().Info("connection closed", "err", err)
+				}
 				break
 			}
+			start := time.Now()
 
-			var msg model.Message
-			if err := json.Unmarshal(p, &msg); err != nil {
-				// Invalid JSON
-				response := model.ServerResponse{
-					Status:          "ERROR",
-					Error:           "Invalid JSON format",
-					ServerTimestamp: time.Now(),
+			if first {
+				first = false
+				welcome := model.Welcome{NodeId: manager.NodeID(), ConnId: client.ID, Resumed: resumed}
+				if sess != nil {
+					welcome.ResumeToken = sess.token
+				}
+				var handled bool
+				proto, handled, err = handshake(client, p, compressed, welcome)
+				if err != nil {
+					break
+				}
+				if sess != nil && proto.has(model.FeatureHistory) {
+					resumption.track(sess)
+				}
+				if handled {
+					continue
 				}
-				conn.WriteJSON(response)
-				continue
 			}
 
-			if errStr := validateMessage(&msg); errStr != "" {
-				response := model.ServerResponse{
-					Message:         msg,
-					Status:          "ERROR",
-					Error:           errStr,
-					ServerTimestamp: time.Now(),
+			if proto.has(model.FeatureAcks) {
+				if ack, ok := decodeAck(client, p); ok {
+					sess.acked.Store(ack.Seq)
+					continue
 				}
-				conn.WriteJSON(response)
-				continue
 			}
 
-			// Valid message - Echo back
-			response := model.ServerResponse{
-				Message:         msg,
-				Status:          "OK",
-				ServerTimestamp: time.Now(),
+			var response interface{}
+			if cdc == codec.JSON && isBatch(p) {
+				response = handleBatch(chatRoom, client, p)
+			} else {
+				response = handleFrame(chatRoom, client, p)
 			}
-			
-			if err := conn.WriteJSON(response); err != nil {
-				log.Println("Write error:", err)
+
+			err = client.Write(response)
+			metrics.MessageProcessingSeconds.Observe(time.Since(start).Seconds())
+			if err != nil {
+				break
+			}
+			left = leftRoom(left, response)
+			if chatRoom.Banned(client.UserId()) {
+				client.Kick(model.ErrorBanned, errBanned)
+				break
+			}
+			if isStrike(response) && strikes.add(time.Now()) {
+				client.Log().Warn("too many invalid messages", "strikes", abuse.MaxStrikes)
+				abused = true
+				client.CloseWithError(model.ErrorTooManyStrikes, "too many invalid messages")
+				offence(admit, client, ip, "strikes")
 				break
 			}
 		}
 	}
 }
 
+// handleFrame decodes a single message with the client's codec and processes it
+func handleFrame(chatRoom *room.Room, client *room.Client, data []byte) model.ServerResponse {
+	var msg model.Message
+	if err := client.Codec.Unmarshal(data, &msg); err != nil {
+		// Invalid JSON (or invalid binary encoding)
+		code, errStr := invalidFormat(client.Codec)
+		response := errorResponse(nil, code, errStr)
+		metrics.MessagesRejected.Inc(response.Code)
+		client.Log().Info("message rejected", "code", response.Code)
+		return response
+	}
+	return processMessage(chatRoom, client, &msg)
+}
+
+// sender is where a message came from: a websocket client or an HTTP session
+type sender interface {
+	ConnID() string
+	Log() *slog.Logger
+	SetUser(userId, username string)
+	UserId() string
+	Username() string
+	Nick() string
+	SetNick(nick string)
+	Moderator() string
+}
+
+// errBanned rejects the messages of users banned from the room
+const errBanned = "You are banned from this room"
+
+// processMessage validates a decoded message, publishes it to the room if
+// it is valid and builds the sender's response
+func processMessage(chatRoom *room.Room, from sender, msg *model.Message) model.ServerResponse {
+	if code, errStr := model.Validate(msg); code != "" {
+		metrics.MessagesRejected.Inc(code)
+		from.Log().Info("message rejected", "code", code, "userId", msg.UserId)
+		return errorResponse(msg, code, errStr)
+	}
+
+	from.SetUser(msg.UserId, msg.Username)
+	if chatRoom.Banned(msg.UserId) {
+		metrics.MessagesRejected.Inc(model.ErrorBanned)
+		from.Log().Info("message rejected", "code", model.ErrorBanned, "userId", msg.UserId)
+		return errorResponse(msg, model.ErrorBanned, errBanned)
+	}
+	if nick := from.Nick(); nick != "" {
+		msg.Username = nick
+	}
+	if isCommand(msg) {
+		return runCommand(chatRoom, from, msg)
+	}
+	metrics.MessagesAccepted.Inc(msg.MessageType)
+	from.Log().Debug("message accepted", "messageType", msg.MessageType)
+
+	// Valid message - Echo back to the sender and broadcast to the room
+	response := model.ServerResponse{
+		Message:         *msg,
+		Status:          "OK",
+		ServerTimestamp: time.Now(),
+	}
+	_, response.Bot = from.(*botSender)
+	if err := chatRoom.Publish(from.ConnID(), response); err != nil {
+		from.Log().Warn("publish failed", "err", err)
+	}
+	emitMessageEvent(chatRoom.ID, response)
+	return response
+}
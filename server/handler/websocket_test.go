@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"chatroom/server/admission"
+	"chatroom/server/cluster"
+	"chatroom/server/model"
+	"chatroom/server/room"
+	"chatroom/server/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// testServer runs the websocket endpoint of a single node
+type testServer struct {
+	*httptest.Server
+	manager *room.Manager
+	history store.Store
+	admit   *admission.Controller
+	poll    *LongPoll
+}
+
+func newTestServer(t *testing.T, admit *admission.Controller) *testServer {
+	t.Helper()
+	history := store.NewMemoryStore(100)
+	s := &testServer{
+		manager: room.NewManager("a", cluster.NewInProcess(), history),
+		history: history,
+		admit:   admit,
+	}
+	s.poll = NewLongPoll(s.manager, admit, history, 200*time.Millisecond)
+	r := mux.NewRouter()
+	r.HandleFunc("/chat/{roomId}", HandleWebSocket(s.manager, admit))
+	r.HandleFunc("/rooms/{roomId}/events", HandleEvents(s.manager, admit, history))
+	r.HandleFunc("/rooms/{roomId}/messages", s.poll.HandlePost()).Methods("POST")
+	r.HandleFunc("/rooms/{roomId}/poll", s.poll.HandlePoll()).Methods("GET")
+	r.HandleFunc("/rooms/{roomId}/export", HandleExport(s.manager, history)).Methods("GET")
+	s.Server = httptest.NewServer(r)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// url is the websocket URL of path on the server
+func (s *testServer) url(path string) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + path
+}
+
+// dial connects to path, failing the test if the upgrade is refused
+func (s *testServer) dial(t *testing.T, path string) *websocket.Conn {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(s.url(path), nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial %s: %v (status %d)", path, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// refused dials path and returns the response to an upgrade that must fail
+func (s *testServer) refused(t *testing.T, path string) *http.Response {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(s.url(path), nil)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("dial %s: upgrade accepted", path)
+	}
+	if resp == nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	return resp
+}
+
+// send writes a JSON frame to conn
+func send(t *testing.T, conn *websocket.Conn, v interface{}) {
+	t.Helper()
+	if err := conn.WriteJSON(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readResponse reads the next frame from conn as a ServerResponse
+func readResponse(t *testing.T, conn *websocket.Conn) model.ServerResponse {
+	t.Helper()
+	var resp model.ServerResponse
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func textMessage(userId, username, text string) model.Message {
+	return model.Message{
+		UserId:      userId,
+		Username:    username,
+		Message:     text,
+		Timestamp:   time.Now(),
+		MessageType: model.MessageTypeText,
+	}
+}
+
+// waitFor polls cond until it holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdmissionRejectsBeforeUpgrade(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits admission.Limits
+		path   string
+		status int
+	}{
+		{"server full", admission.Limits{MaxConnections: 1}, "/chat/8", http.StatusServiceUnavailable},
+		{"room full", admission.Limits{MaxPerRoom: 1}, "/chat/7", http.StatusServiceUnavailable},
+		{"per IP", admission.Limits{MaxPerIP: 1}, "/chat/8", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, admission.NewController(tt.limits))
+		s.dial(t, "/chat/7")
+
+		resp := s.refused(t, tt.path)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if got := resp.Header.Get("Retry-After"); got != admissionRetryAfter {
+			t.Errorf("%s: Retry-After %q", tt.name, got)
+		}
+	}
+}
+
+func TestAdmissionReleasesOnClose(t *testing.T) {
+	admit := admission.NewController(admission.Limits{MaxConnections: 1})
+	s := newTestServer(t, admit)
+
+	conn := s.dial(t, "/chat/7")
+	send(t, conn, textMessage("1", "alice", "hi"))
+	readResponse(t, conn)
+	conn.Close()
+
+	waitFor(t, "the slot to be released", func() bool { return admit.Total() == 0 })
+	s.dial(t, "/chat/7")
+}
@@ -0,0 +1,119 @@
+// Package logging configures the server's structured logger
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures New
+type Options struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
+
+	// Sampling applies to records below ERROR: per message and per
+	// SampleTick, the first SampleInitial records are logged and after that
+	// only every SampleThereafter-th one. SampleInitial <= 0 disables it.
+	SampleInitial    int
+	SampleThereafter int
+	SampleTick       time.Duration
+}
+
+// New builds a logger writing to w according to opts
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", opts.Level)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "text", "":
+		h = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		h = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", opts.Format)
+	}
+
+	if opts.SampleInitial > 0 {
+		h = NewSamplingHandler(h, opts.SampleInitial, opts.SampleThereafter, opts.SampleTick)
+	}
+	return slog.New(h), nil
+}
+
+// SamplingHandler drops repeated records with the same message once a
+// per-tick budget is used up, so hot paths can't flood the log under load
+type SamplingHandler struct {
+	next       slog.Handler
+	initial    int
+	thereafter int
+	tick       time.Duration
+	counts     *sampleCounts
+}
+
+type sampleCounts struct {
+	mu     sync.Mutex
+	window time.Time
+	seen   map[string]int
+}
+
+func NewSamplingHandler(next slog.Handler, initial, thereafter int, tick time.Duration) *SamplingHandler {
+	if tick <= 0 {
+		tick = time.Second
+	}
+	return &SamplingHandler{
+		next:       next,
+		initial:    initial,
+		thereafter: thereafter,
+		tick:       tick,
+		counts:     &sampleCounts{seen: make(map[string]int)},
+	}
+}
+
+func (h *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError || h.allow(r.Message, r.Time) {
+		return h.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *SamplingHandler) allow(msg string, now time.Time) bool {
+	c := h.counts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if window := now.Truncate(h.tick); !window.Equal(c.window) {
+		c.window = window
+		clear(c.seen)
+	}
+
+	c.seen[msg]++
+	n := c.seen[msg]
+	if n <= h.initial {
+		return true
+	}
+	return h.thereafter > 0 && (n-h.initial)%h.thereafter == 0
+}
+
+func (h *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithAttrs(attrs)
+	return &clone
+}
+
+func (h *SamplingHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithGroup(name)
+	return &clone
+}
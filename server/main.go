@@ -1,37 +1,296 @@
 package main
 
 import (
+	"chatroom/server/admission"
+	"chatroom/server/auth"
+	"chatroom/server/cluster"
+	"chatroom/server/command"
 	"chatroom/server/handler"
+	"chatroom/server/logging"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
 	"chatroom/server/room"
+	"chatroom/server/search"
+	"chatroom/server/store"
+	"chatroom/server/webhook"
 	"context"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// storeCheckTimeout bounds the readiness probe of the message history
+const storeCheckTimeout = time.Second
+
 func main() {
-	roomManager := room.NewManager()
+	addr := flag.String("addr", ":8080", "HTTP listen address")
+	nodeId := flag.String("node-id", defaultNodeID(), "Unique ID of this node in the cluster")
+	backplane := flag.String("backplane", "local", "Room fan-out between nodes: local (single node), mesh or redis")
+	clusterListen := flag.String("cluster-listen", "127.0.0.1:7946", "Mesh backplane listen address; listen on a private interface for peers on other hosts")
+	clusterSecret := flag.String("cluster-secret", os.Getenv("CLUSTER_SECRET"), "Shared secret mesh peers authenticate with (default $CLUSTER_SECRET); required by -backplane mesh")
+	clusterPeers := flag.String("cluster-peers", "", "Comma-separated mesh peer addresses (host:port)")
+	clusterMembers := flag.String("cluster-members", "", "Comma-separated id=host:port members of the room ownership ring; empty serves every room locally")
+	redirectMode := flag.String("redirect", handler.RedirectHTTP, "How clients of rooms owned by another node are redirected: http (307) or frame (REDIRECT control frame)")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "Redis backplane address (host:port)")
+	redisPassword := flag.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis AUTH password (default $REDIS_PASSWORD)")
+	maxConns := flag.Int("max-conns", 0, "Maximum total websocket connections (0 = unlimited)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "Maximum websocket connections per client IP (0 = unlimited)")
+	maxConnsPerRoom := flag.Int("max-conns-per-room", 0, "Maximum websocket connections per room (0 = unlimited)")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logSampleInitial := flag.Int("log-sample-initial", 100, "Per second, log the first N records with the same message (0 disables sampling)")
+	logSampleThereafter := flag.Int("log-sample-thereafter", 100, "After the initial records, log every Nth one")
+	compress := flag.Bool("compression", false, "Negotiate permessage-deflate with clients that offer it")
+	compressLevel := flag.Int("compression-level", 1, "Deflate level from 1 (fastest) to 9 (smallest)")
+	compressMinSize := flag.Int("compression-min-size", 256, "Frames smaller than this many bytes are sent uncompressed")
+	historySize := flag.Int("history-size", 1000, "Maximum messages kept per room in the in-memory history, unless the room's retention asks for another count or maximum")
+	retention := flag.String("retention", "", "Default history retention by room ID pattern, e.g. 'support-*=24h,audit-*=forever:100000,*=1000'; age and forever rules take an optional maximum after ':'; unmatched rooms keep everything up to -history-size")
+	compactInterval := flag.Duration("compact-interval", time.Minute, "How often room retention policies are applied to the history (0 disables)")
+	searchEnabled := flag.Bool("search", true, "Index room history for GET /rooms/{roomId}/search")
+	sseHeartbeat := flag.Duration("sse-heartbeat", 15*time.Second, "Interval of heartbeat comments on idle event streams")
+	pollTimeout := flag.Duration("poll-timeout", 25*time.Second, "How long a long-poll request waits for new messages")
+	adminTokenFlag := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token required by /admin, room export and search, and to replay a room's whole history (default $ADMIN_TOKEN); empty refuses /admin, export and search")
+	insecureAdmin := flag.Bool("insecure-admin", false, "Serve /admin without authentication, for local development only")
+	botTokensFile := flag.String("bot-tokens", "", "JSON file of bots ([{\"name\",\"token\",\"rooms\"}]) allowed to post over HTTP")
+	moderatorTokensFile := flag.String("moderator-tokens", "", "JSON file of moderators ([{\"name\",\"token\",\"rooms\"}]); websocket connections opened with one of the tokens may run moderator commands such as /topic <text>")
+	noCommands := flag.Bool("no-commands", false, "Send messages starting with / to the room as text instead of running them")
+	minProtocol := flag.Int("min-protocol", model.MinProtocolVersion, "Oldest protocol version accepted; 2 requires every websocket client to open with HELLO")
+	resumeWindow := flag.Duration("resume-window", 2*time.Minute, "How long the session of a dropped websocket connection that negotiated history can be resumed, and how far back event streams and polls without the admin token catch up (0 disables)")
+	maxBatch := flag.Int("max-batch", 100, "Maximum number of messages in one batch frame")
+	maxFrameBytes := flag.Int64("max-frame-bytes", 256<<10, "Largest websocket frame read from a client, in bytes; larger frames close the connection with 1009 (0 = unlimited)")
+	maxStrikes := flag.Int("max-strikes", 10, "Invalid frames within -strike-window before a websocket client is disconnected with 1008 (0 disables)")
+	strikeWindow := flag.Duration("strike-window", time.Minute, "How long an invalid frame counts as a strike")
+	ipBanOffences := flag.Int("ip-ban-offences", 3, "Abuse disconnects from one IP within -ip-ban-window that get it temporarily banned (0 disables)")
+	ipBanWindow := flag.Duration("ip-ban-window", 10*time.Minute, "How long an abuse disconnect counts towards an IP ban")
+	ipBanDuration := flag.Duration("ip-ban-duration", 15*time.Minute, "How long a banned IP is refused")
+	trustedProxiesFlag := flag.String("trusted-proxies", "", "Comma-separated addresses or CIDR ranges of load balancers whose X-Forwarded-For names the client, for per-IP limits and bans")
+	flag.Parse()
+
+	logger, err := logging.New(os.Stderr, logging.Options{
+		Level:            *logLevel,
+		Format:           *logFormat,
+		SampleInitial:    *logSampleInitial,
+		SampleThereafter: *logSampleThereafter,
+		SampleTick:       time.Second,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	handler.SetCompression(handler.CompressionOptions{
+		Enabled: *compress,
+		Level:   *compressLevel,
+		MinSize: *compressMinSize,
+	})
+
+	handler.SetMaxBatchSize(*maxBatch)
+	handler.SetAbuseLimits(handler.AbuseOptions{
+		MaxFrameBytes: *maxFrameBytes,
+		MaxStrikes:    *maxStrikes,
+		StrikeWindow:  *strikeWindow,
+	})
+	if *minProtocol < model.MinProtocolVersion || *minProtocol > model.ProtocolVersion {
+		fmt.Fprintf(os.Stderr, "-min-protocol must be between %d and %d\n", model.MinProtocolVersion, model.ProtocolVersion)
+		os.Exit(2)
+	}
+	trustedProxies, err := handler.ParseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-trusted-proxies: %v\n", err)
+		os.Exit(2)
+	}
+	handler.SetTrustedProxies(trustedProxies)
+	handler.SetMinProtocol(*minProtocol)
+	handler.SetResumeWindow(*resumeWindow)
+	handler.SetSSEHeartbeat(*sseHeartbeat)
+
+	if *redirectMode != handler.RedirectHTTP && *redirectMode != handler.RedirectFrame {
+		fmt.Fprintf(os.Stderr, "unknown -redirect %q (want http or frame)\n", *redirectMode)
+		os.Exit(2)
+	}
+	handler.SetRedirectMode(*redirectMode)
+
+	retentionRules, err := store.ParseRetentionRules(*retention)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -retention: %v\n", err)
+		os.Exit(2)
+	}
+	// The history is in memory: bounded per room and gone on restart
+	for _, rule := range retentionRules {
+		keep := rule.Retention
+		if keep.Capacity() == 0 {
+			slog.Warn("retention holds at most -history-size messages per room; add a maximum such as forever:100000 to hold more",
+				"pattern", rule.Pattern, "retention", keep.String(), "historySize", *historySize)
+		}
+		if keep.Policy == store.KeepForever {
+			slog.Warn("retention forever does not survive a restart: the history is kept in memory",
+				"pattern", rule.Pattern)
+		}
+	}
+
+	bp, err := newBackplane(*backplane, *nodeId, *clusterListen, *clusterPeers, *clusterSecret, *redisAddr, *redisPassword)
+	if err != nil {
+		slog.Error("backplane setup failed", "backplane", *backplane, "err", err)
+		os.Exit(1)
+	}
+	defer bp.Close()
+
+	history := store.NewMemoryStore(*historySize)
+	defer history.Close()
+
+	searchIndex := search.NewIndex()
+	var roomHistory store.Store = history
+	if *searchEnabled {
+		roomHistory = search.NewIndexedStore(history, searchIndex)
+	}
+
+	roomManager := room.NewManager(*nodeId, bp, roomHistory)
+	roomManager.SetRetentionRules(retentionRules)
+	if *compactInterval > 0 {
+		stopCompactor := roomManager.StartCompactor(*compactInterval)
+		defer stopCompactor()
+	}
+
+	webhooks := webhook.NewDispatcher(*nodeId)
+	handler.SetWebhooks(webhooks)
+	roomManager.OnRoomCreated(func(roomId string) {
+		webhooks.Emit(webhook.EventRoomCreated, roomId, nil)
+	})
+
+	if !*noCommands {
+		var moderators *auth.Moderators
+		if *moderatorTokensFile != "" {
+			moderators, err = auth.LoadModerators(*moderatorTokensFile)
+			if err != nil {
+				slog.Error("loading moderator tokens failed", "err", err)
+				os.Exit(1)
+			}
+		}
+		handler.SetCommands(handler.CommandOptions{
+			Registry:   command.Default,
+			Manager:    roomManager,
+			Moderators: moderators,
+		})
+	}
+	if *clusterMembers != "" {
+		members, err := cluster.ParseMembers(*clusterMembers)
+		if err == nil {
+			ring := cluster.NewRing(cluster.DefaultVirtualNodes)
+			if err = ring.Set(members); err == nil {
+				roomManager.EnableOwnership(ring)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -cluster-members: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	admit := admission.NewController(admission.Limits{
+		MaxConnections: *maxConns,
+		MaxPerIP:       *maxConnsPerIP,
+		MaxPerRoom:     *maxConnsPerRoom,
+	})
+	admit.SetBanPolicy(admission.BanPolicy{
+		Offences: *ipBanOffences,
+		Window:   *ipBanWindow,
+		Duration: *ipBanDuration,
+	})
+	metrics.NewGaugeFunc("chat_rooms", "Number of rooms on this node.", func() float64 {
+		return float64(roomManager.RoomCount())
+	})
 
 	r := mux.NewRouter()
-	r.HandleFunc("/health", handler.HandleHealth).Methods("GET")
-	r.HandleFunc("/chat/{roomId}", handler.HandleWebSocket(roomManager))
+	health := handler.NewHealth(roomManager, admit)
+	health.AddReadinessCheck("store", handler.StoreCheck(history, storeCheckTimeout))
+	if redis, ok := bp.(*cluster.Redis); ok {
+		health.AddReadinessCheck("backplane", func() handler.ComponentStatus {
+			status := handler.StatusDown
+			if redis.Connected() {
+				status = handler.StatusUp
+			}
+			return handler.ComponentStatus{
+				Status:  status,
+				Details: map[string]interface{}{"type": "redis", "addr": *redisAddr},
+			}
+		})
+	}
+	r.HandleFunc("/health", health.HandleReady()).Methods("GET")
+	r.HandleFunc("/health/live", health.HandleLive()).Methods("GET")
+	r.HandleFunc("/health/ready", health.HandleReady()).Methods("GET")
+	r.HandleFunc("/metrics", metrics.Default.Handler()).Methods("GET")
+
+	adminToken := auth.NewAdminToken(*adminTokenFlag)
+	requireAdmin := handler.RequireAdmin(adminToken)
+	handler.SetHistoryAccess(adminToken, *resumeWindow)
+	admin := r.PathPrefix("/admin").Subrouter()
+	switch {
+	case *insecureAdmin:
+		slog.Warn("admin endpoints are unauthenticated (-insecure-admin)")
+	case !adminToken.Enabled():
+		slog.Warn("admin endpoints, room export and search are disabled; set -admin-token")
+		admin.Use(requireAdmin)
+	default:
+		admin.Use(requireAdmin)
+	}
+	admin.HandleFunc("/drain", handler.HandleDrain(roomManager)).Methods("POST")
+	admin.HandleFunc("/drain", handler.HandleDrainStatus(roomManager)).Methods("GET")
+	admin.HandleFunc("/connections", handler.HandleConnections(admit)).Methods("GET")
+	// Never open, even with -insecure-admin: a banned client must not lift its own ban
+	admin.Handle("/ip-bans/{ip}", requireAdmin(handler.HandleUnbanIP(admit))).Methods("DELETE")
+	admin.HandleFunc("/webhooks", handler.HandleListWebhooks(webhooks)).Methods("GET")
+	admin.HandleFunc("/webhooks", handler.HandleCreateWebhook(webhooks)).Methods("POST")
+	admin.HandleFunc("/webhooks/deliveries", handler.HandleWebhookDeliveries(webhooks)).Methods("GET")
+	admin.HandleFunc("/webhooks/{hookId}", handler.HandleDeleteWebhook(webhooks)).Methods("DELETE")
+	if *searchEnabled {
+		admin.HandleFunc("/search/rebuild", handler.HandleRebuildSearch(roomManager, searchIndex, history)).Methods("POST")
+		r.Handle("/rooms/{roomId}/search", requireAdmin(handler.HandleSearch(roomManager, searchIndex))).Methods("GET")
+	}
+	admin.HandleFunc("/rooms", handler.HandleListRooms(roomManager)).Methods("GET")
+	admin.HandleFunc("/rooms/{roomId}/members", handler.HandleRoster(roomManager)).Methods("GET")
+	admin.HandleFunc("/rooms/{roomId}/kick", handler.HandleKick(roomManager)).Methods("POST")
+	admin.HandleFunc("/rooms/{roomId}/bans", handler.HandleListBans(roomManager)).Methods("GET")
+	admin.HandleFunc("/rooms/{roomId}/bans", handler.HandleBan(roomManager)).Methods("POST")
+	admin.HandleFunc("/rooms/{roomId}/bans/{userId}", handler.HandleUnban(roomManager)).Methods("DELETE")
+	admin.HandleFunc("/rooms/{roomId}/retention", handler.HandleSetRetention(roomManager)).Methods("PUT")
+	admin.HandleFunc("/cluster", handler.HandleCluster(roomManager)).Methods("GET")
+	admin.HandleFunc("/cluster/members", handler.HandleSetMembers(roomManager)).Methods("PUT")
+	r.Handle("/rooms/{roomId}/export", requireAdmin(handler.HandleExport(roomManager, history))).Methods("GET")
+	r.HandleFunc("/chat/{roomId}", handler.HandleWebSocket(roomManager, admit))
+	r.HandleFunc("/rooms/{roomId}", handler.HandleRoomInfo(roomManager)).Methods("GET")
+	r.HandleFunc("/rooms/{roomId}/events", handler.HandleEvents(roomManager, admit, history)).Methods("GET")
+	longPoll := handler.NewLongPoll(roomManager, admit, history, *pollTimeout)
+	if *botTokensFile != "" {
+		bots, err := auth.LoadBots(*botTokensFile)
+		if err != nil {
+			slog.Error("loading bot tokens failed", "err", err)
+			os.Exit(1)
+		}
+		longPoll.SetBots(bots)
+	}
+	r.HandleFunc("/rooms/{roomId}/messages", longPoll.HandlePost()).Methods("POST")
+	r.HandleFunc("/rooms/{roomId}/poll", longPoll.HandlePoll()).Methods("GET")
 
 	srv := &http.Server{
 		Handler:      r,
-		Addr:         ":8080",
+		Addr:         *addr,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	log.Println("Server starting on :8080")
+	slog.Info("server starting", "addr", srv.Addr, "nodeId", *nodeId, "backplane", *backplane)
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("ListenAndServe error: %v", err)
+			slog.Error("listen failed", "err", err)
+			os.Exit(1)
 		}
 	}()
 
@@ -40,15 +299,47 @@ func main() {
 	signal.Notify(c, os.Interrupt)
 	<-c
 
-	log.Println("Shutting down server...")
+	slog.Info("shutting down server")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		slog.Error("server forced to shutdown", "err", err)
+		os.Exit(1)
+	}
+
+	slog.Info("server exiting")
+}
+
+// defaultNodeID combines the host name with a random suffix so several
+// nodes on one machine don't collide
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "node"
 	}
+	return host + "-" + room.NewConnID()[:6]
+}
 
-	log.Println("Server exiting")
+func newBackplane(kind, nodeId, listen, peers, secret, redisAddr, redisPassword string) (cluster.Backplane, error) {
+	switch kind {
+	case "local":
+		return cluster.NewInProcess(), nil
+	case "mesh":
+		return cluster.NewMesh(nodeId, listen, splitList(peers), secret)
+	case "redis":
+		return cluster.NewRedis(nodeId, redisAddr, redisPassword), nil
+	}
+	return nil, fmt.Errorf("unknown backplane %q (want local, mesh or redis)", kind)
 }
 
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
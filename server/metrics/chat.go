@@ -0,0 +1,102 @@
+package metrics
+
+// Server-wide chat metrics
+var (
+	ActiveConnections = NewGauge(
+		"chat_active_connections",
+		"Number of open websocket connections.",
+	)
+	SSESubscribers = NewGauge(
+		"chat_sse_subscribers",
+		"Number of open Server-Sent Events streams.",
+	)
+	HistoryCompacted = NewCounter(
+		"chat_history_compacted_total",
+		"History messages removed by room retention policies.",
+	)
+	SearchQueries = NewCounter(
+		"chat_search_queries_total",
+		"Room history searches served.",
+	)
+	ResumableSessions = NewGauge(
+		"chat_resumable_sessions",
+		"Sessions of dropped websocket connections that can still be resumed.",
+	)
+	LongPollSessions = NewGauge(
+		"chat_longpoll_sessions",
+		"Number of long-poll sessions that are room members.",
+	)
+	MessagesAccepted = NewCounterVec(
+		"chat_messages_accepted_total",
+		"Messages that passed validation, by message type.",
+		"type",
+	)
+	MessagesRejected = NewCounterVec(
+		"chat_messages_rejected_total",
+		"Messages rejected by the server, by error reason.",
+		"reason",
+	)
+	UpgradeFailures = NewCounterVec(
+		"chat_upgrade_failures_total",
+		"Websocket upgrades that were refused or failed, by reason.",
+		"reason",
+	)
+	Redirects = NewCounterVec(
+		"chat_redirects_total",
+		"Clients sent to the node that owns their room, by how (http, frame, rebalance).",
+		"mode",
+	)
+	Handshakes = NewCounterVec(
+		"chat_handshakes_total",
+		"Websocket connections by opening: hello, legacy (no HELLO) or rejected.",
+		"result",
+	)
+	Resumptions = NewCounterVec(
+		"chat_resumptions_total",
+		"Reconnects carrying a resume token, by result (resumed, replaced, unknown, banned).",
+		"result",
+	)
+	Commands = NewCounterVec(
+		"chat_commands_total",
+		"Slash commands run, by command and result (ok, error, denied, unknown).",
+		"command", "result",
+	)
+	AdminAuthFailures = NewCounter(
+		"chat_admin_auth_failures_total",
+		"Admin requests rejected for a missing or invalid token.",
+	)
+	BotAuthFailures = NewCounter(
+		"chat_bot_auth_failures_total",
+		"Bot posts rejected for an invalid bearer token.",
+	)
+	MessageProcessingSeconds = NewHistogram(
+		"chat_message_processing_seconds",
+		"Time from reading a frame to writing its response.",
+		DefBuckets,
+	)
+	BackplanePublished = NewCounter(
+		"chat_backplane_published_total",
+		"Accepted messages published to the backplane.",
+	)
+	BroadcastDeliveries = NewCounter(
+		"chat_broadcast_deliveries_total",
+		"Broadcast frames queued to local clients.",
+	)
+	SlowConsumers = NewCounter(
+		"chat_slow_consumers_total",
+		"Clients disconnected because their send queue was full.",
+	)
+	AbuseDisconnects = NewCounterVec(
+		"chat_abuse_disconnects_total",
+		"Websocket clients disconnected for abuse, by reason (strikes, frame_too_large).",
+		"reason",
+	)
+	IPBans = NewCounter(
+		"chat_ip_bans_total",
+		"Client IPs temporarily banned after repeated abuse.",
+	)
+	WriteErrors = NewCounter(
+		"chat_write_errors_total",
+		"Errors writing frames to websocket clients.",
+	)
+)
@@ -0,0 +1,292 @@
+// Package metrics is a minimal Prometheus text exposition implementation,
+// kept dependency-free so the server can be scraped without a client library
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector is anything that can write its samples in exposition format
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds the metrics exposed on /metrics
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default is the registry the package-level constructors register into
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collectors[c.name()]; ok {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors[c.name()] = c
+}
+
+// Write writes every registered metric, sorted by name
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the registry in Prometheus text format
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		r.Write(bw)
+		bw.Flush()
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	metricName string
+	help       string
+	value      atomic.Uint64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc()          { c.value.Add(1) }
+func (c *Counter) Add(n uint64)  { c.value.Add(n) }
+func (c *Counter) Value() uint64 { return c.value.Load() }
+func (c *Counter) name() string  { return c.metricName }
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.metricName, c.value.Load())
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	metricName string
+	help       string
+	labels     []string
+
+	mu       sync.RWMutex
+	counters map[string]*labelledCounter
+}
+
+type labelledCounter struct {
+	values []string
+	value  atomic.Uint64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		counters:   make(map[string]*labelledCounter),
+	}
+	Default.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values
+func (c *CounterVec) Inc(values ...string) {
+	c.get(values).value.Add(1)
+}
+
+func (c *CounterVec) get(values []string) *labelledCounter {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", c.metricName, len(c.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	c.mu.RLock()
+	lc, ok := c.counters[key]
+	c.mu.RUnlock()
+	if ok {
+		return lc
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if lc, ok = c.counters[key]; !ok {
+		lc = &labelledCounter{values: append([]string(nil), values...)}
+		c.counters[key] = lc
+	}
+	return lc
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.counters))
+	for k := range c.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	counters := make([]*labelledCounter, len(keys))
+	for i, k := range keys {
+		counters[i] = c.counters[k]
+	}
+	c.mu.RUnlock()
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	for _, lc := range counters {
+		fmt.Fprintf(w, "%s%s %d\n", c.metricName, formatLabels(c.labels, lc.values), lc.value.Load())
+	}
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	metricName string
+	help       string
+	value      atomic.Int64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{metricName: name, help: help}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Inc()         { g.value.Add(1) }
+func (g *Gauge) Dec()         { g.value.Add(-1) }
+func (g *Gauge) Set(v int64)  { g.value.Store(v) }
+func (g *Gauge) Value() int64 { return g.value.Load() }
+func (g *Gauge) name() string { return g.metricName }
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.metricName, g.value.Load())
+}
+
+// GaugeFunc is a gauge whose value is computed at scrape time
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, fn: fn}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string { return g.metricName }
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	metricName string
+	help       string
+	bounds     []float64
+	counts     []atomic.Uint64 // one per bound plus +Inf
+	sumBits    atomic.Uint64
+}
+
+// DefBuckets suits request latencies measured in seconds
+var DefBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	h := &Histogram{
+		metricName: name,
+		help:       help,
+		bounds:     bounds,
+		counts:     make([]atomic.Uint64, len(bounds)+1),
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + v
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.metricName, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatFloat(bound), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatFloat(math.Float64frombits(h.sumBits.Load())))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, cumulative)
+}
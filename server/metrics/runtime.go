@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// runtimeCollector exposes Go runtime statistics, read at scrape time
+type runtimeCollector struct{}
+
+func (runtimeCollector) name() string { return "go_runtime" }
+
+func (runtimeCollector) write(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	writeHeader(w, "go_goroutines", "Number of goroutines that currently exist.", "gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+
+	writeHeader(w, "go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes %d\n", ms.Alloc)
+
+	writeHeader(w, "go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", "gauge")
+	fmt.Fprintf(w, "go_memstats_heap_inuse_bytes %d\n", ms.HeapInuse)
+
+	writeHeader(w, "go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", ms.Sys)
+
+	writeHeader(w, "go_memstats_mallocs_total", "Total number of mallocs.", "counter")
+	fmt.Fprintf(w, "go_memstats_mallocs_total %d\n", ms.Mallocs)
+
+	writeHeader(w, "go_gc_cycles_total", "Number of completed GC cycles.", "counter")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", ms.NumGC)
+
+	writeHeader(w, "go_gc_pause_seconds_total", "Total GC stop-the-world pause time in seconds.", "counter")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %s\n", formatFloat(float64(ms.PauseTotalNs)/1e9))
+}
+
+func init() {
+	Default.register(runtimeCollector{})
+}
@@ -0,0 +1,37 @@
+package model
+
+// Error codes identify why the server rejected a message, in
+// ServerResponse.Code, or ended a connection, at the start of the close
+// reason. Unlike the error text they are stable, so clients can branch on
+// them.
+const (
+	// Frames that could not be decoded
+	ErrorInvalidJSON   = "INVALID_JSON"   // chat.json.v1 frame is not a JSON message
+	ErrorInvalidFormat = "INVALID_FORMAT" // binary frame does not decode with the codec
+	ErrorBatchSize     = "BATCH_SIZE"     // empty batch or more than the maximum
+
+	// Validation of a decoded message
+	ErrorUserIdRange   = "USERID_RANGE"
+	ErrorUsername      = "USERNAME_INVALID"
+	ErrorMessageLength = "MESSAGE_LENGTH"
+	ErrorTimestamp     = "TIMESTAMP_INVALID"
+	ErrorMessageType   = "MESSAGE_TYPE_INVALID"
+
+	// Room rules
+	ErrorBanned = "BANNED"
+
+	// Slash commands
+	ErrorUnknownCommand   = "UNKNOWN_COMMAND"
+	ErrorPermissionDenied = "PERMISSION_DENIED"
+	ErrorCommandUsage     = "COMMAND_USAGE"
+	ErrorCommandFailed    = "COMMAND_FAILED"
+
+	// Reasons for closing a connection
+	ErrorProtocolVersion = "PROTOCOL_VERSION" // HELLO version unsupported, or HELLO required
+	ErrorKicked          = "KICKED"
+	ErrorSlowConsumer    = "SLOW_CONSUMER"
+	ErrorServerDraining  = "SERVER_DRAINING"
+	ErrorRoomMoved       = "ROOM_MOVED"
+	ErrorSessionReplaced = "SESSION_REPLACED" // resumed by another connection
+	ErrorTooManyStrikes  = "TOO_MANY_STRIKES" // kept sending invalid messages
+)
@@ -7,22 +7,113 @@ const (
 	MessageTypeText  = "TEXT"
 	MessageTypeJoin  = "JOIN"
 	MessageTypeLeave = "LEAVE"
+	// ACTION and SYSTEM are only generated by the server, from slash commands
+	MessageTypeAction = "ACTION"
+	MessageTypeSystem = "SYSTEM"
 )
 
-// Message represents the WebSocket message structure
+// ServerResponse statuses
+const (
+	StatusOK    = "OK"
+	StatusError = "ERROR"
+	// StatusBroadcast marks another member's message relayed to the room
+	StatusBroadcast = "BROADCAST"
+)
+
+// Message represents the WebSocket message structure. The proto tags give
+// the field numbers used by the chat.proto.v1 subprotocol.
 type Message struct {
-	UserId      string    `json:"userId"`
-	Username    string    `json:"username"`
-	Message     string    `json:"message"`
-	Timestamp   time.Time `json:"timestamp"`
-	MessageType string    `json:"messageType"`
+	UserId      string    `json:"userId" proto:"1"`
+	Username    string    `json:"username" proto:"2"`
+	Message     string    `json:"message" proto:"3"`
+	Timestamp   time.Time `json:"timestamp" proto:"4"`
+	MessageType string    `json:"messageType" proto:"5"`
 }
 
 // ServerResponse represents the server's response
 type ServerResponse struct {
-	Message
-	ServerTimestamp time.Time `json:"serverTimestamp"`
-	Status          string    `json:"status"` // "OK" or "ERROR"
-	Error           string    `json:"error,omitempty"`
+	Message         `proto:"1"`
+	ServerTimestamp time.Time `json:"serverTimestamp" proto:"2"`
+	Status          string    `json:"status" proto:"3"` // "OK", "ERROR" or "BROADCAST"
+	Error           string    `json:"error,omitempty" proto:"4"`
+	Seq             uint64    `json:"seq,omitempty" proto:"5"`   // position in the room's history, set on broadcasts
+	Bot             bool      `json:"bot,omitempty" proto:"6"`   // posted by an authenticated integration
+	Reply           string    `json:"reply,omitempty" proto:"7"` // a slash command's output, sent only to the caller
+	Code            string    `json:"code,omitempty" proto:"8"`  // with ERROR, one of the Error* codes
+}
+
+// Control message types pushed by the server outside the request/response flow
+const (
+	ControlTypeReconnect = "RECONNECT"
+	ControlTypeRedirect  = "REDIRECT"
+)
+
+// ControlMessage is sent by the server to instruct a client, e.g. to
+// reconnect elsewhere before the node goes away or to connect to the node
+// that owns its room
+type ControlMessage struct {
+	Type         string `json:"type" proto:"1"`
+	Reason       string `json:"reason,omitempty" proto:"2"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty" proto:"3"`
+	URL          string `json:"url,omitempty" proto:"4"`    // REDIRECT target
+	NodeId       string `json:"nodeId,omitempty" proto:"5"` // REDIRECT target's node ID
+}
+
+// Protocol versions. Version 1 is the original protocol without a
+// handshake; from version 2 clients may open with HELLO.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Handshake frame types
+const (
+	ControlTypeHello   = "HELLO"
+	ControlTypeWelcome = "WELCOME"
+	ControlTypeAck     = "ACK"
+)
+
+// Optional protocol features negotiated by HELLO and WELCOME
+const (
+	FeatureAcks        = "acks"        // acknowledged delivery by sequence number
+	FeatureHistory     = "history"     // replay of missed messages
+	FeatureCompression = "compression" // permessage-deflate is in use
+	FeatureBatching    = "batching"    // JSON arrays of messages in one frame
+	FeatureCommands    = "commands"    // slash commands in TEXT messages
+)
+
+// Hello is the first frame a versioned client sends after the upgrade
+type Hello struct {
+	Type     string   `json:"type" proto:"1"` // "HELLO"
+	Version  int      `json:"version" proto:"2"`
+	Features []string `json:"features,omitempty" proto:"3"` // what the client would like to use
+	Client   string   `json:"client,omitempty" proto:"4"`   // name/version, for logs
+}
+
+// Limits are the server's bounds on what a client may send
+type Limits struct {
+	MaxMessageLength int   `json:"maxMessageLength" proto:"1"` // characters of Message.Message
+	MaxBatchSize     int   `json:"maxBatchSize" proto:"2"`     // messages per batch frame
+	MaxFrameBytes    int64 `json:"maxFrameBytes,omitempty" proto:"3"`
 }
 
+// Welcome answers Hello with the version and features the connection uses
+type Welcome struct {
+	Type     string   `json:"type" proto:"1"` // "WELCOME"
+	Version  int      `json:"version" proto:"2"`
+	Features []string `json:"features" proto:"3"` // requested and supported
+	Limits   Limits   `json:"limits" proto:"4"`
+	NodeId   string   `json:"nodeId,omitempty" proto:"5"`
+	ConnId   string   `json:"connId,omitempty" proto:"6"`
+	// ResumeToken resumes the session after a dropped connection; only
+	// sent when history was negotiated
+	ResumeToken string `json:"resumeToken,omitempty" proto:"7"`
+	Resumed     bool   `json:"resumed,omitempty" proto:"8"` // this connection resumed a session
+}
+
+// Ack tells the server the client has everything up to Seq, which is
+// where a resumed session replays from
+type Ack struct {
+	Type string `json:"type" proto:"1"` // "ACK"
+	Seq  uint64 `json:"seq" proto:"2"`
+}
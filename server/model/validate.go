@@ -0,0 +1,79 @@
+package model
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// MaxMessageLength bounds Message.Message of what clients send; WELCOME
+// reports it to clients
+const MaxMessageLength = 500
+
+// maxAnnouncementLength bounds SYSTEM messages, which quote client text
+// such as a new topic
+const maxAnnouncementLength = 2 * MaxMessageLength
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9]{3,20}$`)
+
+// Validate returns the error code and text of the first rule a message
+// sent by a client breaks, or an empty code if it is valid
+func Validate(msg *Message) (code, errStr string) {
+	return validate(msg, false)
+}
+
+// ValidateAccepted checks a message that another node says it accepted:
+// the client rules, except that the server's own ACTION and SYSTEM
+// messages are allowed too
+func ValidateAccepted(msg *Message) (code, errStr string) {
+	return validate(msg, true)
+}
+
+// ValidateIdentity returns the error code and text of a userId or username
+// a client may not use, or an empty code if both are valid
+func ValidateIdentity(userId, username string) (code, errStr string) {
+	// userId validation
+	uid, err := strconv.Atoi(userId)
+	if err != nil || uid < 1 || uid > 100000 {
+		return ErrorUserIdRange, "userId must be between 1 and 100000"
+	}
+
+	// username validation
+	if !usernameRegex.MatchString(username) {
+		return ErrorUsername, "username must be 3-20 alphanumeric characters"
+	}
+	return "", ""
+}
+
+func validate(msg *Message, accepted bool) (code, errStr string) {
+	if code, errStr := ValidateIdentity(msg.UserId, msg.Username); code != "" {
+		return code, errStr
+	}
+
+	// message validation
+	maxLength := MaxMessageLength
+	if accepted && msg.MessageType == MessageTypeSystem {
+		maxLength = maxAnnouncementLength
+	}
+	if len(msg.Message) < 1 || len(msg.Message) > maxLength {
+		return ErrorMessageLength, "message must be 1-500 characters"
+	}
+
+	// timestamp validation (checked implicitly by unmarshal, but ensure it's not zero)
+	if msg.Timestamp.IsZero() {
+		return ErrorTimestamp, "timestamp is invalid"
+	}
+
+	// messageType validation
+	switch msg.MessageType {
+	case MessageTypeText, MessageTypeJoin, MessageTypeLeave:
+		// valid
+	case MessageTypeAction, MessageTypeSystem:
+		if !accepted {
+			return ErrorMessageType, "invalid messageType"
+		}
+	default:
+		return ErrorMessageType, "invalid messageType"
+	}
+
+	return "", ""
+}
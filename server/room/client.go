@@ -0,0 +1,209 @@
+package room
+
+import (
+	"chatroom/codec"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait = 5 * time.Second
+
+	// sendQueueSize is how many broadcasts may wait for a slow client
+	sendQueueSize = 256
+)
+
+// Client wraps a websocket connection so that writes coming from the
+// handler loop and from room-level operations (e.g. drain) never interleave
+type Client struct {
+	ID    string
+	Conn  *websocket.Conn
+	Codec codec.Codec
+	mu    sync.Mutex
+
+	// CompressMinSize is the smallest frame that is compressed when
+	// permessage-deflate was negotiated; tiny frames grow when deflated
+	CompressMinSize int
+
+	send     chan interface{}
+	done     chan struct{}
+	stopOnce sync.Once
+	replayed uint64 // last sequence written by Replay, before the write pump starts
+	kicked   atomic.Bool
+
+	Identity
+
+	base   *slog.Logger
+	logger atomic.Pointer[slog.Logger]
+}
+
+// NewClient wraps conn, whose frames are encoded with cdc; every log line of
+// the client carries its connection ID on top of the attributes already on logger
+func NewClient(conn *websocket.Conn, cdc codec.Codec, id string, logger *slog.Logger) *Client {
+	c := &Client{
+		ID:    id,
+		Conn:  conn,
+		Codec: cdc,
+		send:  make(chan interface{}, sendQueueSize),
+		done:  make(chan struct{}),
+		base:  logger.With("connId", id),
+	}
+	c.logger.Store(c.base)
+	return c
+}
+
+// NewConnID returns a random identifier for a new connection
+func NewConnID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ConnID returns the connection ID, which identifies the client as a sender
+func (c *Client) ConnID() string {
+	return c.ID
+}
+
+// Log returns the client's logger
+func (c *Client) Log() *slog.Logger {
+	return c.logger.Load()
+}
+
+// SetUser records the user of an accepted message and attaches its userId
+// to the client's log lines
+func (c *Client) SetUser(userId, username string) {
+	if c.Remember(userId, username) {
+		c.logger.Store(c.base.With("userId", userId))
+	}
+}
+
+// Restore takes over the identity of an earlier connection, e.g. one whose
+// session is being resumed
+func (c *Client) Restore(from *Identity) {
+	c.CopyFrom(from)
+	if userId := c.UserId(); userId != "" {
+		c.logger.Store(c.base.With("userId", userId))
+	}
+}
+
+// Write encodes v with the client's codec and sends it as one frame
+func (c *Client) Write(v interface{}) error {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Conn.EnableWriteCompression(len(data) >= c.CompressMinSize)
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err = c.Conn.WriteMessage(c.Codec.FrameType(), data)
+	if err != nil {
+		metrics.WriteErrors.Inc()
+		c.Log().Warn("write failed", "err", err)
+	}
+	return err
+}
+
+// Enqueue queues v for the write pump without blocking. It returns false
+// if the client's queue is full.
+func (c *Client) Enqueue(v interface{}) bool {
+	select {
+	case c.send <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+// Replay writes messages the client missed, oldest first. It must be called
+// before WritePump starts, which then skips queued broadcasts that were
+// already replayed.
+func (c *Client) Replay(msgs []model.ServerResponse) error {
+	for _, msg := range msgs {
+		if msg.Seq <= c.replayed {
+			continue
+		}
+		if err := c.Write(msg); err != nil {
+			return err
+		}
+		c.replayed = msg.Seq
+	}
+	return nil
+}
+
+// WritePump writes queued frames until Stop is called or a write fails
+func (c *Client) WritePump() {
+	for {
+		select {
+		case v := <-c.send:
+			if msg, ok := v.(model.ServerResponse); ok && msg.Seq != 0 && msg.Seq <= c.replayed {
+				continue
+			}
+			if err := c.Write(v); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Stop ends the write pump
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+// closeCodes are the websocket close codes of the errors that end a connection
+var closeCodes = map[string]int{
+	model.ErrorProtocolVersion: websocket.CloseProtocolError,
+	model.ErrorKicked:          websocket.ClosePolicyViolation,
+	model.ErrorBanned:          websocket.ClosePolicyViolation,
+	model.ErrorSlowConsumer:    websocket.CloseTryAgainLater,
+	model.ErrorServerDraining:  websocket.CloseGoingAway,
+	model.ErrorRoomMoved:       websocket.CloseGoingAway,
+	model.ErrorSessionReplaced: websocket.CloseNormalClosure,
+	model.ErrorTooManyStrikes:  websocket.ClosePolicyViolation,
+}
+
+// maxCloseReason is the longest reason a close frame can carry
+const maxCloseReason = 123
+
+// CloseWithError closes the connection with the close code of the error
+// code and the reason "CODE: text"
+func (c *Client) CloseWithError(code, text string) error {
+	closeCode, ok := closeCodes[code]
+	if !ok {
+		closeCode = websocket.CloseInternalServerErr
+	}
+	reason := code
+	if text != "" {
+		reason += ": " + text
+	}
+	for len(reason) > maxCloseReason {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	return c.CloseWithReason(closeCode, reason)
+}
+
+// CloseWithReason sends a close frame with the given code and reason and
+// then closes the underlying connection
+func (c *Client) CloseWithReason(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	return c.Conn.Close()
+}
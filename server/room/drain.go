@@ -0,0 +1,176 @@
+package room
+
+import (
+	"chatroom/server/model"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// Drain states reported by DrainStatus
+const (
+	DrainStateIdle     = "IDLE"
+	DrainStateDraining = "DRAINING"
+	DrainStateDrained  = "DRAINED"
+)
+
+var ErrAlreadyDraining = errors.New("drain already in progress")
+
+// DrainOptions controls how existing clients are moved off the node
+type DrainOptions struct {
+	Waves    int           // number of groups the clients are split into
+	Interval time.Duration // pause between two waves
+}
+
+// DrainStatus reports the progress of a drain
+type DrainStatus struct {
+	State         string     `json:"state"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+	Waves         int        `json:"waves"`
+	WavesDone     int        `json:"wavesDone"`
+	TotalClients  int        `json:"totalClients"`
+	ClientsClosed int        `json:"clientsClosed"`
+}
+
+// Draining reports whether the node stopped accepting new connections
+func (m *Manager) Draining() bool {
+	return m.draining.Load()
+}
+
+// DrainStatus returns a copy of the current drain progress
+func (m *Manager) DrainStatus() DrainStatus {
+	m.drainMu.Lock()
+	defer m.drainMu.Unlock()
+
+	status := m.drain
+	if status.State == "" {
+		status.State = DrainStateIdle
+	}
+	return status
+}
+
+// Drainer is a connection a drain can end. Websocket clients are drainers,
+// and so are subscribers that hold a connection open, such as event streams
+// and long-poll sessions.
+type Drainer interface {
+	// Drain asks the client to reconnect in retryAfterMs and ends the connection
+	Drain(retryAfterMs int64)
+}
+
+// StartDrain stops the node from accepting connections and closes the
+// existing clients in staggered waves, asking each one to reconnect elsewhere
+func (m *Manager) StartDrain(opts DrainOptions) (DrainStatus, error) {
+	if !m.draining.CompareAndSwap(false, true) {
+		return m.DrainStatus(), ErrAlreadyDraining
+	}
+	if opts.Waves < 1 {
+		opts.Waves = 1
+	}
+
+	clients := m.drainers()
+	now := time.Now()
+
+	m.drainMu.Lock()
+	m.drain = DrainStatus{
+		State:        DrainStateDraining,
+		StartedAt:    &now,
+		Waves:        opts.Waves,
+		TotalClients: len(clients),
+	}
+	status := m.drain
+	m.drainMu.Unlock()
+
+	go m.runDrain(clients, opts)
+	return status, nil
+}
+
+// drainers returns the websocket clients and the subscribers that can be
+// drained across every room
+func (m *Manager) drainers() []Drainer {
+	var drainers []Drainer
+	for _, room := range m.RoomList() {
+		room.mu.RLock()
+		for c := range room.Clients {
+			drainers = append(drainers, c)
+		}
+		for s := range room.Subscribers {
+			if d, ok := s.(Drainer); ok {
+				drainers = append(drainers, d)
+			}
+		}
+		room.mu.RUnlock()
+	}
+	return drainers
+}
+
+func (m *Manager) runDrain(clients []Drainer, opts DrainOptions) {
+	waveSize := (len(clients) + opts.Waves - 1) / opts.Waves
+
+	for wave := 0; wave < opts.Waves; wave++ {
+		start := wave * waveSize
+		if start >= len(clients) {
+			// Everyone is gone; the remaining waves would only sleep
+			break
+		}
+		end := min(start+waveSize, len(clients))
+		if wave > 0 {
+			time.Sleep(opts.Interval)
+		}
+
+		for _, c := range clients[start:end] {
+			c.Drain(drainRetryAfter(opts.Interval))
+		}
+
+		m.drainMu.Lock()
+		m.drain.WavesDone++
+		m.drain.ClientsClosed += end - start
+		m.drainMu.Unlock()
+	}
+
+	// Sweep clients that registered while the snapshot was being taken
+	drained := make(map[Drainer]bool, len(clients))
+	for _, c := range clients {
+		drained[c] = true
+	}
+	var stragglers []Drainer
+	for _, c := range m.drainers() {
+		if !drained[c] {
+			stragglers = append(stragglers, c)
+			c.Drain(drainRetryAfter(opts.Interval))
+		}
+	}
+
+	finished := time.Now()
+
+	m.drainMu.Lock()
+	m.drain.TotalClients += len(stragglers)
+	m.drain.ClientsClosed += len(stragglers)
+	m.drain.State = DrainStateDrained
+	m.drain.FinishedAt = &finished
+	closed := m.drain.ClientsClosed
+	m.drainMu.Unlock()
+
+	slog.Info("drain finished", "clientsClosed", closed)
+}
+
+// drainRetryAfter jitters the suggested retry within spread so a wave
+// doesn't reconnect in lockstep
+func drainRetryAfter(spread time.Duration) int64 {
+	if spread <= 0 {
+		return 0
+	}
+	return rand.Int63n(spread.Milliseconds() + 1)
+}
+
+// Drain sends a RECONNECT frame and closes the connection with 1001
+func (c *Client) Drain(retryAfterMs int64) {
+	c.Log().Debug("asking client to reconnect", "retryAfterMs", retryAfterMs)
+	c.Write(model.ControlMessage{
+		Type:         model.ControlTypeReconnect,
+		Reason:       "server draining",
+		RetryAfterMs: retryAfterMs,
+	})
+	c.CloseWithError(model.ErrorServerDraining, "server draining")
+}
@@ -0,0 +1,64 @@
+package room
+
+import "sync/atomic"
+
+// Identity is the user behind a connection: the userId and username of its
+// latest accepted message, the nickname it chose with /nick, and the
+// moderator whose token opened the connection
+type Identity struct {
+	userId    atomic.Pointer[string]
+	username  atomic.Pointer[string]
+	nick      atomic.Pointer[string]
+	moderator atomic.Pointer[string]
+}
+
+func load(p *atomic.Pointer[string]) string {
+	if v := p.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+func (i *Identity) UserId() string { return load(&i.userId) }
+func (i *Identity) Nick() string   { return load(&i.nick) }
+
+// Username returns the nickname if one is set, else the last username sent
+func (i *Identity) Username() string {
+	if nick := i.Nick(); nick != "" {
+		return nick
+	}
+	return load(&i.username)
+}
+
+func (i *Identity) SetNick(nick string) {
+	i.nick.Store(&nick)
+}
+
+// Moderator returns the name of the moderator credential the connection
+// was opened with, or "". It never comes from the messages sent.
+func (i *Identity) Moderator() string { return load(&i.moderator) }
+
+func (i *Identity) SetModerator(name string) {
+	i.moderator.Store(&name)
+}
+
+// Remember records the identity of an accepted message and reports
+// whether the userId changed
+func (i *Identity) Remember(userId, username string) bool {
+	if load(&i.username) != username {
+		i.username.Store(&username)
+	}
+	if load(&i.userId) == userId {
+		return false
+	}
+	i.userId.Store(&userId)
+	return true
+}
+
+// CopyFrom takes over the userId, username and nickname of from. The
+// moderator role is not copied: each connection presents its own token.
+func (i *Identity) CopyFrom(from *Identity) {
+	i.userId.Store(from.userId.Load())
+	i.username.Store(from.username.Load())
+	i.nick.Store(from.nick.Load())
+}
@@ -1,29 +1,83 @@
 package room
 
 import (
+	"chatroom/server/cluster"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"log/slog"
+	"sort"
 	"sync"
-
-	"github.com/gorilla/websocket"
+	"sync/atomic"
 )
 
+// broadcastQueueSize buffers envelopes between the backplane and Room.Run
+const broadcastQueueSize = 1024
+
+// Subscriber receives a room's broadcasts without holding a websocket, e.g.
+// an SSE stream or a long-poll session. Deliver is called from Room.Run and
+// must not block; it returns false when the subscriber could not keep up.
+type Subscriber interface {
+	// ConnID identifies the subscriber as a sender, so its own messages are
+	// not delivered back to it; "" for subscribers that never send
+	ConnID() string
+	// Transport names the protocol, e.g. "sse", for the room roster
+	Transport() string
+	Deliver(msg model.ServerResponse) bool
+}
+
+// Member describes one connection in a room
+type Member struct {
+	ConnId    string `json:"connId,omitempty"`
+	UserId    string `json:"userId,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Transport string `json:"transport"`
+}
+
 // Room represents a chat room with connected clients
 type Room struct {
 	ID          string
-	Clients     map[*websocket.Conn]bool
-	Register    chan *websocket.Conn
-	Unregister  chan *websocket.Conn
-	Broadcast   chan []byte
+	Clients     map[*Client]bool
+	Subscribers map[Subscriber]bool
+	Register    chan *Client
+	Unregister  chan *Client
+	Broadcast   chan cluster.Envelope // accepted messages coming back from the backplane
 	mu          sync.RWMutex
+
+	nodeId      string
+	backplane   cluster.Backplane
+	history     store.Store
+	unsubscribe func()
+
+	topic     string          // guarded by mu
+	retention store.Retention // guarded by mu
+	bans      map[string]Ban  // guarded by mu, by userId
 }
 
-func NewRoom(id string) *Room {
-	return &Room{
-		ID:         id,
-		Clients:    make(map[*websocket.Conn]bool),
-		Register:   make(chan *websocket.Conn),
-		Unregister: make(chan *websocket.Conn),
-		Broadcast:  make(chan []byte),
+// NewRoom creates a room that publishes to and subscribes through bp and
+// records its broadcasts in history
+func NewRoom(id, nodeId string, bp cluster.Backplane, history store.Store) *Room {
+	r := &Room{
+		ID:          id,
+		Clients:     make(map[*Client]bool),
+		Subscribers: make(map[Subscriber]bool),
+		Register:    make(chan *Client),
+		Unregister:  make(chan *Client),
+		Broadcast:   make(chan cluster.Envelope, broadcastQueueSize),
+		nodeId:      nodeId,
+		backplane:   bp,
+		history:     history,
 	}
+
+	unsubscribe, err := bp.Subscribe(id, func(env cluster.Envelope) {
+		r.Broadcast <- env
+	})
+	if err != nil {
+		slog.Error("backplane subscribe failed", "roomId", id, "err", err)
+		unsubscribe = func() {}
+	}
+	r.unsubscribe = unsubscribe
+	return r
 }
 
 func (r *Room) Run() {
@@ -37,36 +91,177 @@ func (r *Room) Run() {
 			r.mu.Lock()
 			if _, ok := r.Clients[conn]; ok {
 				delete(r.Clients, conn)
-				conn.Close()
+				conn.Stop()
+				conn.Conn.Close()
 			}
 			r.mu.Unlock()
-		case <-r.Broadcast:
-			r.mu.RLock()
-			for conn := range r.Clients {
-				_ = conn // suppress unused error
-				select {
-				case <-make(chan bool): // Placeholder for write handling if needed
-				default:
-					// For assignment 1, we mostly echo back in the handler loop.
-				}
-			}
-			r.mu.RUnlock()
+		case env := <-r.Broadcast:
+			r.fanOut(env)
 		}
 	}
 }
 
+// Publish hands a message accepted from connection connId to the backplane,
+// which delivers it back to this room and to the room on every other node
+func (r *Room) Publish(connId string, response model.ServerResponse) error {
+	env := cluster.Envelope{
+		Origin:  r.nodeId,
+		RoomId:  r.ID,
+		ConnId:  connId,
+		Message: response,
+	}
+	metrics.BackplanePublished.Inc()
+	return r.backplane.Publish(env)
+}
+
+// AddSubscriber starts delivering the room's broadcasts to s
+func (r *Room) AddSubscriber(s Subscriber) {
+	r.mu.Lock()
+	r.Subscribers[s] = true
+	r.mu.Unlock()
+}
+
+// RemoveSubscriber stops delivering to s
+func (r *Room) RemoveSubscriber(s Subscriber) {
+	r.mu.Lock()
+	delete(r.Subscribers, s)
+	r.mu.Unlock()
+}
+
+// fanOut records a broadcast in the room's history and queues it to every
+// local client except the sender, who already got the message back as its
+// response, and to every subscriber. Clients whose queue is full are
+// disconnected rather than allowed to stall the room.
+func (r *Room) fanOut(env cluster.Envelope) {
+	broadcast := env.Message
+	broadcast.Status = model.StatusBroadcast
+
+	stored, err := r.history.Append(r.ID, broadcast)
+	if err != nil {
+		slog.Warn("history append failed", "roomId", r.ID, "err", err)
+	} else {
+		broadcast = stored
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for s := range r.Subscribers {
+		if env.Origin == r.nodeId && env.ConnId != "" && s.ConnID() == env.ConnId {
+			continue
+		}
+		if s.Deliver(broadcast) {
+			metrics.BroadcastDeliveries.Inc()
+			continue
+		}
+		metrics.SlowConsumers.Inc()
+	}
+
+	for c := range r.Clients {
+		if env.Origin == r.nodeId && c.ID == env.ConnId {
+			continue
+		}
+		if c.Enqueue(broadcast) {
+			metrics.BroadcastDeliveries.Inc()
+			continue
+		}
+		metrics.SlowConsumers.Inc()
+		c.Log().Warn("disconnecting slow consumer")
+		go c.CloseWithError(model.ErrorSlowConsumer, "slow consumer")
+	}
+}
+
+// Members lists the room's websocket clients and subscribers on this node.
+// Users are known once they have sent an accepted message.
+func (r *Room) Members() []Member {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	members := make([]Member, 0, len(r.Clients)+len(r.Subscribers))
+	for c := range r.Clients {
+		members = append(members, Member{ConnId: c.ID, UserId: c.UserId(), Username: c.Username(), Transport: "websocket"})
+	}
+	for s := range r.Subscribers {
+		m := Member{ConnId: s.ConnID(), Transport: s.Transport()}
+		if user, ok := s.(interface {
+			UserId() string
+			Username() string
+		}); ok {
+			m.UserId, m.Username = user.UserId(), user.Username()
+		}
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+	return members
+}
+
+// Topic returns the room's topic
+func (r *Room) Topic() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.topic
+}
+
+func (r *Room) SetTopic(topic string) {
+	r.mu.Lock()
+	r.topic = topic
+	r.mu.Unlock()
+}
+
+// Snapshot returns the clients currently registered in the room
+func (r *Room) Snapshot() []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(r.Clients))
+	for c := range r.Clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
 // Manager manages multiple rooms
 type Manager struct {
 	Rooms map[string]*Room
 	mu    sync.RWMutex
+
+	nodeId    string
+	backplane cluster.Backplane
+	history   store.Store
+	ring      *cluster.Ring        // guarded by mu; nil unless ownership is enabled
+	retention store.RetentionRules // guarded by mu
+
+	onRoomCreated func(roomId string)
+
+	draining atomic.Bool
+	drainMu  sync.Mutex
+	drain    DrainStatus
 }
 
-func NewManager() *Manager {
+// NewManager creates the rooms of node nodeId, connected through bp and
+// recording their broadcasts in history
+func NewManager(nodeId string, bp cluster.Backplane, history store.Store) *Manager {
 	return &Manager{
-		Rooms: make(map[string]*Room),
+		Rooms:     make(map[string]*Room),
+		nodeId:    nodeId,
+		backplane: bp,
+		history:   history,
 	}
 }
 
+// NodeID returns the ID of this node in the cluster
+func (m *Manager) NodeID() string {
+	return m.nodeId
+}
+
+// Room returns roomId if it exists on this node, without creating it
+func (m *Manager) Room(roomId string) (*Room, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.Rooms[roomId]
+	return room, ok
+}
+
 func (m *Manager) GetRoom(roomId string) *Room {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -75,8 +270,49 @@ func (m *Manager) GetRoom(roomId string) *Room {
 		return room
 	}
 
-	room := NewRoom(roomId)
+	room := NewRoom(roomId, m.nodeId, m.backplane, m.history)
+	room.SetRetention(m.retention.For(roomId))
 	m.Rooms[roomId] = room
 	go room.Run()
+	if m.onRoomCreated != nil {
+		m.onRoomCreated(roomId)
+	}
 	return room
 }
+
+// OnRoomCreated registers fn to be called, with the manager locked, when a
+// room is created on this node. fn must not block.
+func (m *Manager) OnRoomCreated(fn func(roomId string)) {
+	m.mu.Lock()
+	m.onRoomCreated = fn
+	m.mu.Unlock()
+}
+
+// AllClients returns the clients registered across every room
+func (m *Manager) AllClients() []*Client {
+	var clients []*Client
+	for _, room := range m.RoomList() {
+		clients = append(clients, room.Snapshot()...)
+	}
+	return clients
+}
+
+// RoomList returns the rooms that exist on this node, sorted by ID
+func (m *Manager) RoomList() []*Room {
+	m.mu.RLock()
+	rooms := make([]*Room, 0, len(m.Rooms))
+	for _, room := range m.Rooms {
+		rooms = append(rooms, room)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms
+}
+
+// RoomCount returns the number of rooms that exist on this node
+func (m *Manager) RoomCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.Rooms)
+}
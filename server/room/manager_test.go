@@ -0,0 +1,151 @@
+package room
+
+import (
+	"chatroom/server/cluster"
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testSubscriber collects the broadcasts a room delivers to it
+type testSubscriber struct {
+	connId string
+	msgs   chan model.ServerResponse
+}
+
+func newTestSubscriber(connId string) *testSubscriber {
+	return &testSubscriber{connId: connId, msgs: make(chan model.ServerResponse, 16)}
+}
+
+func (s *testSubscriber) ConnID() string    { return s.connId }
+func (s *testSubscriber) Transport() string { return "test" }
+
+func (s *testSubscriber) Deliver(msg model.ServerResponse) bool {
+	select {
+	case s.msgs <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *testSubscriber) next(t *testing.T) model.ServerResponse {
+	t.Helper()
+	select {
+	case msg := <-s.msgs:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("subscriber %q got nothing", s.connId)
+		return model.ServerResponse{}
+	}
+}
+
+func (s *testSubscriber) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-s.msgs:
+		t.Fatalf("subscriber %q got %+v", s.connId, msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func accepted(text string) model.ServerResponse {
+	return model.ServerResponse{
+		Message: model.Message{
+			UserId:      "1",
+			Username:    "alice",
+			Message:     text,
+			Timestamp:   time.Now(),
+			MessageType: model.MessageTypeText,
+		},
+		Status:          model.StatusOK,
+		ServerTimestamp: time.Now(),
+	}
+}
+
+func TestBroadcastCrossesNodes(t *testing.T) {
+	bp := cluster.NewInProcess()
+	historyA, historyB := store.NewMemoryStore(100), store.NewMemoryStore(100)
+	a := NewManager("a", bp, historyA)
+	b := NewManager("b", bp, historyB)
+
+	sender := newTestSubscriber("c1")
+	localPeer := newTestSubscriber("c2")
+	remotePeer := newTestSubscriber("c1") // same ID on another node is another connection
+	roomA, roomB := a.GetRoom("7"), b.GetRoom("7")
+	roomA.AddSubscriber(sender)
+	roomA.AddSubscriber(localPeer)
+	roomB.AddSubscriber(remotePeer)
+	other := newTestSubscriber("c3")
+	b.GetRoom("8").AddSubscriber(other)
+
+	if err := roomA.Publish("c1", accepted("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*testSubscriber{localPeer, remotePeer} {
+		msg := s.next(t)
+		if msg.Message.Message != "hello" || msg.Status != model.StatusBroadcast {
+			t.Errorf("subscriber %q got %+v", s.connId, msg)
+		}
+	}
+	sender.expectNothing(t)
+	other.expectNothing(t)
+
+	for node, history := range map[string]store.Store{"a": historyA, "b": historyB} {
+		msgs, err := history.Since("7", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 {
+			t.Errorf("node %s recorded %d messages, want 1", node, len(msgs))
+		}
+	}
+}
+
+func TestOwnershipAgreesAcrossNodes(t *testing.T) {
+	members := []cluster.Member{{ID: "a", Addr: "localhost:8080"}, {ID: "b", Addr: "localhost:8081"}}
+	bp := cluster.NewInProcess()
+	a := NewManager("a", bp, store.NewMemoryStore(10))
+	b := NewManager("b", bp, store.NewMemoryStore(10))
+
+	if owner, local := a.Owner("7"); !local || owner.ID != "a" {
+		t.Fatalf("without a ring, a.Owner = %+v, %v", owner, local)
+	}
+	if _, err := a.SetMembers(members); err != ErrOwnershipDisabled {
+		t.Fatalf("SetMembers without a ring: %v", err)
+	}
+
+	a.EnableOwnership(cluster.NewRing(0))
+	b.EnableOwnership(cluster.NewRing(0))
+	if _, err := a.SetMembers(members); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SetMembers([]cluster.Member{members[1], members[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	owned := map[string]int{}
+	for i := 0; i < 200; i++ {
+		roomId := strconv.Itoa(i)
+		ownerA, localA := a.Owner(roomId)
+		ownerB, localB := b.Owner(roomId)
+		if ownerA != ownerB {
+			t.Fatalf("room %s: a says %s, b says %s", roomId, ownerA.ID, ownerB.ID)
+		}
+		if localA == localB {
+			t.Fatalf("room %s: local on a %v, on b %v", roomId, localA, localB)
+		}
+		owned[ownerA.ID]++
+
+		want := "ws://" + ownerA.Addr + "/chat/" + roomId
+		if got := RedirectURL(ownerA, roomId); got != want {
+			t.Fatalf("RedirectURL = %q, want %q", got, want)
+		}
+	}
+	if owned["a"] == 0 || owned["b"] == 0 {
+		t.Errorf("rooms owned: %v", owned)
+	}
+}
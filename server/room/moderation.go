@@ -0,0 +1,124 @@
+package room
+
+import (
+	"chatroom/server/model"
+	"sort"
+	"time"
+)
+
+// Kicker is a room member that can be removed by a moderator. code is
+// model.ErrorKicked or model.ErrorBanned.
+type Kicker interface {
+	Kick(code, reason string)
+}
+
+// Kick closes the connection with a policy-violation close frame
+func (c *Client) Kick(code, reason string) {
+	c.Log().Info("client kicked", "code", code, "reason", reason)
+	c.kicked.Store(true)
+	c.CloseWithError(code, reason)
+}
+
+// Kicked reports whether the client was removed with Kick
+func (c *Client) Kicked() bool {
+	return c.kicked.Load()
+}
+
+// Ban keeps a user out of a room until it expires
+type Ban struct {
+	UserId string     `json:"userId"`
+	Reason string     `json:"reason,omitempty"`
+	Until  *time.Time `json:"until,omitempty"` // nil for a permanent ban
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return b.Until != nil && !now.Before(*b.Until)
+}
+
+// Kick removes every connection of userId from the room on this node and
+// returns how many there were. Subscribers without a user, such as event
+// streams, are not affected.
+func (r *Room) Kick(userId, reason string) int {
+	return r.kick(userId, model.ErrorKicked, reason)
+}
+
+func (r *Room) kick(userId, code, reason string) int {
+	var kick []Kicker
+	r.mu.RLock()
+	for c := range r.Clients {
+		if c.UserId() == userId {
+			kick = append(kick, c)
+		}
+	}
+	for s := range r.Subscribers {
+		k, ok := s.(interface {
+			Kicker
+			UserId() string
+		})
+		if ok && k.UserId() == userId {
+			kick = append(kick, k)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, k := range kick {
+		k.Kick(code, reason)
+	}
+	return len(kick)
+}
+
+// Ban keeps userId out of the room, and kicks its current connections. A
+// zero until bans permanently. It returns the number of kicked connections.
+func (r *Room) Ban(userId, reason string, until time.Time) int {
+	ban := Ban{UserId: userId, Reason: reason}
+	if !until.IsZero() {
+		ban.Until = &until
+	}
+	r.mu.Lock()
+	if r.bans == nil {
+		r.bans = make(map[string]Ban)
+	}
+	r.bans[userId] = ban
+	r.mu.Unlock()
+
+	if reason == "" {
+		reason = "banned"
+	}
+	return r.kick(userId, model.ErrorBanned, reason)
+}
+
+// Unban lifts the ban of userId and reports whether there was one
+func (r *Room) Unban(userId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.bans[userId]
+	delete(r.bans, userId)
+	return ok
+}
+
+// Banned reports whether userId is banned from the room
+func (r *Room) Banned(userId string) bool {
+	r.mu.RLock()
+	ban, ok := r.bans[userId]
+	r.mu.RUnlock()
+	return ok && !ban.expired(time.Now())
+}
+
+// Bans lists the room's current bans, sorted by userId. Expired bans are
+// dropped.
+func (r *Room) Bans() []Ban {
+	now := time.Now()
+	r.mu.Lock()
+	bans := make([]Ban, 0, len(r.bans))
+	for userId, ban := range r.bans {
+		if ban.expired(now) {
+			delete(r.bans, userId)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].UserId < bans[j].UserId })
+	return bans
+}
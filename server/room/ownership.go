@@ -0,0 +1,84 @@
+package room
+
+import (
+	"chatroom/server/cluster"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"errors"
+	"log/slog"
+)
+
+var ErrOwnershipDisabled = errors.New("room ownership is not enabled")
+
+// EnableOwnership makes every room owned by a single node of ring. Until it
+// is called, or while the ring is empty, this node serves every room.
+func (m *Manager) EnableOwnership(ring *cluster.Ring) {
+	m.mu.Lock()
+	m.ring = ring
+	m.mu.Unlock()
+}
+
+// Ring returns the ownership ring, or nil when ownership is disabled
+func (m *Manager) Ring() *cluster.Ring {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ring
+}
+
+// Owner returns the member that owns roomId and whether that is this node
+func (m *Manager) Owner(roomId string) (cluster.Member, bool) {
+	ring := m.Ring()
+	if ring == nil {
+		return cluster.Member{ID: m.nodeId}, true
+	}
+	owner, ok := ring.Owner(roomId)
+	if !ok {
+		return cluster.Member{ID: m.nodeId}, true
+	}
+	return owner, owner.ID == m.nodeId
+}
+
+// SetMembers changes the ring membership and redirects the clients of the
+// rooms this node no longer owns. It returns the number of redirected clients.
+func (m *Manager) SetMembers(members []cluster.Member) (int, error) {
+	ring := m.Ring()
+	if ring == nil {
+		return 0, ErrOwnershipDisabled
+	}
+	if err := ring.Set(members); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, room := range m.RoomList() {
+		owner, local := m.Owner(room.ID)
+		if local {
+			continue
+		}
+		for _, c := range room.Snapshot() {
+			metrics.Redirects.Inc("rebalance")
+			RedirectClient(c, owner, room.ID)
+			moved++
+		}
+	}
+
+	slog.Info("ring membership changed", "version", ring.Version(), "members", len(members), "clientsRedirected", moved)
+	return moved, nil
+}
+
+// RedirectURL is where clients of roomId should connect on owner
+func RedirectURL(owner cluster.Member, roomId string) string {
+	return owner.URL("/chat/" + roomId)
+}
+
+// RedirectClient tells c which node owns its room and closes the connection
+func RedirectClient(c *Client, owner cluster.Member, roomId string) {
+	c.Log().Debug("redirecting client", "owner", owner.ID)
+	c.Write(model.ControlMessage{
+		Type:   model.ControlTypeRedirect,
+		Reason: "room owned by another node",
+		URL:    RedirectURL(owner, roomId),
+		NodeId: owner.ID,
+	})
+	c.CloseWithError(model.ErrorRoomMoved, "room moved")
+}
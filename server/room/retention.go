@@ -0,0 +1,93 @@
+package room
+
+import (
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"log/slog"
+	"time"
+)
+
+// Retention returns how much of the room's history is kept
+func (r *Room) Retention() store.Retention {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.retention
+}
+
+// SetRetention changes how much of the room's history is kept from the
+// next compaction on. A bounded store is resized for keep at once.
+func (r *Room) SetRetention(keep store.Retention) {
+	r.mu.Lock()
+	r.retention = keep
+	r.mu.Unlock()
+	if bounded, ok := r.history.(store.Bounded); ok {
+		bounded.SetCapacity(r.ID, keep.Capacity())
+	}
+}
+
+// History describes the room's retained history
+func (r *Room) History() (store.Stats, error) {
+	return r.history.Stats(r.ID)
+}
+
+// Since returns the retained messages after afterSeq, oldest first
+func (r *Room) Since(afterSeq uint64) ([]model.ServerResponse, error) {
+	return r.history.Since(r.ID, afterSeq, 0)
+}
+
+// SetRetentionRules sets the retention of rooms created from now on
+func (m *Manager) SetRetentionRules(rules store.RetentionRules) {
+	m.mu.Lock()
+	m.retention = rules
+	m.mu.Unlock()
+}
+
+// DefaultRetention is the retention a new room roomId would get
+func (m *Manager) DefaultRetention(roomId string) store.Retention {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.retention.For(roomId)
+}
+
+// Compact applies every room's retention to the history store and returns
+// the number of messages removed
+func (m *Manager) Compact(now time.Time) int {
+	removed := 0
+	for _, room := range m.RoomList() {
+		keep := room.Retention()
+		if keep.Policy == store.KeepForever {
+			continue
+		}
+		n, err := m.history.Compact(room.ID, keep, now)
+		if err != nil {
+			slog.Warn("history compaction failed", "roomId", room.ID, "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Debug("history compacted", "roomId", room.ID, "retention", keep.String(), "removed", n)
+		}
+		removed += n
+	}
+	metrics.HistoryCompacted.Add(uint64(removed))
+	return removed
+}
+
+// StartCompactor runs Compact every interval until the returned function
+// is called
+func (m *Manager) StartCompactor(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				m.Compact(now)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,103 @@
+package room
+
+import (
+	"chatroom/server/cluster"
+	"chatroom/server/store"
+	"testing"
+	"time"
+)
+
+// fill records n broadcasts in roomId's history, dated at
+func fill(t *testing.T, history store.Store, roomId string, n int, at time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		msg := accepted("hi")
+		msg.ServerTimestamp = at
+		if _, err := history.Append(roomId, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func historySize(t *testing.T, history store.Store, roomId string) int {
+	t.Helper()
+	stats, err := history.Stats(roomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.Messages
+}
+
+func TestCompactAppliesEachRoomsRetention(t *testing.T) {
+	history := store.NewMemoryStore(100)
+	m := NewManager("a", cluster.NewInProcess(), history)
+	rules, err := store.ParseRetentionRules("support-*=1h,audit-*=forever,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetRetentionRules(rules)
+
+	now := time.Now()
+	for _, roomId := range []string{"support-1", "audit-1", "lobby"} {
+		m.GetRoom(roomId)
+		fill(t, history, roomId, 20, now.Add(-2*time.Hour))
+		fill(t, history, roomId, 5, now)
+	}
+	m.GetRoom("custom").SetRetention(store.Retention{Policy: store.KeepMessages, Messages: 3})
+	fill(t, history, "custom", 5, now)
+
+	// Message counts are held to by the store as messages arrive, so only
+	// the age policy has anything left to remove
+	if removed := m.Compact(now); removed != 20 {
+		t.Errorf("Compact removed %d, want 20", removed)
+	}
+	want := map[string]int{"support-1": 5, "audit-1": 25, "lobby": 10, "custom": 3}
+	for roomId, n := range want {
+		if got := historySize(t, history, roomId); got != n {
+			t.Errorf("%s keeps %d messages, want %d", roomId, got, n)
+		}
+	}
+}
+
+func TestRetentionSizesTheStore(t *testing.T) {
+	history := store.NewMemoryStore(10)
+	m := NewManager("a", cluster.NewInProcess(), history)
+	rules, err := store.ParseRetentionRules("big=50,audit=forever:30,small=24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetRetentionRules(rules)
+
+	want := map[string]int{"big": 50, "audit": 30, "small": 10}
+	for roomId, n := range want {
+		m.GetRoom(roomId)
+		fill(t, history, roomId, 100, time.Now())
+		if got := historySize(t, history, roomId); got != n {
+			t.Errorf("%s holds %d messages, want %d", roomId, got, n)
+		}
+	}
+
+	// Shrinking a room's retention shrinks what the store holds at once
+	m.GetRoom("big").SetRetention(store.Retention{Policy: store.KeepMessages, Messages: 5})
+	if got := historySize(t, history, "big"); got != 5 {
+		t.Errorf("big holds %d messages after shrinking, want 5", got)
+	}
+}
+
+func TestCompactorRuns(t *testing.T) {
+	history := store.NewMemoryStore(100)
+	m := NewManager("a", cluster.NewInProcess(), history)
+	m.SetRetentionRules(store.RetentionRules{{Pattern: "*", Retention: store.Retention{Policy: store.KeepAge, MaxAge: time.Minute}}})
+	m.GetRoom("7")
+	fill(t, history, "7", 5, time.Now().Add(-time.Hour))
+
+	stop := m.StartCompactor(10 * time.Millisecond)
+	defer stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for historySize(t, history, "7") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("compactor never removed the expired messages")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
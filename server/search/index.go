@@ -0,0 +1,431 @@
+// Package search is an inverted index over the text of room history. It
+// is kept up to date by wrapping the history store, so it holds the same
+// messages the store retains and can be rebuilt from it.
+package search
+
+import (
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// posting is one message containing a term, with the term's positions
+type posting struct {
+	seq       uint64
+	positions []int
+}
+
+// roomIndex indexes one room's messages by sequence number
+type roomIndex struct {
+	mu       sync.RWMutex
+	docs     map[uint64]model.ServerResponse
+	postings map[string][]posting // sorted by seq
+	minSeq   uint64               // postings below this belong to pruned messages
+	stale    int                  // pruned messages still in postings
+}
+
+func newRoomIndex() *roomIndex {
+	return &roomIndex{
+		docs:     make(map[uint64]model.ServerResponse),
+		postings: make(map[string][]posting),
+	}
+}
+
+// Index is a per-room inverted index of message text
+type Index struct {
+	mu       sync.RWMutex
+	rooms    map[string]*roomIndex
+	rebuilds map[string][]*rebuild // in progress, by room
+}
+
+func NewIndex() *Index {
+	return &Index{
+		rooms:    make(map[string]*roomIndex),
+		rebuilds: make(map[string][]*rebuild),
+	}
+}
+
+// rebuild collects the messages added to a room while its index is being
+// rebuilt from history, which may have been read before they were stored
+type rebuild struct {
+	mu   sync.Mutex
+	msgs []model.ServerResponse
+}
+
+func (rb *rebuild) add(msg model.ServerResponse) {
+	rb.mu.Lock()
+	rb.msgs = append(rb.msgs, msg)
+	rb.mu.Unlock()
+}
+
+func (x *Index) room(roomId string, create bool) *roomIndex {
+	x.mu.RLock()
+	ri := x.rooms[roomId]
+	x.mu.RUnlock()
+	if ri != nil || !create {
+		return ri
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if ri = x.rooms[roomId]; ri == nil {
+		ri = newRoomIndex()
+		x.rooms[roomId] = ri
+	}
+	return ri
+}
+
+// searchable reports whether msg carries text people would search for
+func searchable(msg model.ServerResponse) bool {
+	switch msg.MessageType {
+	case model.MessageTypeText, model.MessageTypeAction:
+		return msg.Seq > 0 && msg.Message.Message != ""
+	}
+	return false
+}
+
+// Add indexes a stored message; messages without a sequence number or
+// text to search are ignored
+func (x *Index) Add(roomId string, msg model.ServerResponse) {
+	if !searchable(msg) {
+		return
+	}
+	x.mu.RLock()
+	for _, rb := range x.rebuilds[roomId] {
+		rb.add(msg)
+	}
+	x.mu.RUnlock()
+	ri := x.room(roomId, true)
+
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.add(msg)
+}
+
+func (ri *roomIndex) add(msg model.ServerResponse) {
+	if msg.Seq < ri.minSeq {
+		return
+	}
+	if _, exists := ri.docs[msg.Seq]; exists {
+		return
+	}
+	ri.docs[msg.Seq] = msg
+
+	positions := make(map[string][]int)
+	for i, term := range Tokenize(msg.Message.Message) {
+		positions[term] = append(positions[term], i)
+	}
+	for term, pos := range positions {
+		list := ri.postings[term]
+		p := posting{seq: msg.Seq, positions: pos}
+		// Messages nearly always arrive in order; insert the rest in place
+		i := len(list)
+		for i > 0 && list[i-1].seq > msg.Seq {
+			i--
+		}
+		list = append(list, posting{})
+		copy(list[i+1:], list[i:])
+		list[i] = p
+		ri.postings[term] = list
+	}
+}
+
+// Prune drops the messages of roomId below seq, e.g. once the store no
+// longer retains them
+func (x *Index) Prune(roomId string, seq uint64) {
+	ri := x.room(roomId, false)
+	if ri == nil {
+		return
+	}
+
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.prune(seq)
+}
+
+func (ri *roomIndex) prune(seq uint64) {
+	if seq <= ri.minSeq {
+		return
+	}
+	drop := func(s uint64) {
+		if _, ok := ri.docs[s]; ok {
+			delete(ri.docs, s)
+			ri.stale++
+		}
+	}
+	// Retention usually moves by one message; walk the range when it is
+	// shorter than the map
+	if seq-ri.minSeq <= uint64(len(ri.docs)) {
+		for s := ri.minSeq; s < seq; s++ {
+			drop(s)
+		}
+	} else {
+		for s := range ri.docs {
+			if s < seq {
+				drop(s)
+			}
+		}
+	}
+	ri.minSeq = seq
+	// Postings of pruned messages are skipped by queries; compact them
+	// once they outnumber the live messages
+	if ri.stale > len(ri.docs) {
+		ri.compact()
+	}
+}
+
+func (ri *roomIndex) compact() {
+	for term, list := range ri.postings {
+		i := sort.Search(len(list), func(i int) bool { return list[i].seq >= ri.minSeq })
+		if i == len(list) {
+			delete(ri.postings, term)
+			continue
+		}
+		ri.postings[term] = append([]posting(nil), list[i:]...)
+	}
+	ri.stale = 0
+}
+
+// Rebuild replaces the index of roomId with the messages history retains.
+// Messages added while history is read are indexed too, and pruning done
+// meanwhile is kept. It returns the number of messages indexed.
+func (x *Index) Rebuild(roomId string, history store.Store) (int, error) {
+	rb := &rebuild{}
+	x.mu.Lock()
+	x.rebuilds[roomId] = append(x.rebuilds[roomId], rb)
+	x.mu.Unlock()
+
+	msgs, err := history.Since(roomId, 0, 0)
+	if err != nil {
+		x.mu.Lock()
+		x.endRebuild(roomId, rb)
+		x.mu.Unlock()
+		return 0, err
+	}
+
+	ri := newRoomIndex()
+	for _, msg := range msgs {
+		if searchable(msg) {
+			ri.add(msg)
+		}
+	}
+
+	// Adds wait for the swap, so none falls between the catch-up and it
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.endRebuild(roomId, rb)
+	rb.mu.Lock()
+	for _, msg := range rb.msgs {
+		ri.add(msg)
+	}
+	rb.mu.Unlock()
+	if old := x.rooms[roomId]; old != nil {
+		old.mu.RLock()
+		minSeq := old.minSeq
+		old.mu.RUnlock()
+		ri.prune(minSeq)
+	}
+	x.rooms[roomId] = ri
+	return len(ri.docs), nil
+}
+
+// endRebuild stops collecting messages for rb. x.mu must be held.
+func (x *Index) endRebuild(roomId string, rb *rebuild) {
+	rebuilds := x.rebuilds[roomId]
+	for i, r := range rebuilds {
+		if r == rb {
+			rebuilds = append(rebuilds[:i], rebuilds[i+1:]...)
+			break
+		}
+	}
+	if len(rebuilds) == 0 {
+		delete(x.rebuilds, roomId)
+	} else {
+		x.rebuilds[roomId] = rebuilds
+	}
+}
+
+// Rooms lists the rooms with an index
+func (x *Index) Rooms() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	rooms := make([]string, 0, len(x.rooms))
+	for roomId := range x.rooms {
+		rooms = append(rooms, roomId)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Tokenize lower-cases text and splits it into words of letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Query is a parsed search. Every term and every phrase must match.
+type Query struct {
+	Terms    []string
+	Phrases  [][]string // words that must appear consecutively
+	Username string     // exact, case-insensitive; empty matches anyone
+	From     time.Time  // server timestamps at or after; zero for no bound
+	To       time.Time  // server timestamps before; zero for no bound
+	Before   uint64     // only messages with a lower seq, for paging; 0 for no bound
+	Limit    int
+}
+
+// ParseQuery splits q into terms and "quoted phrases"
+func ParseQuery(q string) Query {
+	var query Query
+	for i, part := range strings.Split(q, `"`) {
+		words := Tokenize(part)
+		if i%2 == 1 && len(words) > 1 {
+			query.Phrases = append(query.Phrases, words)
+			continue
+		}
+		query.Terms = append(query.Terms, words...)
+	}
+	return query
+}
+
+// Empty reports whether the query has nothing to match
+func (q Query) Empty() bool {
+	return len(q.Terms) == 0 && len(q.Phrases) == 0
+}
+
+// Result is a page of matches, newest first
+type Result struct {
+	Total    int                    `json:"total"` // matches across all pages
+	Messages []model.ServerResponse `json:"messages"`
+	Next     uint64                 `json:"next,omitempty"` // pass as before= for the next page
+}
+
+// Search runs q over roomId's messages
+func (x *Index) Search(roomId string, q Query) Result {
+	result := Result{Messages: []model.ServerResponse{}}
+	ri := x.room(roomId, false)
+	if ri == nil || q.Empty() {
+		return result
+	}
+
+	ri.mu.RLock()
+	defer ri.mu.RUnlock()
+
+	// Every word of the query must be in the message; phrases then also
+	// need their words at consecutive positions
+	words := append([]string(nil), q.Terms...)
+	for _, phrase := range q.Phrases {
+		words = append(words, phrase...)
+	}
+	lists := make(map[string]map[uint64][]int, len(words))
+	for _, w := range words {
+		if _, done := lists[w]; done {
+			continue
+		}
+		m := make(map[uint64][]int, len(ri.postings[w]))
+		for _, p := range ri.postings[w] {
+			if p.seq >= ri.minSeq {
+				m[p.seq] = p.positions
+			}
+		}
+		if len(m) == 0 {
+			return result
+		}
+		lists[w] = m
+	}
+
+	// Candidates come from the rarest word
+	rarest := words[0]
+	for _, w := range words[1:] {
+		if len(lists[w]) < len(lists[rarest]) {
+			rarest = w
+		}
+	}
+
+	// Total counts every page, so the cursor is applied after counting
+	var matches []uint64
+	for seq := range lists[rarest] {
+		msg, ok := ri.docs[seq]
+		if !ok || !q.accepts(msg) || !containsAll(lists, words, seq) {
+			continue
+		}
+		if !containsPhrases(lists, q.Phrases, seq) {
+			continue
+		}
+		result.Total++
+		if q.Before > 0 && seq >= q.Before {
+			continue
+		}
+		matches = append(matches, seq)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+
+	limit := q.Limit
+	if limit <= 0 || limit > len(matches) {
+		limit = len(matches)
+	}
+	for _, seq := range matches[:limit] {
+		result.Messages = append(result.Messages, ri.docs[seq])
+	}
+	if limit < len(matches) {
+		result.Next = matches[limit-1]
+	}
+	return result
+}
+
+// accepts applies the username and time filters
+func (q Query) accepts(msg model.ServerResponse) bool {
+	if q.Username != "" && !strings.EqualFold(msg.Username, q.Username) {
+		return false
+	}
+	if !q.From.IsZero() && msg.ServerTimestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !msg.ServerTimestamp.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+func containsAll(lists map[string]map[uint64][]int, words []string, seq uint64) bool {
+	for _, w := range words {
+		if _, ok := lists[w][seq]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// containsPhrases checks that each phrase's words follow each other in seq
+func containsPhrases(lists map[string]map[uint64][]int, phrases [][]string, seq uint64) bool {
+	for _, phrase := range phrases {
+		found := false
+		for _, start := range lists[phrase[0]][seq] {
+			if phraseAt(lists, phrase, seq, start) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func phraseAt(lists map[string]map[uint64][]int, phrase []string, seq uint64, start int) bool {
+	for i, w := range phrase[1:] {
+		positions := lists[w][seq]
+		j := sort.SearchInts(positions, start+i+1)
+		if j == len(positions) || positions[j] != start+i+1 {
+			return false
+		}
+	}
+	return true
+}
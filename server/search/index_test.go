@@ -0,0 +1,137 @@
+package search
+
+import (
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"testing"
+	"time"
+)
+
+// blockingStore pauses Since until released, so messages can be appended
+// while a rebuild is reading history
+type blockingStore struct {
+	store.Store
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Since(roomId string, afterSeq uint64, limit int) ([]model.ServerResponse, error) {
+	msgs, err := s.Store.Since(roomId, afterSeq, limit)
+	close(s.reading)
+	<-s.release
+	return msgs, err
+}
+
+func textMessage(text string) model.ServerResponse {
+	return model.ServerResponse{
+		Message: model.Message{
+			UserId:      "1",
+			Username:    "alice",
+			Message:     text,
+			MessageType: model.MessageTypeText,
+		},
+		Status:          model.StatusBroadcast,
+		ServerTimestamp: time.Now(),
+	}
+}
+
+func TestRebuildKeepsMessagesAppendedDuringRebuild(t *testing.T) {
+	history := store.NewMemoryStore(100)
+	index := NewIndex()
+	indexed := NewIndexedStore(history, index)
+
+	if _, err := indexed.Append("r1", textMessage("before rebuild")); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := &blockingStore{Store: history, reading: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan int)
+	go func() {
+		n, err := index.Rebuild("r1", slow)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- n
+	}()
+
+	<-slow.reading
+	if _, err := indexed.Append("r1", textMessage("during rebuild")); err != nil {
+		t.Fatal(err)
+	}
+	close(slow.release)
+
+	if n := <-done; n != 2 {
+		t.Errorf("Rebuild indexed %d messages, want 2", n)
+	}
+	for _, q := range []string{"before", "during"} {
+		if got := index.Search("r1", ParseQuery(q)).Total; got != 1 {
+			t.Errorf("search %q found %d messages after rebuild, want 1", q, got)
+		}
+	}
+}
+
+func TestRebuildKeepsPruning(t *testing.T) {
+	history := store.NewMemoryStore(100)
+	index := NewIndex()
+	indexed := NewIndexedStore(history, index)
+	for _, text := range []string{"one", "two", "three"} {
+		if _, err := indexed.Append("r1", textMessage(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slow := &blockingStore{Store: history, reading: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		index.Rebuild("r1", slow)
+		close(done)
+	}()
+
+	<-slow.reading
+	index.Prune("r1", 3)
+	close(slow.release)
+	<-done
+
+	if got := index.Search("r1", ParseQuery("one")).Total; got != 0 {
+		t.Errorf("pruned message found %d times after rebuild", got)
+	}
+	if got := index.Search("r1", ParseQuery("three")).Total; got != 1 {
+		t.Errorf("search found %d retained messages, want 1", got)
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	index := NewIndex()
+	indexed := NewIndexedStore(store.NewMemoryStore(100), index)
+	for i := 0; i < 5; i++ {
+		if _, err := indexed.Append("r1", textMessage("deploy done")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := indexed.Append("r1", textMessage("unrelated")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := ParseQuery("deploy")
+	q.Limit = 2
+	var seen []uint64
+	for page := 0; ; page++ {
+		result := index.Search("r1", q)
+		if result.Total != 5 {
+			t.Fatalf("page %d: Total = %d, want 5", page, result.Total)
+		}
+		for _, msg := range result.Messages {
+			if len(seen) > 0 && msg.Seq >= seen[len(seen)-1] {
+				t.Fatalf("page %d: seq %d not older than %d", page, msg.Seq, seen[len(seen)-1])
+			}
+			seen = append(seen, msg.Seq)
+		}
+		if result.Next == 0 {
+			break
+		}
+		q.Before = result.Next
+	}
+	if len(seen) != 5 {
+		t.Fatalf("paged through %d matches, want 5", len(seen))
+	}
+}
@@ -0,0 +1,60 @@
+package search
+
+import (
+	"chatroom/server/model"
+	"chatroom/server/store"
+	"log/slog"
+	"time"
+)
+
+// IndexedStore is a Store that indexes every message it appends and drops
+// messages from the index once the store no longer retains them
+type IndexedStore struct {
+	store.Store
+	index *Index
+}
+
+// NewIndexedStore wraps history so index follows it
+func NewIndexedStore(history store.Store, index *Index) *IndexedStore {
+	return &IndexedStore{Store: history, index: index}
+}
+
+func (s *IndexedStore) Append(roomId string, msg model.ServerResponse) (model.ServerResponse, error) {
+	stored, err := s.Store.Append(roomId, msg)
+	if err != nil {
+		return stored, err
+	}
+	s.index.Add(roomId, stored)
+	s.prune(roomId)
+	return stored, nil
+}
+
+func (s *IndexedStore) Compact(roomId string, keep store.Retention, now time.Time) (int, error) {
+	removed, err := s.Store.Compact(roomId, keep, now)
+	if removed > 0 {
+		s.prune(roomId)
+	}
+	return removed, err
+}
+
+// SetCapacity changes the capacity of the wrapped store if it is bounded
+func (s *IndexedStore) SetCapacity(roomId string, n int) {
+	if bounded, ok := s.Store.(store.Bounded); ok {
+		bounded.SetCapacity(roomId, n)
+		s.prune(roomId)
+	}
+}
+
+// prune drops the messages the store no longer retains from the index
+func (s *IndexedStore) prune(roomId string) {
+	stats, err := s.Store.Stats(roomId)
+	if err != nil {
+		slog.Warn("search index prune failed", "roomId", roomId, "err", err)
+		return
+	}
+	if stats.Messages == 0 {
+		s.index.Prune(roomId, stats.LastSeq+1)
+		return
+	}
+	s.index.Prune(roomId, stats.FirstSeq)
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention policies
+const (
+	KeepForever  = "forever"
+	KeepMessages = "messages"
+	KeepAge      = "age"
+)
+
+// Retention is how much of a room's history to keep: the latest Messages
+// messages, the messages of the last MaxAge, or everything. Stores with a
+// bounded capacity hold Capacity messages of the room.
+type Retention struct {
+	Policy   string
+	Messages int
+	MaxAge   time.Duration
+	// MaxMessages bounds the age and forever policies in stores with a
+	// bounded capacity; 0 leaves the store's default
+	MaxMessages int
+}
+
+// Forever keeps every message
+var Forever = Retention{Policy: KeepForever}
+
+// ParseRetention parses "forever", a message count such as "500" or a
+// duration such as "72h". Forever and durations may add the most messages
+// to hold after a colon, e.g. "forever:100000".
+func ParseRetention(s string) (Retention, error) {
+	s = strings.TrimSpace(s)
+	if policy, max, ok := strings.Cut(s, ":"); ok {
+		r, err := ParseRetention(policy)
+		if err != nil {
+			return Retention{}, err
+		}
+		if r.Policy == KeepMessages {
+			return Retention{}, fmt.Errorf("retention %q: a message count is its own maximum", s)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(max))
+		if err != nil || n < 1 {
+			return Retention{}, fmt.Errorf("retention %q: maximum must be a positive message count", s)
+		}
+		r.MaxMessages = n
+		return r, nil
+	}
+	if s == KeepForever {
+		return Forever, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 {
+			return Retention{}, errors.New("retention must keep at least 1 message")
+		}
+		return Retention{Policy: KeepMessages, Messages: n}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return Retention{}, errors.New("retention duration must be positive")
+		}
+		return Retention{Policy: KeepAge, MaxAge: d}, nil
+	}
+	return Retention{}, fmt.Errorf("retention %q is not forever, a message count or a duration", s)
+}
+
+// Capacity is how many messages a bounded store must hold for r, or 0 for
+// its default
+func (r Retention) Capacity() int {
+	if r.Policy == KeepMessages {
+		return r.Messages
+	}
+	return r.MaxMessages
+}
+
+func (r Retention) String() string {
+	s := KeepForever
+	switch r.Policy {
+	case KeepMessages:
+		return strconv.Itoa(r.Messages)
+	case KeepAge:
+		s = r.MaxAge.String()
+	}
+	if r.MaxMessages > 0 {
+		s += ":" + strconv.Itoa(r.MaxMessages)
+	}
+	return s
+}
+
+type retentionJSON struct {
+	Policy      string `json:"policy"`
+	Messages    int    `json:"messages,omitempty"`
+	MaxAge      string `json:"maxAge,omitempty"`
+	MaxMessages int    `json:"maxMessages,omitempty"`
+}
+
+// MarshalJSON writes e.g. {"policy":"age","maxAge":"24h0m0s"}
+func (r Retention) MarshalJSON() ([]byte, error) {
+	v := retentionJSON{Policy: r.Policy, Messages: r.Messages, MaxMessages: r.MaxMessages}
+	if r.Policy == "" {
+		v.Policy = KeepForever
+	}
+	if r.Policy == KeepAge {
+		v.MaxAge = r.MaxAge.String()
+	}
+	return json.Marshal(v)
+}
+
+func (r *Retention) UnmarshalJSON(data []byte) error {
+	var v retentionJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	var parsed Retention
+	var err error
+	switch v.Policy {
+	case KeepForever:
+		parsed = Forever
+	case KeepMessages:
+		parsed, err = ParseRetention(strconv.Itoa(v.Messages))
+	case KeepAge:
+		parsed, err = ParseRetention(v.MaxAge)
+		if err == nil && (parsed.Policy != KeepAge || parsed.MaxMessages > 0) {
+			err = fmt.Errorf("maxAge %q is not a duration", v.MaxAge)
+		}
+	default:
+		err = fmt.Errorf("unknown retention policy %q (want forever, messages or age)", v.Policy)
+	}
+	if err == nil && v.MaxMessages != 0 {
+		switch {
+		case parsed.Policy == KeepMessages:
+			err = errors.New("maxMessages does not apply to the messages policy")
+		case v.MaxMessages < 0:
+			err = errors.New("maxMessages must be positive")
+		default:
+			parsed.MaxMessages = v.MaxMessages
+		}
+	}
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// RetentionRule gives the rooms whose ID matches Pattern (path.Match
+// syntax, e.g. "support-*") a default retention
+type RetentionRule struct {
+	Pattern   string
+	Retention Retention
+}
+
+// RetentionRules are checked in order; the first match wins and rooms
+// that match none keep everything
+type RetentionRules []RetentionRule
+
+// ParseRetentionRules parses comma-separated pattern=retention pairs, e.g.
+// "support-*=24h,audit-*=forever,*=1000". A bare retention means "*".
+func ParseRetentionRules(s string) (RetentionRules, error) {
+	var rules RetentionRules
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(item, "=")
+		if !ok {
+			pattern, value = "*", item
+		}
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("retention pattern %q: %w", pattern, err)
+		}
+		retention, err := ParseRetention(value)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, RetentionRule{Pattern: pattern, Retention: retention})
+	}
+	return rules, nil
+}
+
+// For returns the default retention of roomId
+func (rules RetentionRules) For(roomId string) Retention {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, roomId); ok {
+			return rule.Retention
+		}
+	}
+	return Forever
+}
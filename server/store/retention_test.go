@@ -0,0 +1,93 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Retention
+		ok   bool
+	}{
+		{"forever", Forever, true},
+		{" 500 ", Retention{Policy: KeepMessages, Messages: 500}, true},
+		{"72h", Retention{Policy: KeepAge, MaxAge: 72 * time.Hour}, true},
+		{"forever:100000", Retention{Policy: KeepForever, MaxMessages: 100000}, true},
+		{"24h:5000", Retention{Policy: KeepAge, MaxAge: 24 * time.Hour, MaxMessages: 5000}, true},
+		{"0", Retention{}, false},
+		{"-1h", Retention{}, false},
+		{"500:1000", Retention{}, false},
+		{"forever:0", Retention{}, false},
+		{"forever:many", Retention{}, false},
+		{"always", Retention{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRetention(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseRetention(%q) = %+v, %v", tt.in, got, err)
+		}
+		if tt.ok {
+			if again, _ := ParseRetention(got.String()); again != got {
+				t.Errorf("%q: String %q parses to %+v", tt.in, got.String(), again)
+			}
+		}
+	}
+}
+
+func TestRetentionJSON(t *testing.T) {
+	for _, keep := range []Retention{
+		Forever,
+		{Policy: KeepMessages, Messages: 500},
+		{Policy: KeepAge, MaxAge: 24 * time.Hour, MaxMessages: 5000},
+		{Policy: KeepForever, MaxMessages: 100000},
+	} {
+		data, err := json.Marshal(keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Retention
+		if err := json.Unmarshal(data, &got); err != nil || got != keep {
+			t.Errorf("%s round-tripped to %+v, %v", data, got, err)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"policy":"sometimes"}`,
+		`{"policy":"messages","messages":0}`,
+		`{"policy":"age","maxAge":"500"}`,
+		`{"policy":"age","maxAge":"24h:10"}`,
+		`{"policy":"messages","messages":5,"maxMessages":10}`,
+		`{"policy":"forever","maxMessages":-1}`,
+	} {
+		var got Retention
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("%s decoded to %+v", bad, got)
+		}
+	}
+}
+
+func TestRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules("support-*=24h, audit-*=forever:100000,1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]Retention{
+		"support-1": {Policy: KeepAge, MaxAge: 24 * time.Hour},
+		"audit-7":   {Policy: KeepForever, MaxMessages: 100000},
+		"lobby":     {Policy: KeepMessages, Messages: 1000},
+	}
+	for roomId, want := range tests {
+		if got := rules.For(roomId); got != want {
+			t.Errorf("For(%q) = %+v, want %+v", roomId, got, want)
+		}
+	}
+	if got := RetentionRules(nil).For("lobby"); got != Forever {
+		t.Errorf("no rules: %+v", got)
+	}
+	if _, err := ParseRetentionRules("[=24h"); err == nil {
+		t.Error("invalid pattern parsed")
+	}
+}
@@ -0,0 +1,196 @@
+// Package store keeps the history of the messages broadcast in each room
+package store
+
+import (
+	"chatroom/server/model"
+	"sync"
+	"time"
+)
+
+// Store records the messages broadcast in each room. Append assigns the
+// message the next sequence number of its room, starting at 1, so readers
+// can resume after the last sequence they saw.
+type Store interface {
+	Append(roomId string, msg model.ServerResponse) (model.ServerResponse, error)
+	// Since returns up to limit messages with a sequence above afterSeq,
+	// oldest first; limit <= 0 means all that are retained
+	Since(roomId string, afterSeq uint64, limit int) ([]model.ServerResponse, error)
+	// Compact removes the messages of roomId that keep no longer retains
+	// at now and returns how many it removed
+	Compact(roomId string, keep Retention, now time.Time) (int, error)
+	Stats(roomId string) (Stats, error)
+	Close() error
+}
+
+// Bounded is implemented by stores that hold a limited number of messages
+// per room, so a room's retention can ask for more or fewer than the default
+type Bounded interface {
+	// SetCapacity makes the store hold up to n messages of roomId; 0
+	// restores the default
+	SetCapacity(roomId string, n int)
+}
+
+// Stats describes what a store holds for a room
+type Stats struct {
+	Messages int        `json:"messages"`
+	FirstSeq uint64     `json:"firstSeq,omitempty"`
+	LastSeq  uint64     `json:"lastSeq,omitempty"` // last assigned, retained or not
+	Oldest   *time.Time `json:"oldest,omitempty"`  // server timestamp of the first retained message
+}
+
+// MemoryStore keeps the latest messages of every room in memory. Nothing
+// survives a restart.
+type MemoryStore struct {
+	perRoom int
+
+	mu    sync.RWMutex
+	rooms map[string]*roomLog
+}
+
+type roomLog struct {
+	mu       sync.RWMutex
+	seq      uint64
+	msgs     []model.ServerResponse // contiguous sequence numbers, oldest first
+	capacity int                    // overrides MemoryStore.perRoom when > 0
+}
+
+// NewMemoryStore keeps up to perRoom messages per room unless SetCapacity
+// says otherwise. With perRoom 0 nothing is retained but sequence numbers
+// are still assigned.
+func NewMemoryStore(perRoom int) *MemoryStore {
+	if perRoom < 0 {
+		perRoom = 0
+	}
+	return &MemoryStore{perRoom: perRoom, rooms: make(map[string]*roomLog)}
+}
+
+func (s *MemoryStore) log(roomId string, create bool) *roomLog {
+	s.mu.RLock()
+	l := s.rooms[roomId]
+	s.mu.RUnlock()
+	if l != nil || !create {
+		return l
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l = s.rooms[roomId]; l == nil {
+		l = &roomLog{}
+		s.rooms[roomId] = l
+	}
+	return l
+}
+
+func (s *MemoryStore) Append(roomId string, msg model.ServerResponse) (model.ServerResponse, error) {
+	l := s.log(roomId, true)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	msg.Seq = l.seq
+	if limit := s.limit(l); limit > 0 {
+		l.msgs = append(l.msgs, msg)
+		if len(l.msgs) > limit {
+			l.msgs = l.msgs[len(l.msgs)-limit:]
+		}
+	}
+	return msg, nil
+}
+
+// limit is the most messages l holds. l.mu must be held.
+func (s *MemoryStore) limit(l *roomLog) int {
+	if l.capacity > 0 {
+		return l.capacity
+	}
+	return s.perRoom
+}
+
+func (s *MemoryStore) SetCapacity(roomId string, n int) {
+	l := s.log(roomId, true)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.capacity = max(n, 0)
+	if limit := s.limit(l); len(l.msgs) > limit {
+		l.msgs = append([]model.ServerResponse(nil), l.msgs[len(l.msgs)-limit:]...)
+	}
+}
+
+func (s *MemoryStore) Since(roomId string, afterSeq uint64, limit int) ([]model.ServerResponse, error) {
+	l := s.log(roomId, false)
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.msgs) == 0 {
+		return nil, nil
+	}
+	start := 0
+	if first := l.msgs[0].Seq; afterSeq >= first {
+		start = int(afterSeq - first + 1)
+	}
+	if start >= len(l.msgs) {
+		return nil, nil
+	}
+
+	end := len(l.msgs)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return append([]model.ServerResponse(nil), l.msgs[start:end]...), nil
+}
+
+func (s *MemoryStore) Compact(roomId string, keep Retention, now time.Time) (int, error) {
+	l := s.log(roomId, false)
+	if l == nil {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	drop := 0
+	switch keep.Policy {
+	case KeepMessages:
+		if len(l.msgs) > keep.Messages {
+			drop = len(l.msgs) - keep.Messages
+		}
+	case KeepAge:
+		cutoff := now.Add(-keep.MaxAge)
+		for drop < len(l.msgs) && l.msgs[drop].ServerTimestamp.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		// Copy so the dropped messages can be collected
+		l.msgs = append([]model.ServerResponse(nil), l.msgs[drop:]...)
+	}
+	return drop, nil
+}
+
+func (s *MemoryStore) Stats(roomId string) (Stats, error) {
+	l := s.log(roomId, false)
+	if l == nil {
+		return Stats{}, nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := Stats{Messages: len(l.msgs), LastSeq: l.seq}
+	if len(l.msgs) > 0 {
+		stats.FirstSeq = l.msgs[0].Seq
+		oldest := l.msgs[0].ServerTimestamp
+		stats.Oldest = &oldest
+	}
+	return stats, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
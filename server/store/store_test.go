@@ -0,0 +1,74 @@
+package store
+
+import (
+	"chatroom/server/model"
+	"testing"
+	"time"
+)
+
+func appendN(t *testing.T, s Store, roomId string, n int, ts time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := s.Append(roomId, model.ServerResponse{ServerTimestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func retained(t *testing.T, s Store, roomId string) (int, uint64) {
+	t.Helper()
+	stats, err := s.Stats(roomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.Messages, stats.FirstSeq
+}
+
+func TestMemoryStoreCompact(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		keep     Retention
+		removed  int
+		firstSeq uint64
+	}{
+		{Forever, 0, 1},
+		{Retention{Policy: KeepMessages, Messages: 4}, 6, 7},
+		{Retention{Policy: KeepAge, MaxAge: time.Hour}, 5, 6},
+	}
+	for _, tt := range tests {
+		s := NewMemoryStore(100)
+		appendN(t, s, "7", 5, now.Add(-2*time.Hour))
+		appendN(t, s, "7", 5, now)
+
+		removed, err := s.Compact("7", tt.keep, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, first := retained(t, s, "7")
+		if removed != tt.removed || n != 10-tt.removed || first != tt.firstSeq {
+			t.Errorf("%s: removed %d, kept %d from seq %d", tt.keep, removed, n, first)
+		}
+		if msg, _ := s.Append("7", model.ServerResponse{}); msg.Seq != 11 {
+			t.Errorf("%s: sequence restarted at %d", tt.keep, msg.Seq)
+		}
+	}
+}
+
+func TestMemoryStoreCapacity(t *testing.T) {
+	s := NewMemoryStore(5)
+	s.SetCapacity("audit", 20)
+	appendN(t, s, "audit", 30, time.Now())
+	appendN(t, s, "lobby", 30, time.Now())
+
+	if n, first := retained(t, s, "audit"); n != 20 || first != 11 {
+		t.Fatalf("audit kept %d from seq %d, want 20 from 11", n, first)
+	}
+	if n, _ := retained(t, s, "lobby"); n != 5 {
+		t.Fatalf("lobby kept %d, want the default 5", n)
+	}
+
+	s.SetCapacity("audit", 0)
+	if n, first := retained(t, s, "audit"); n != 5 || first != 26 {
+		t.Fatalf("after restoring the default, audit kept %d from seq %d", n, first)
+	}
+}
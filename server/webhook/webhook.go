@@ -0,0 +1,397 @@
+// Package webhook delivers room events to registered HTTP endpoints
+package webhook
+
+import (
+	"bytes"
+	"chatroom/server/metrics"
+	"chatroom/server/model"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventMessageAccepted = "message.accepted" // a TEXT message was accepted
+	EventUserJoined      = "user.joined"      // a JOIN message was accepted
+	EventUserLeft        = "user.left"        // a LEAVE message was accepted
+	EventRoomCreated     = "room.created"     // the first client opened a room on this node
+)
+
+// EventTypes lists every event a hook can subscribe to
+var EventTypes = []string{EventMessageAccepted, EventUserJoined, EventUserLeft, EventRoomCreated}
+
+// Delivery outcomes recorded in the log
+const (
+	StatusDelivered = "delivered"
+	StatusRetrying  = "retrying"
+	StatusFailed    = "failed"
+)
+
+const (
+	queueSize      = 4096
+	hookQueueSize  = 1024
+	maxAttempts    = 6
+	firstBackoff   = time.Second
+	maxBackoff     = time.Minute
+	requestTimeout = 5 * time.Second
+	logSize        = 1000
+)
+
+var deliveries = metrics.NewCounterVec(
+	"chat_webhook_deliveries_total",
+	"Webhook delivery attempts, by result (delivered, retrying, failed, dropped).",
+	"result",
+)
+
+// Event is the JSON body POSTed to hooks
+type Event struct {
+	ID      string                `json:"id"`
+	Type    string                `json:"type"`
+	RoomId  string                `json:"roomId"`
+	NodeId  string                `json:"nodeId"`
+	Time    time.Time             `json:"time"`
+	Message *model.ServerResponse `json:"message,omitempty"`
+}
+
+// Hook is a registered endpoint. RoomId and Events narrow what it receives;
+// empty means every room and every event type.
+type Hook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	RoomId    string    `json:"roomId,omitempty"`
+	Events    []string  `json:"events,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (h *Hook) matches(ev Event) bool {
+	if h.RoomId != "" && h.RoomId != ev.RoomId {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == ev.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is one attempt to deliver an event to a hook
+type Delivery struct {
+	HookId     string     `json:"hookId"`
+	EventId    string     `json:"eventId"`
+	EventType  string     `json:"eventType"`
+	RoomId     string     `json:"roomId"`
+	Attempt    int        `json:"attempt"`
+	Status     string     `json:"status"`
+	StatusCode int        `json:"statusCode,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	DurationMs int64      `json:"durationMs"`
+	Time       time.Time  `json:"time"`
+	NextRetry  *time.Time `json:"nextRetry,omitempty"`
+}
+
+// job is a pending delivery of one event to one hook
+type job struct {
+	event   Event
+	body    []byte
+	attempt int
+}
+
+// hookWorker delivers the jobs of one hook in order, so a slow receiver
+// only delays its own deliveries
+type hookWorker struct {
+	hook Hook
+	jobs chan job
+	done chan struct{}
+}
+
+// Dispatcher queues events and delivers them from its own goroutines, so
+// emitting never waits for a receiver. Failed deliveries are retried with
+// exponential backoff.
+type Dispatcher struct {
+	nodeId       string
+	client       *http.Client
+	events       chan Event
+	firstBackoff time.Duration // before the first retry, doubling up to maxBackoff
+	maxBackoff   time.Duration
+
+	mu    sync.RWMutex
+	hooks map[string]*hookWorker
+
+	logMu sync.Mutex
+	log   []Delivery // ring buffer of the latest attempts
+	next  int
+}
+
+// NewDispatcher starts the delivery workers for node nodeId
+func NewDispatcher(nodeId string) *Dispatcher {
+	d := &Dispatcher{
+		nodeId:       nodeId,
+		client:       &http.Client{Timeout: requestTimeout},
+		events:       make(chan Event, queueSize),
+		firstBackoff: firstBackoff,
+		maxBackoff:   maxBackoff,
+		hooks:        make(map[string]*hookWorker),
+	}
+	go d.fanOutLoop()
+	return d
+}
+
+// Emit queues an event without blocking; it is dropped when the queue is
+// full. A nil Dispatcher ignores events.
+func (d *Dispatcher) Emit(eventType, roomId string, msg *model.ServerResponse) {
+	if d == nil {
+		return
+	}
+	ev := Event{
+		ID:      newID(),
+		Type:    eventType,
+		RoomId:  roomId,
+		NodeId:  d.nodeId,
+		Time:    time.Now(),
+		Message: msg,
+	}
+	select {
+	case d.events <- ev:
+	default:
+		deliveries.Inc("dropped")
+	}
+}
+
+// Register validates and adds a hook, generating its ID and, if missing,
+// its secret
+func (d *Dispatcher) Register(h Hook) (Hook, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Hook{}, errors.New("url must be an absolute http or https URL")
+	}
+	for _, t := range h.Events {
+		if !knownEvent(t) {
+			return Hook{}, fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	if h.Secret == "" {
+		h.Secret = newID() + newID()
+	}
+	h.ID = newID()
+	h.CreatedAt = time.Now()
+
+	hw := &hookWorker{hook: h, jobs: make(chan job, hookQueueSize), done: make(chan struct{})}
+	d.mu.Lock()
+	d.hooks[h.ID] = hw
+	d.mu.Unlock()
+	go d.deliverLoop(hw)
+
+	slog.Info("webhook registered", "hookId", h.ID, "url", h.URL, "roomId", h.RoomId, "events", h.Events)
+	return h, nil
+}
+
+// Unregister removes a hook; queued retries for it are abandoned
+func (d *Dispatcher) Unregister(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hw, ok := d.hooks[id]
+	if !ok {
+		return false
+	}
+	delete(d.hooks, id)
+	close(hw.done)
+	return true
+}
+
+// Hooks returns the registered hooks without their secrets
+func (d *Dispatcher) Hooks() []Hook {
+	d.mu.RLock()
+	hooks := make([]Hook, 0, len(d.hooks))
+	for _, hw := range d.hooks {
+		hook := hw.hook
+		hook.Secret = ""
+		hooks = append(hooks, hook)
+	}
+	d.mu.RUnlock()
+
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks
+}
+
+// Deliveries returns the latest attempts, newest first, optionally only
+// those of one hook
+func (d *Dispatcher) Deliveries(hookId string, limit int) []Delivery {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+
+	var out []Delivery
+	for i := 1; i <= len(d.log); i++ {
+		entry := d.log[(d.next-i+len(d.log))%len(d.log)]
+		if hookId != "" && entry.HookId != hookId {
+			continue
+		}
+		out = append(out, entry)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+func (d *Dispatcher) record(entry Delivery) {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+
+	if len(d.log) < logSize {
+		d.log = append(d.log, entry)
+		d.next = len(d.log) % logSize
+		return
+	}
+	d.log[d.next] = entry
+	d.next = (d.next + 1) % logSize
+}
+
+// fanOutLoop turns each event into one job per matching hook
+func (d *Dispatcher) fanOutLoop() {
+	for ev := range d.events {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			slog.Warn("webhook event encoding failed", "type", ev.Type, "err", err)
+			continue
+		}
+
+		d.mu.RLock()
+		for _, hw := range d.hooks {
+			if hw.hook.matches(ev) {
+				hw.enqueue(job{event: ev, body: body, attempt: 1})
+			}
+		}
+		d.mu.RUnlock()
+	}
+}
+
+// enqueue hands j to the hook's worker; retries that come due after the
+// hook was unregistered are dropped
+func (hw *hookWorker) enqueue(j job) {
+	select {
+	case <-hw.done:
+		return
+	default:
+	}
+	select {
+	case hw.jobs <- j:
+	default:
+		deliveries.Inc("dropped")
+	}
+}
+
+// deliverLoop runs until the hook is unregistered
+func (d *Dispatcher) deliverLoop(hw *hookWorker) {
+	for {
+		select {
+		case j := <-hw.jobs:
+			d.attempt(hw, j)
+		case <-hw.done:
+			return
+		}
+	}
+}
+
+// attempt POSTs the event once and schedules a retry on failure
+func (d *Dispatcher) attempt(hw *hookWorker, j job) {
+	entry := Delivery{
+		HookId:    hw.hook.ID,
+		EventId:   j.event.ID,
+		EventType: j.event.Type,
+		RoomId:    j.event.RoomId,
+		Attempt:   j.attempt,
+		Time:      time.Now(),
+	}
+
+	statusCode, err := d.post(&hw.hook, j)
+	entry.DurationMs = time.Since(entry.Time).Milliseconds()
+	entry.StatusCode = statusCode
+
+	switch {
+	case err == nil:
+		entry.Status = StatusDelivered
+	case j.attempt < maxAttempts:
+		entry.Status = StatusRetrying
+		entry.Error = err.Error()
+		backoff := min(d.firstBackoff<<(j.attempt-1), d.maxBackoff)
+		retryAt := entry.Time.Add(backoff)
+		entry.NextRetry = &retryAt
+		j.attempt++
+		time.AfterFunc(backoff, func() { hw.enqueue(j) })
+	default:
+		entry.Status = StatusFailed
+		entry.Error = err.Error()
+		slog.Warn("webhook delivery failed", "hookId", hw.hook.ID, "eventId", j.event.ID, "attempts", j.attempt, "err", err)
+	}
+
+	deliveries.Inc(entry.Status)
+	d.record(entry)
+}
+
+func (d *Dispatcher) post(hook *Hook, j job) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(j.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chatroom-webhooks/1")
+	req.Header.Set("X-Chat-Event", j.event.Type)
+	req.Header.Set("X-Chat-Delivery", j.event.ID)
+	req.Header.Set("X-Chat-Timestamp", timestamp)
+	req.Header.Set("X-Chat-Signature", "sha256="+Sign(hook.Secret, timestamp, j.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret,
+// as sent in X-Chat-Signature. Receivers recompute it to verify a delivery
+// and should reject old timestamps to prevent replays.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func knownEvent(t string) bool {
+	for _, known := range EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
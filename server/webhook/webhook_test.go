@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver records the deliveries it gets and answers with the status
+// codes in replies, then 200
+type receiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+	replies  []int
+	always   int // answered once replies run out, if set
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	rc.times = append(rc.times, time.Now())
+
+	status := http.StatusOK
+	if n := len(rc.requests); n <= len(rc.replies) {
+		status = rc.replies[n-1]
+	} else if rc.always != 0 {
+		status = rc.always
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.requests)
+}
+
+func newTestDispatcher(t *testing.T) *Dispatcher {
+	t.Helper()
+	d := NewDispatcher("node-1")
+	d.firstBackoff = 10 * time.Millisecond
+	d.maxBackoff = 40 * time.Millisecond
+	return d
+}
+
+func register(t *testing.T, d *Dispatcher, url string) Hook {
+	t.Helper()
+	hook, err := d.Register(Hook{URL: url, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDeliverySignature(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	register(t, d, srv.URL)
+	d.Emit(EventRoomCreated, "r1", nil)
+	waitFor(t, "a delivery", func() bool { return rc.count() == 1 })
+
+	req, body := rc.requests[0], rc.bodies[0]
+	timestamp := req.Header.Get("X-Chat-Timestamp")
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get("X-Chat-Signature"); got != want {
+		t.Errorf("X-Chat-Signature = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-Chat-Event"); got != EventRoomCreated {
+		t.Errorf("X-Chat-Event = %q, want %q", got, EventRoomCreated)
+	}
+
+	var ev Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != EventRoomCreated || ev.RoomId != "r1" || ev.NodeId != "node-1" {
+		t.Errorf("event = %+v", ev)
+	}
+	if got := req.Header.Get("X-Chat-Delivery"); got != ev.ID {
+		t.Errorf("X-Chat-Delivery = %q, want event ID %q", got, ev.ID)
+	}
+}
+
+func TestRetriesWithBackoff(t *testing.T) {
+	rc := &receiver{replies: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	hook := register(t, d, srv.URL)
+	d.Emit(EventRoomCreated, "r1", nil)
+	waitFor(t, "the third attempt", func() bool { return rc.count() == 3 })
+	waitFor(t, "the log entry", func() bool { return len(d.Deliveries(hook.ID, 0)) == 3 })
+
+	rc.mu.Lock()
+	for i, wait := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond} {
+		if gap := rc.times[i+1].Sub(rc.times[i]); gap < wait {
+			t.Errorf("retry %d came after %s, want at least %s", i+1, gap, wait)
+		}
+	}
+	rc.mu.Unlock()
+
+	log := d.Deliveries(hook.ID, 0) // newest first
+	want := []struct {
+		status string
+		code   int
+	}{
+		{StatusDelivered, http.StatusOK},
+		{StatusRetrying, http.StatusBadGateway},
+		{StatusRetrying, http.StatusInternalServerError},
+	}
+	for i, w := range want {
+		entry := log[i]
+		if entry.Status != w.status || entry.StatusCode != w.code || entry.Attempt != 3-i {
+			t.Errorf("log[%d] = %s/%d attempt %d, want %s/%d attempt %d",
+				i, entry.Status, entry.StatusCode, entry.Attempt, w.status, w.code, 3-i)
+		}
+		if (entry.Status == StatusRetrying) != (entry.NextRetry != nil) {
+			t.Errorf("log[%d] nextRetry = %v with status %s", i, entry.NextRetry, entry.Status)
+		}
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	rc := &receiver{always: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	hook := register(t, d, srv.URL)
+	d.Emit(EventRoomCreated, "r1", nil)
+	waitFor(t, "a failed delivery", func() bool {
+		log := d.Deliveries(hook.ID, 1)
+		return len(log) == 1 && log[0].Status == StatusFailed
+	})
+
+	// Leave time for a retry that should not happen
+	time.Sleep(100 * time.Millisecond)
+	if got := rc.count(); got != maxAttempts {
+		t.Errorf("receiver got %d attempts, want %d", got, maxAttempts)
+	}
+	failed := d.Deliveries(hook.ID, 1)[0]
+	if failed.Attempt != maxAttempts || failed.Error == "" || failed.NextRetry != nil {
+		t.Errorf("last entry = %+v", failed)
+	}
+}
+
+func TestUnregisterAbandonsRetries(t *testing.T) {
+	rc := &receiver{always: http.StatusInternalServerError}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	d.firstBackoff = 50 * time.Millisecond
+	hook := register(t, d, srv.URL)
+	d.Emit(EventRoomCreated, "r1", nil)
+	waitFor(t, "the first attempt", func() bool { return len(d.Deliveries(hook.ID, 0)) == 1 })
+
+	d.mu.RLock()
+	hw := d.hooks[hook.ID]
+	d.mu.RUnlock()
+	if !d.Unregister(hook.ID) {
+		t.Fatal("Unregister found no hook")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := rc.count(); got != 1 {
+		t.Errorf("receiver got %d attempts after the hook was removed, want 1", got)
+	}
+	if n := len(hw.jobs); n != 0 {
+		t.Errorf("%d retries were queued to the stopped worker", n)
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	first := register(t, d, srv.URL)
+	second, err := d.Register(Hook{URL: srv.URL, RoomId: "r2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Emit(EventRoomCreated, "r1", nil)
+	d.Emit(EventRoomCreated, "r2", nil)
+	waitFor(t, "three deliveries", func() bool { return len(d.Deliveries("", 0)) == 3 })
+
+	if got := len(d.Deliveries(first.ID, 0)); got != 2 {
+		t.Errorf("first hook has %d deliveries, want 2", got)
+	}
+	log := d.Deliveries(second.ID, 0)
+	if len(log) != 1 || log[0].RoomId != "r2" || log[0].Status != StatusDelivered {
+		t.Errorf("second hook deliveries = %+v, want one for r2", log)
+	}
+	if got := len(d.Deliveries("", 2)); got != 2 {
+		t.Errorf("limit 2 returned %d deliveries", got)
+	}
+}